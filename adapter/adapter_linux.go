@@ -0,0 +1,251 @@
+package adapter
+
+import (
+	"errors"
+	"net"
+	"os"
+	"os/exec"
+	"syscall"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// LinuxAdapter linux tap adapter
+type LinuxAdapter struct {
+	name string
+	mac  net.HardwareAddr
+
+	file *os.File
+	conn syscall.RawConn
+
+	readBuf []uint8
+}
+
+const (
+	tunDevice     = "/dev/net/tun"
+	readBatchSize = 64    // maximum number of frames returned by a single Read
+	readFrameSize = 65536 // large enough for any frame a tap device can hand out
+)
+
+// GetName get name
+func (a *LinuxAdapter) GetName() string {
+	return a.name
+}
+
+// Read read packets, all frames queued on the tap device are returned at once
+func (a *LinuxAdapter) Read() (p []Packet, err error) {
+	var readErr error
+	err = a.conn.Read(func(fd uintptr) bool {
+		for len(p) < readBatchSize {
+			n, err := unix.Read(int(fd), a.readBuf)
+			if nil != err {
+				if err == unix.EAGAIN || err == unix.EINTR {
+					break
+				}
+				readErr = err
+				return true
+			}
+			if n == 0 {
+				break
+			}
+			frame := make(Packet, n)
+			copy(frame, a.readBuf[:n])
+			p = append(p, frame)
+		}
+
+		// wait for the fd to become readable again if nothing was read
+		return len(p) > 0
+	})
+
+	if nil != err {
+		return nil, err
+	}
+	if nil != readErr && len(p) == 0 {
+		return nil, readErr
+	}
+
+	printPackets("reading", p)
+	return p, nil
+}
+
+// Write write packets
+func (a *LinuxAdapter) Write(p []Packet) (err error) {
+	printPackets("writing", p)
+	for _, x := range p {
+		if _, err := a.file.Write(x); nil != err {
+			return err
+		}
+	}
+	return nil
+}
+
+// Destroy destroy adapter, a non-persistent tap device vanishes with its fd
+func (a *LinuxAdapter) Destroy() {
+	_ = a.file.Close()
+}
+
+// ErrInvalidAdapterName invalid adapter name
+var ErrInvalidAdapterName = errors.New("invalid adapter name, valid names are 1 to 15 characters")
+
+func createLocalMachineAdapter(name string, mac string) (Adapter, error) {
+	if len(name) == 0 || len(name) >= unix.IFNAMSIZ {
+		return nil, ErrInvalidAdapterName
+	}
+
+	hw, err := net.ParseMAC(mac)
+	if nil != err {
+		return nil, err
+	}
+
+	a := &LinuxAdapter{name: name, mac: hw}
+	if err := a.createTap(); nil != err {
+		return nil, err
+	}
+
+	if err := a.setLinkUp(); nil != err {
+		a.Destroy()
+		return nil, err
+	}
+
+	return a, nil
+}
+
+// ifReqFlags struct ifreq with the ifr_flags member
+type ifReqFlags struct {
+	Name  [unix.IFNAMSIZ]byte
+	Flags uint16
+	_     [40 - unix.IFNAMSIZ - 2]byte
+}
+
+func (a *LinuxAdapter) createTap() error {
+	fd, err := unix.Open(tunDevice, unix.O_RDWR|unix.O_CLOEXEC, 0)
+	if nil != err {
+		return err
+	}
+
+	req := ifReqFlags{Flags: unix.IFF_TAP | unix.IFF_NO_PI}
+	copy(req.Name[:], a.name)
+	if _, _, errno := unix.Syscall(unix.SYS_IOCTL, uintptr(fd), unix.TUNSETIFF, uintptr(unsafe.Pointer(&req))); 0 != errno {
+		unix.Close(fd)
+		return errno
+	}
+
+	// the go runtime poller takes care of blocking reads & writes
+	if err := unix.SetNonblock(fd, true); nil != err {
+		unix.Close(fd)
+		return err
+	}
+
+	a.file = os.NewFile(uintptr(fd), tunDevice)
+	if a.conn, err = a.file.SyscallConn(); nil != err {
+		a.file.Close()
+		return err
+	}
+	a.readBuf = make([]uint8, readFrameSize)
+
+	return nil
+}
+
+// setLinkUp set the link layer address and bring the link up with a single RTM_NEWLINK
+func (a *LinuxAdapter) setLinkUp() error {
+	iface, err := net.InterfaceByName(a.name)
+	if nil != err {
+		return err
+	}
+
+	fd, err := unix.Socket(unix.AF_NETLINK, unix.SOCK_RAW|unix.SOCK_CLOEXEC, unix.NETLINK_ROUTE)
+	if nil != err {
+		return err
+	}
+	defer unix.Close(fd)
+
+	if err := unix.Bind(fd, &unix.SockaddrNetlink{Family: unix.AF_NETLINK}); nil != err {
+		return err
+	}
+
+	attrLen := unix.SizeofRtAttr + len(a.mac)
+	msgLen := unix.NLMSG_HDRLEN + unix.SizeofIfInfomsg + rtaAlign(attrLen)
+	b := make([]byte, msgLen)
+
+	hdr := (*unix.NlMsghdr)(unsafe.Pointer(&b[0]))
+	hdr.Len = uint32(msgLen)
+	hdr.Type = unix.RTM_NEWLINK
+	hdr.Flags = unix.NLM_F_REQUEST | unix.NLM_F_ACK
+	hdr.Seq = 1
+
+	info := (*unix.IfInfomsg)(unsafe.Pointer(&b[unix.NLMSG_HDRLEN]))
+	info.Family = unix.AF_UNSPEC
+	info.Index = int32(iface.Index)
+	info.Flags = unix.IFF_UP
+	info.Change = unix.IFF_UP
+
+	attr := (*unix.RtAttr)(unsafe.Pointer(&b[unix.NLMSG_HDRLEN+unix.SizeofIfInfomsg]))
+	attr.Len = uint16(attrLen)
+	attr.Type = unix.IFLA_ADDRESS
+	copy(b[unix.NLMSG_HDRLEN+unix.SizeofIfInfomsg+unix.SizeofRtAttr:], a.mac)
+
+	if err := unix.Sendto(fd, b, 0, &unix.SockaddrNetlink{Family: unix.AF_NETLINK}); nil != err {
+		return err
+	}
+
+	return readNetlinkAck(fd, hdr.Seq)
+}
+
+// ErrNetlinkNoAck no netlink ack
+var ErrNetlinkNoAck = errors.New("no netlink ack")
+
+func readNetlinkAck(fd int, seq uint32) error {
+	buf := make([]byte, unix.Getpagesize())
+	for {
+		n, _, err := unix.Recvfrom(fd, buf, 0)
+		if nil != err {
+			return err
+		}
+
+		msgs, err := syscall.ParseNetlinkMessage(buf[:n])
+		if nil != err {
+			return err
+		}
+
+		for _, m := range msgs {
+			if m.Header.Seq != seq {
+				continue
+			}
+			if m.Header.Type != unix.NLMSG_ERROR {
+				continue
+			}
+			if len(m.Data) < 4 {
+				return ErrNetlinkNoAck
+			}
+			if errno := *(*int32)(unsafe.Pointer(&m.Data[0])); 0 != errno {
+				return syscall.Errno(-errno)
+			}
+			return nil
+		}
+	}
+}
+
+func rtaAlign(x int) int {
+	return (x + unix.RTA_ALIGNTO - 1) &^ (unix.RTA_ALIGNTO - 1)
+}
+
+var dhcpClients = [][]string{
+	{"dhclient"},
+	{"udhcpc", "-q", "-i"},
+	{"dhcpcd"},
+}
+
+// ErrNoDHCPClient no dhcp client
+var ErrNoDHCPClient = errors.New("no dhcp client found, tried dhclient, udhcpc and dhcpcd")
+
+func invokeDHCP(a Adapter) error {
+	for _, c := range dhcpClients {
+		if path, err := exec.LookPath(c[0]); nil == err {
+			args := append(append([]string{}, c[1:]...), a.GetName())
+			_, err := exec.Command(path, args...).Output()
+			return err
+		}
+	}
+	return ErrNoDHCPClient
+}
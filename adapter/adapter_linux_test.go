@@ -0,0 +1,36 @@
+package adapter
+
+import (
+	"net"
+	"os"
+	"testing"
+)
+
+func TestAdapter(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("root is required to create a tap device")
+	}
+
+	a, err := CreateLocalMachineAdapter("setap0", "5e:22:33:44:55:66")
+	if nil != err {
+		t.Skip("create error:", err)
+	}
+	defer a.Destroy()
+
+	iface, err := net.InterfaceByName(a.GetName())
+	if nil != err {
+		t.Fatal(err)
+	}
+	if iface.HardwareAddr.String() != "5e:22:33:44:55:66" {
+		t.Error("unexpected mac:", iface.HardwareAddr)
+	}
+	if iface.Flags&net.FlagUp == 0 {
+		t.Error("link is not up")
+	}
+
+	// the kernel sends router solicitations etc. once the link is up, but
+	// an empty write must never fail
+	if err := a.Write(nil); nil != err {
+		t.Error(err)
+	}
+}
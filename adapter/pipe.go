@@ -0,0 +1,167 @@
+package adapter
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+)
+
+// DropPolicy what a pipe does with a write when the queue is full
+type DropPolicy uint32
+
+const (
+	DROP_NONE   DropPolicy = 0 // Block the writer until there is room
+	DROP_NEWEST DropPolicy = 1 // Discard the batch being written
+	DROP_OLDEST DropPolicy = 2 // Discard the oldest queued batch to make room
+)
+
+// PipeOption pipe options
+type PipeOption struct {
+	QueueDepth int        // number of batches queued per direction
+	DropPolicy DropPolicy // behavior when the queue is full
+	MTU        int        // maximum payload size excluding the ethernet header, 0 means unlimited
+}
+
+// DefaultPipeOption default pipe options
+var DefaultPipeOption = PipeOption{
+	QueueDepth: 16,
+	DropPolicy: DROP_NONE,
+}
+
+const etherHeaderSize = 14
+
+// ErrPipeClosed the pipe is destroyed
+var ErrPipeClosed = errors.New("pipe closed")
+
+type pipe struct {
+	option PipeOption
+	done   chan struct{}
+	once   sync.Once
+}
+
+// PipeAdapter one end of an in-memory pipe
+type PipeAdapter struct {
+	dropped uint64 // first word for 64-bit atomic alignment on 32-bit platforms
+
+	*pipe
+	name string
+	r    chan []Packet
+	w    chan []Packet
+}
+
+// NewPipe create two connected in-memory adapters with the default options
+func NewPipe() (Adapter, Adapter) {
+	return NewPipeEx(DefaultPipeOption)
+}
+
+// NewPipeEx create two connected in-memory adapters, whatever is written to
+// one end is read from the other. Ownership of written packets passes to the
+// pipe, they are not copied.
+func NewPipeEx(o PipeOption) (Adapter, Adapter) {
+	if o.QueueDepth <= 0 {
+		o.QueueDepth = DefaultPipeOption.QueueDepth
+	}
+
+	p := &pipe{option: o, done: make(chan struct{})}
+	l2r := make(chan []Packet, o.QueueDepth)
+	r2l := make(chan []Packet, o.QueueDepth)
+
+	left := &PipeAdapter{pipe: p, name: "pipe0", r: r2l, w: l2r}
+	right := &PipeAdapter{pipe: p, name: "pipe1", r: l2r, w: r2l}
+	return left, right
+}
+
+// GetName get name
+func (a *PipeAdapter) GetName() string {
+	return a.name
+}
+
+// Destroy destroy both ends of the pipe
+func (a *PipeAdapter) Destroy() {
+	a.once.Do(func() {
+		close(a.done)
+	})
+}
+
+// Dropped number of packets dropped on write, by the drop policy or the MTU
+func (a *PipeAdapter) Dropped() uint64 {
+	return atomic.LoadUint64(&a.dropped)
+}
+
+// Read read packets
+func (a *PipeAdapter) Read() (p []Packet, err error) {
+	select {
+	case p = <-a.r:
+		printPackets("reading", p)
+		return p, nil
+	case <-a.done:
+		return nil, ErrPipeClosed
+	}
+}
+
+// Write write packets
+func (a *PipeAdapter) Write(p []Packet) (err error) {
+	select {
+	case <-a.done:
+		return ErrPipeClosed
+	default:
+	}
+
+	if p = a.filter(p); len(p) == 0 {
+		return nil
+	}
+	printPackets("writing", p)
+
+	switch a.option.DropPolicy {
+	case DROP_NEWEST:
+		select {
+		case a.w <- p:
+		default:
+			atomic.AddUint64(&a.dropped, uint64(len(p)))
+		}
+		return nil
+	case DROP_OLDEST:
+		for {
+			select {
+			case a.w <- p:
+				return nil
+			default:
+			}
+			select {
+			case old := <-a.w:
+				atomic.AddUint64(&a.dropped, uint64(len(old)))
+			default:
+			}
+		}
+	default:
+		select {
+		case a.w <- p:
+			return nil
+		case <-a.done:
+			return ErrPipeClosed
+		}
+	}
+}
+
+// filter drop packets exceeding the MTU
+func (a *PipeAdapter) filter(p []Packet) []Packet {
+	if a.option.MTU <= 0 {
+		return p
+	}
+
+	max := a.option.MTU + etherHeaderSize
+	for _, x := range p {
+		if len(x) > max {
+			ret := make([]Packet, 0, len(p))
+			for _, x := range p {
+				if len(x) > max {
+					atomic.AddUint64(&a.dropped, 1)
+				} else {
+					ret = append(ret, x)
+				}
+			}
+			return ret
+		}
+	}
+	return p
+}
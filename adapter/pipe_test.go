@@ -0,0 +1,74 @@
+package adapter
+
+import (
+	"testing"
+)
+
+func TestPipe(t *testing.T) {
+	left, right := NewPipe()
+
+	go func() {
+		_ = left.Write([]Packet{{1, 2, 3}, {4, 5}})
+	}()
+
+	p, err := right.Read()
+	if nil != err {
+		t.Fatal(err)
+	}
+	if len(p) != 2 || len(p[0]) != 3 || len(p[1]) != 2 {
+		t.Error("unexpected packets:", p)
+	}
+
+	right.Destroy()
+	if _, err := left.Read(); err != ErrPipeClosed {
+		t.Error("expected ErrPipeClosed, got", err)
+	}
+	if err := left.Write([]Packet{{1}}); err != ErrPipeClosed {
+		t.Error("expected ErrPipeClosed, got", err)
+	}
+}
+
+func TestPipeDropPolicy(t *testing.T) {
+	for _, policy := range []DropPolicy{DROP_NEWEST, DROP_OLDEST} {
+		left, right := NewPipeEx(PipeOption{QueueDepth: 2, DropPolicy: policy})
+		for i := uint8(0); i < 4; i++ {
+			if err := left.Write([]Packet{{i}}); nil != err {
+				t.Fatal(err)
+			}
+		}
+
+		if dropped := left.(*PipeAdapter).Dropped(); dropped != 2 {
+			t.Error("policy", policy, "dropped", dropped)
+		}
+
+		first := uint8(0)
+		if policy == DROP_OLDEST {
+			first = 2
+		}
+		for i := first; i < first+2; i++ {
+			if p, err := right.Read(); nil != err {
+				t.Fatal(err)
+			} else if p[0][0] != i {
+				t.Error("policy", policy, "expected", i, "got", p[0][0])
+			}
+		}
+	}
+}
+
+func TestPipeMTU(t *testing.T) {
+	left, right := NewPipeEx(PipeOption{MTU: 1500})
+	big := make(Packet, 1500+etherHeaderSize+1)
+	small := make(Packet, 1500+etherHeaderSize)
+	if err := left.Write([]Packet{big, small}); nil != err {
+		t.Fatal(err)
+	}
+
+	if p, err := right.Read(); nil != err {
+		t.Fatal(err)
+	} else if len(p) != 1 || len(p[0]) != len(small) {
+		t.Error("oversized packet was not dropped")
+	}
+	if dropped := left.(*PipeAdapter).Dropped(); dropped != 1 {
+		t.Error("dropped", dropped)
+	}
+}
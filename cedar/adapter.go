@@ -1,11 +1,18 @@
 package cedar
 
-import "go-softether/adapter"
+import (
+	"context"
+	"go-softether/adapter"
+	"sync"
+)
 
 type sessionAdapter struct {
 	*Session
 	l2r chan []adapter.Packet // local to remote
 	r2l chan []adapter.Packet // remote to local
+
+	quit chan struct{}
+	once sync.Once
 }
 
 func (a *sessionAdapter) GetName() string {
@@ -13,14 +20,55 @@ func (a *sessionAdapter) GetName() string {
 }
 
 func (a *sessionAdapter) Destroy() {
-	a.Connection.tcp[0].Close()
+	a.once.Do(func() {
+		close(a.quit)
+	})
+}
+
+// quitContext a context cancelled once the adapter is destroyed, so that
+// logins in the background do not hold Destroy back
+func (a *sessionAdapter) quitContext() (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		select {
+		case <-a.quit:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	return ctx, cancel
 }
 
+// Read read packets, once the session is over the error is returned
 func (a *sessionAdapter) Read() (p []adapter.Packet, err error) {
-	return <-a.r2l, nil
+	if p, ok := <-a.r2l; ok {
+		return p, nil
+	}
+	return nil, a.Err()
 }
 
+// Write write packets, once the session is over the error is returned
 func (a *sessionAdapter) Write(p []adapter.Packet) (err error) {
-	a.l2r <- p
-	return nil
+	select {
+	case <-a.Done():
+		return a.Err()
+	default:
+	}
+
+	// frames go over udp while it works, the rest fall back to tcp
+	if ua := a.udpAccel(); nil != ua && ua.IsSendReady() {
+		for len(p) > 0 && nil == ua.Send(p[0]) {
+			p = p[1:]
+		}
+		if len(p) == 0 {
+			return nil
+		}
+	}
+
+	select {
+	case a.l2r <- p:
+		return nil
+	case <-a.Done():
+		return a.Err()
+	}
 }
@@ -0,0 +1,119 @@
+package cedar
+
+import (
+	"bytes"
+	"go-softether/mayaqua"
+	"net"
+	"testing"
+)
+
+func TestOutRpcNodeInfo(t *testing.T) {
+	info := NodeInfo{
+		ClientProductName: "Go SoftEther VPN Client",
+		ClientProductVer:  446,
+		ClientIpAddress:   mayaqua.IPToUINT(net.IPv4(192, 168, 0, 2)),
+		ServerPort:        443,
+		ProxyPort:         8080,
+		HubName:           "DEFAULT",
+		UniqueId:          [16]byte{1, 2, 3},
+	}
+	p := &mayaqua.Pack{}
+	if err := OutRpcNodeInfo(p, info); nil != err {
+		t.Fatal(err)
+	}
+
+	// the names written by SoftEther's OutRpcNodeInfo
+	for _, name := range []string{"ClientProductName", "ServerProductName", "ClientOsName", "ClientOsVer",
+		"ClientOsProductId", "ClientHostname", "ServerHostname", "ProxyHostname", "HubName", "UniqueId",
+		"ClientProductVer", "ClientProductBuild", "ServerProductVer", "ServerProductBuild",
+		"ClientIpAddress", "ClientIpAddress@ipv6_bool", "ClientIpAddress6", "ClientPort",
+		"ServerIpAddress", "ServerIpAddress6", "ServerPort2", "ProxyIpAddress", "ProxyIpAddress6", "ProxyPort"} {
+		if nil == p.GetElement(name, mayaqua.ValueType(mayaqua.INFINITE)) {
+			t.Error("missing", name)
+		}
+	}
+	if nil != p.GetElement("ServerPort", mayaqua.ValueType(mayaqua.INFINITE)) ||
+		nil != p.GetElement("Padding", mayaqua.ValueType(mayaqua.INFINITE)) {
+		t.Error("unexpected element")
+	}
+	if p.GetInt("ServerPort2") != 443 || p.GetInt("ClientIpAddress") != info.ClientIpAddress ||
+		!bytes.Equal(p.GetData("UniqueId"), info.UniqueId[:]) || len(p.GetData("ClientIpAddress6")) != 16 {
+		t.Error("unexpected values")
+	}
+
+	// and back
+	got := NodeInfo{}
+	if err := mayaqua.Unmarshal(p, &got); nil != err {
+		t.Fatal(err)
+	}
+	if got != info {
+		t.Errorf("got %+v", got)
+	}
+}
+
+func TestOutRpcWinVer(t *testing.T) {
+	p := &mayaqua.Pack{}
+	if err := OutRpcWinVer(p, RPCWinVer{IsWindows: true, VerMajor: 10, Title: "linux/amd64"}); nil != err {
+		t.Fatal(err)
+	}
+	if !p.GetBool("V_IsWindows") || p.GetBool("V_IsNT") || p.GetInt("V_VerMajor") != 10 || p.GetStr("V_Title") != "linux/amd64" {
+		t.Error("unexpected values")
+	}
+	if len(p.Elements) != 9 {
+		t.Error("elements", len(p.Elements))
+	}
+}
+
+func TestPackGetPolicy(t *testing.T) {
+	p := &mayaqua.Pack{}
+	p.AddBool("policy:Access", true)
+	p.AddBool("policy:NoQoS", true)
+	p.AddInt("policy:MaxConnection", 32)
+	p.AddInt("policy:VLanId", 7)
+	p.AddBool("policy:Ver3", true)
+	p.AddBool("Access", false)
+	p.AddInt("MaxMac", 9)
+
+	po := PackGetPolicy(p)
+	if po != (Policy{Access: true, NoQoS: true, MaxConnection: 32, VLanId: 7, Ver3: true}) {
+		t.Errorf("got %+v", po)
+	}
+}
+
+func TestCreateNodeInfo(t *testing.T) {
+	ts := newTestServer(t)
+	defer ts.close()
+
+	var client, server net.IP
+	ts.welcome = func(auth *mayaqua.Pack, random []byte) *mayaqua.Pack {
+		client, server = auth.GetIp("ClientIpAddress"), auth.GetIp("ServerIpAddress")
+		return defaultTestWelcome(auth)
+	}
+
+	conn := newTestConnection(ts.port())
+	if err := conn.ClientConnect(); nil != err {
+		t.Fatal(err)
+	}
+	conn.Disconnect()
+
+	if !client.Equal(net.IPv4(127, 0, 0, 1)) || !server.Equal(net.IPv4(127, 0, 0, 1)) {
+		t.Error("unexpected addresses", client, server)
+	}
+}
+
+func TestNodeInfoIp(t *testing.T) {
+	info := NodeInfo{}
+	nodeInfoIp(net.IPv4(10, 0, 0, 1), &info.ClientIpAddress, &info.ClientIpAddress6)
+	nodeInfoIp(net.ParseIP("2001:db8::1"), &info.ServerIpAddress, &info.ServerIpAddress6)
+
+	p := &mayaqua.Pack{}
+	if err := OutRpcNodeInfo(p, info); nil != err {
+		t.Fatal(err)
+	}
+	if !p.GetIp("ClientIpAddress").Equal(net.IPv4(10, 0, 0, 1)) || info.ClientIpAddress6 != [16]byte{} {
+		t.Error("unexpected client address")
+	}
+	if !net.IP(p.GetData("ServerIpAddress6")).Equal(net.ParseIP("2001:db8::1")) || 0 != info.ServerIpAddress {
+		t.Error("unexpected server address")
+	}
+}
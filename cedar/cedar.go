@@ -25,6 +25,17 @@ const (
 const (
 	KEEP_ALIVE_MAGIC   uint32 = 0xffffffff
 	MAX_KEEPALIVE_SIZE uint32 = 512
+	MAX_BLOCK_NUM      uint32 = 65536 // Sanity limit of packets in a single block
+	MAX_BLOCK_SIZE     uint32 = 65536 // Sanity limit of a single packet in a block
+)
+const (
+	TIMEOUT_DEFAULT        uint32 = 30 // Default time-out period (in seconds)
+	KEEP_ALIVE_INTERVAL    uint32 = 3  // Keep-alive interval (in seconds)
+	RETRY_INTERVAL_DEFAULT uint32 = 1  // Default initial reconnect interval (in seconds)
+	RETRY_INTERVAL_MAX     uint32 = 60 // Maximum reconnect interval after backoff (in seconds)
+
+	MAX_TCP_CONNECTION                     uint32 = 32 // Maximum number of TCP connections
+	ADDITIONAL_CONNECTION_INTERVAL_DEFAULT uint32 = 1  // Default interval between additional connections (in seconds)
 )
 
 //////////////////////////////////////////////////////////////////////
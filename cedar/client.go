@@ -0,0 +1,248 @@
+package cedar
+
+import (
+	"context"
+	"errors"
+	"go-softether/mayaqua"
+	"net"
+	"time"
+)
+
+// ErrUseEncryptFalse the server refused to encrypt the session
+var ErrUseEncryptFalse = errors.New("use_encrypt is false")
+
+// ClientConnect run the whole login sequence on a fresh tcp stream and switch
+// the connection to tunneling mode, it may be called again to reconnect
+func (c *Connection) ClientConnect() error {
+	return c.ClientConnectContext(context.Background())
+}
+
+// ClientConnectContext ClientConnect aborted when ctx is done, the sequence
+// lasts TIMEOUT_DEFAULT at most unless ctx has a deadline
+func (c *Connection) ClientConnectContext(ctx context.Context) error {
+	c.Disconnect()
+	c.goHome()
+
+	if err := c.checkLoginConfig(); nil != err {
+		return err
+	}
+
+	ctx, cancel := loginContext(ctx)
+	defer cancel()
+
+	for redirected := false; ; redirected = true {
+		s, err := c.ClientConnectToServerContext(ctx)
+		if nil != err {
+			return err
+		}
+
+		r, err := c.clientLogin(ctx, s)
+		if nil == err && nil == r {
+			c.StartTunnelingMode()
+			return nil
+		}
+
+		if nil == err && redirected {
+			// farm members do not redirect
+			err = ERR_PROTOCOL_ERROR
+		} else if nil == err {
+			// the controller waits for an empty pack before we leave
+			mayaqua.HttpClientSendContext(ctx, s, &mayaqua.Pack{})
+			c.redirectTo(r)
+		}
+		c.Disconnect()
+		if nil != err {
+			return err
+		}
+	}
+}
+
+// loginContext bound ctx by TIMEOUT_DEFAULT unless it has a deadline, so that
+// a silent server does not hang the login
+func loginContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	if _, ok := ctx.Deadline(); ok {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, time.Duration(TIMEOUT_DEFAULT)*time.Second)
+}
+
+// clientLogin log in on the first tcp stream, a cluster controller may
+// redirect us to a farm member instead
+func (c *Connection) clientLogin(ctx context.Context, s *mayaqua.Sock) (*Redirect, error) {
+	if !c.Session.ClientOption.NoUdpAcceleration && PROXY_DIRECT == c.ProxyType {
+		// udp acceleration is optional, carry on without it
+		if ua, err := NewUdpAccel(s.LocalAddr().(*net.TCPAddr).IP); nil == err {
+			c.Session.setUdpAccel(ua)
+		}
+	}
+
+	if req, err := c.ClientUploadSignatureContext(ctx, s); nil != err {
+		return nil, err
+	} else if err := c.ClientDownloadHelloContext(ctx, s, req); nil != err {
+		return nil, err
+	}
+
+	// TODO: IsAdminPackSupportedServerProduct
+
+	// ClientCheckServerCert ran during the tls handshake
+
+	var welcome *mayaqua.Pack
+	if req, err := c.ClientUploadAuthContext(ctx); nil != err {
+		return nil, err
+	} else if p, err := mayaqua.HttpClientRecvContext(ctx, s, req, c.PackLimits); nil != err {
+		return nil, err
+	} else if e := p.GetError(); 0 != e {
+		return nil, ErrorCode(e)
+	} else if brandedCfroms := p.GetStr("branded_cfroms"); len(brandedCfroms) > 0 && "Branded_VPN" != brandedCfroms {
+		return nil, ERR_BRANDED_C_FROM_S
+	} else {
+		welcome = p
+	}
+
+	// TODO: client update notification
+
+	if msg := string(welcome.GetData("Msg")); "" != msg {
+		// TODO: msg from server
+	}
+
+	if welcome.GetInt("Redirect") != 0 {
+		return GetRedirectFromPack(welcome)
+	}
+
+	sessionName, connectionName, policy := ParseWelcomeFromPack(welcome)
+
+	if sessionKey, sessionKey32, err := GetSessionKeyFromPack(welcome); nil != err {
+		return nil, err
+	} else {
+		c.Session.SessionKey = sessionKey
+		c.Session.SessionKey32 = sessionKey32
+	}
+
+	if welcome.GetInt("use_encrypt") == 0 {
+		return nil, ErrUseEncryptFalse
+	}
+
+	// TODO: Deploy and update connection parameters
+
+	c.Name = connectionName
+
+	c.Session.Name = sessionName
+	c.Session.Policy = policy
+	c.Session.Policy.MaxConnection = welcome.GetInt("max_connection")
+	c.Session.HalfConnection = welcome.GetBool("half_connection") && c.Session.maxConnection() >= 2
+
+	if ua := c.Session.udpAccel(); nil != ua {
+		if err := c.initUdpAccel(ua, welcome); nil != err {
+			ua.Close()
+			c.Session.setUdpAccel(nil)
+		}
+	}
+
+	return nil, nil
+}
+
+// initUdpAccel apply the udp acceleration parameters of the welcome pack
+func (c *Connection) initUdpAccel(ua *UdpAccel, p *mayaqua.Pack) error {
+	if !p.GetBool("use_udp_acceleration") {
+		return ErrUdpAccelNotReady
+	}
+
+	// servers predating V2 leave the version out
+	version := p.GetInt("udp_acceleration_version")
+	if 0 == version {
+		version = 1
+	}
+	key := p.GetData("udp_acceleration_server_key")
+	if 2 == version {
+		key = p.GetData("udp_acceleration_server_key_v2")
+	}
+
+	// the server may not know its public address
+	ip := p.GetIp("udp_acceleration_server_ip")
+	if nil == ip || ip.IsUnspecified() {
+		ip = c.firstSock.RemoteAddr().(*net.TCPAddr).IP
+	}
+
+	return ua.Init(version, key, ip,
+		p.GetInt("udp_acceleration_server_port"),
+		p.GetInt("udp_acceleration_client_cookie"),
+		p.GetInt("udp_acceleration_server_cookie"))
+}
+
+// Disconnect close every socket of the connection
+func (c *Connection) Disconnect() {
+	if ua := c.Session.udpAccel(); nil != ua {
+		ua.Close()
+		c.Session.setUdpAccel(nil)
+	}
+	if nil != c.firstSock {
+		c.firstSock.Close()
+		c.firstSock = nil
+	}
+	for _, ts := range c.tcp {
+		ts.Sock.Close()
+	}
+	c.tcp = nil
+	c.tubeSock = nil
+}
+
+// ClientAdditionalConnect open one more tcp stream for the established
+// session, its direction is assigned by the server in half-connection mode
+func (c *Connection) ClientAdditionalConnect() (*TcpSock, error) {
+	return c.ClientAdditionalConnectContext(context.Background())
+}
+
+// ClientAdditionalConnectContext ClientAdditionalConnect aborted when ctx is
+// done, it lasts TIMEOUT_DEFAULT at most unless ctx has a deadline
+func (c *Connection) ClientAdditionalConnectContext(ctx context.Context) (*TcpSock, error) {
+	ctx, cancel := loginContext(ctx)
+	defer cancel()
+
+	s, _, err := c.dialServer(ctx)
+	if nil != err {
+		return nil, err
+	}
+
+	if direction, err := c.clientAdditionalLogin(ctx, s); nil != err {
+		s.Close()
+		return nil, err
+	} else {
+		return &TcpSock{Sock: s, Direction: direction}, nil
+	}
+}
+
+func (c *Connection) clientAdditionalLogin(ctx context.Context, s *mayaqua.Sock) (TcpDirection, error) {
+	if req, err := c.ClientUploadSignatureContext(ctx, s); nil != err {
+		return TCP_BOTH, err
+	} else if p, err := mayaqua.HttpClientRecvContext(ctx, s, req, c.PackLimits); nil != err {
+		return TCP_BOTH, err
+	} else if e := p.GetError(); 0 != e {
+		return TCP_BOTH, ErrorCode(e)
+	} else if _, _, _, _, err := GetHello(p); nil != err {
+		return TCP_BOTH, err
+	}
+
+	if req, err := c.ClientUploadAuth2Context(ctx, s); nil != err {
+		return TCP_BOTH, err
+	} else if p, err := mayaqua.HttpClientRecvContext(ctx, s, req, c.PackLimits); nil != err {
+		return TCP_BOTH, err
+	} else if e := p.GetError(); 0 != e {
+		return TCP_BOTH, ErrorCode(e)
+	} else if !c.Session.HalfConnection {
+		return TCP_BOTH, nil
+	} else if direction := TcpDirection(p.GetInt("direction")); direction > TCP_CLIENT_TO_SERVER {
+		return TCP_BOTH, ERR_PROTOCOL_ERROR
+	} else {
+		return direction, nil
+	}
+}
+
+// removeSock forget a closed tcp stream
+func (c *Connection) removeSock(ts *TcpSock) {
+	for i, x := range c.tcp {
+		if x == ts {
+			c.tcp = append(c.tcp[:i], c.tcp[i+1:]...)
+			return
+		}
+	}
+}
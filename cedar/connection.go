@@ -1,6 +1,8 @@
 package cedar
 
 import (
+	"crypto"
+	"crypto/x509"
 	"go-softether/mayaqua"
 )
 
@@ -11,6 +13,20 @@ type Connection struct {
 	Port               int
 	InsecureSkipVerify bool // skip certificate and other checks
 
+	ServerCertFingerprints [][]byte        // SHA-1 or SHA-256 fingerprints of trusted server certificates
+	RootCAs                *x509.CertPool  // Authorities issuing the server certificate
+	KnownHosts             KnownHosts      // Server certificates trusted on first use
+	ServerCertTrust        ServerCertTrust // How the certificate of the server was accepted at the last login
+
+	PackLimits mayaqua.PackDecoderOptions // Limits of the packs received from the server
+
+	ProxyType      ProxyType // Type of the proxy to the server
+	ProxyHost      string    // Proxy host name
+	ProxyPort      int       // Proxy port number
+	ProxyUsername  string    // Proxy user name, no authentication if empty
+	ProxyPassword  string    // Proxy password
+	ProxyUserAgent string    // User agent sent to HTTP proxies, DEFAULT_PROXY_USER_AGENT if empty
+
 	UseTicket bool // Ticket using flag
 	Ticket    [mayaqua.SHA1_SIZE]byte
 	Name      string // Connection Name
@@ -32,7 +48,11 @@ type Connection struct {
 
 	// tcp
 	tubeSock *mayaqua.Sock
-	tcp      []*mayaqua.Sock
+	tcp      []*TcpSock
+
+	// cluster redirect
+	home         *redirectHome     // Server the login started with, if redirected
+	redirectCert *x509.Certificate // Certificate of the farm member given by the controller
 
 	// encrypt
 	Random [mayaqua.SHA1_SIZE]byte
@@ -41,12 +61,29 @@ type Connection struct {
 	IsInProc bool
 }
 
+// TcpDirection direction of a tcp stream
+type TcpDirection uint32
+
+const (
+	TCP_BOTH             TcpDirection = 0 // Bi-directional
+	TCP_SERVER_TO_CLIENT TcpDirection = 1 // Only server -> client direction
+	TCP_CLIENT_TO_SERVER TcpDirection = 2 // Only client -> server direction
+)
+
+// TcpSock a tcp stream of the session in tunneling mode
+type TcpSock struct {
+	Sock      *mayaqua.Sock
+	Direction TcpDirection
+}
+
 // ClientAuth client authorization
 type ClientAuth struct {
 	AuthType       ClientAuthType
 	Username       string
 	HashedPassword [mayaqua.SHA1_SIZE]byte
 	PlainPassword  string
+	ClientX        *x509.Certificate // Client certificate
+	ClientK        crypto.Signer     // Private key of the client certificate, RSA or ECDSA
 }
 
 // ClientOption client options
@@ -55,13 +92,18 @@ type ClientOption struct {
 
 	MaxConnection  uint32
 	UseEncrypt     bool
-	UseCompress    bool
+	UseCompress    bool // Not supported, compression is never requested
 	HalfConnection bool
 
 	RequireBridgeRoutingMode bool
 	RequireMonitorMode       bool
 	DisableQoS               bool
 	NoUdpAcceleration        bool
+
+	NumRetry      uint32 // Number of reconnect attempts, INFINITE for unlimited
+	RetryInterval uint32 // Initial reconnect interval (in seconds), doubled on each failure
+
+	AdditionalConnectionInterval uint32 // Interval between additional connections (in seconds)
 }
 
 // StartTunnelingMode start tunneling mode
@@ -71,7 +113,12 @@ func (c *Connection) StartTunnelingMode() {
 			c.tubeSock = c.firstSock
 		}
 
-		c.tcp = append(c.tcp, c.firstSock)
+		ts := &TcpSock{Sock: c.firstSock, Direction: TCP_BOTH}
+		if c.Session.HalfConnection {
+			// the server reads from the first stream only
+			ts.Direction = TCP_CLIENT_TO_SERVER
+		}
+		c.tcp = append(c.tcp, ts)
 		c.firstSock = nil
 	} else {
 		// TODO: UDP
@@ -0,0 +1,79 @@
+package cedar
+
+import (
+	"context"
+	"crypto/x509"
+	"go-softether/mayaqua"
+)
+
+// ClientConfig what Dial needs to log in to a hub
+type ClientConfig struct {
+	Host               string
+	Port               int
+	InsecureSkipVerify bool // skip certificate and other checks
+
+	ServerCertFingerprints [][]byte       // SHA-1 or SHA-256 fingerprints of trusted server certificates
+	RootCAs                *x509.CertPool // Authorities issuing the server certificate
+	KnownHosts             KnownHosts     // Server certificates trusted on first use
+
+	ClientStr   string // Client name sent in the hello
+	ClientVer   uint32
+	ClientBuild uint32
+
+	Auth   ClientAuth
+	Option ClientOption // UseEncrypt is always set, MaxConnection is 1 if 0
+
+	PackLimits mayaqua.PackDecoderOptions // Limits of the packs received from the server
+
+	ProxyType      ProxyType // Type of the proxy to the server
+	ProxyHost      string    // Proxy host name
+	ProxyPort      int       // Proxy port number
+	ProxyUsername  string    // Proxy user name, no authentication if empty
+	ProxyPassword  string    // Proxy password
+	ProxyUserAgent string    // User agent sent to HTTP proxies, DEFAULT_PROXY_USER_AGENT if empty
+}
+
+// Dial log in to the hub of config, the returned session is ready for Main,
+// the login is aborted when ctx is done and lasts TIMEOUT_DEFAULT at most
+// unless ctx has a deadline
+func Dial(ctx context.Context, config ClientConfig) (*Session, error) {
+	session := &Session{
+		ClientAuth:   config.Auth,
+		ClientOption: config.Option,
+	}
+	session.ClientOption.UseEncrypt = true
+	if 0 == session.ClientOption.MaxConnection {
+		session.ClientOption.MaxConnection = 1
+	}
+
+	conn := &Connection{
+		Cedar:              NewCedar(),
+		Host:               config.Host,
+		Port:               config.Port,
+		InsecureSkipVerify: config.InsecureSkipVerify,
+		PackLimits:         config.PackLimits,
+
+		ServerCertFingerprints: config.ServerCertFingerprints,
+		RootCAs:                config.RootCAs,
+		KnownHosts:             config.KnownHosts,
+
+		ProxyType:      config.ProxyType,
+		ProxyHost:      config.ProxyHost,
+		ProxyPort:      config.ProxyPort,
+		ProxyUsername:  config.ProxyUsername,
+		ProxyPassword:  config.ProxyPassword,
+		ProxyUserAgent: config.ProxyUserAgent,
+
+		ClientStr:   config.ClientStr,
+		ClientVer:   config.ClientVer,
+		ClientBuild: config.ClientBuild,
+		Session:     session,
+	}
+	session.Connection = conn
+
+	if err := conn.ClientConnectContext(ctx); nil != err {
+		conn.Disconnect()
+		return nil, err
+	}
+	return session, nil
+}
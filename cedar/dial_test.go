@@ -0,0 +1,143 @@
+package cedar
+
+import (
+	"context"
+	"go-softether/mayaqua"
+	"net"
+	"testing"
+	"time"
+)
+
+func testClientConfig(port int) ClientConfig {
+	cfg := ClientConfig{
+		Host:               "127.0.0.1",
+		Port:               port,
+		InsecureSkipVerify: true,
+		ClientStr:          "test",
+	}
+	cfg.Auth.AuthType = CLIENT_AUTHTYPE_PASSWORD
+	cfg.Auth.Username = "user"
+	cfg.Option.HubName = "DEFAULT"
+	return cfg
+}
+
+// blackHole a tcp listener accepting connections and never answering
+func blackHole(t *testing.T) (port int, close func()) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if nil != err {
+		t.Fatal(err)
+	}
+	conns := make(chan net.Conn, 16)
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if nil != err {
+				return
+			}
+			conns <- conn
+		}
+	}()
+	return ln.Addr().(*net.TCPAddr).Port, func() {
+		ln.Close()
+		for {
+			select {
+			case conn := <-conns:
+				conn.Close()
+			default:
+				return
+			}
+		}
+	}
+}
+
+func TestDial(t *testing.T) {
+	ts := newTestServer(t)
+	defer ts.close()
+
+	var auth *mayaqua.Pack
+	ts.welcome = func(p *mayaqua.Pack, random []byte) *mayaqua.Pack {
+		auth = p
+		return defaultTestWelcome(p)
+	}
+
+	session, err := Dial(context.Background(), testClientConfig(ts.port()))
+	if nil != err {
+		t.Fatal(err)
+	}
+	defer session.Connection.Disconnect()
+
+	if "SID-user" != session.Name || "CID-1" != session.Connection.Name || session != session.Connection.Session {
+		t.Error("unexpected session", session.Name, session.Connection.Name)
+	}
+	if 1 != auth.GetInt("max_connection") || !auth.GetBool("use_encrypt") || "DEFAULT" != auth.GetStr("hubname") {
+		t.Error("unexpected login")
+	}
+}
+
+func TestDialDeadline(t *testing.T) {
+	port, closeHole := blackHole(t)
+	defer closeHole()
+
+	// silent during the tls handshake
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if _, err := Dial(ctx, testClientConfig(port)); context.DeadlineExceeded != err {
+		t.Error("unexpected error", err)
+	}
+	if time.Since(start) > 5*time.Second {
+		t.Error("deadline ignored")
+	}
+
+	// silent after the hello
+	ts := newTestServer(t)
+	defer ts.close()
+	hang := make(chan struct{})
+	defer close(hang)
+	ts.welcome = func(auth *mayaqua.Pack, random []byte) *mayaqua.Pack {
+		<-hang
+		return defaultTestWelcome(auth)
+	}
+	ctx, cancel = context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if _, err := Dial(ctx, testClientConfig(ts.port())); context.DeadlineExceeded != err {
+		t.Error("unexpected error", err)
+	}
+
+	// silent proxy
+	cfg := testClientConfig(ts.port())
+	cfg.ProxyType = PROXY_HTTP
+	cfg.ProxyHost = "127.0.0.1"
+	cfg.ProxyPort = port
+	ctx, cancel = context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if _, err := Dial(ctx, cfg); context.DeadlineExceeded != err {
+		t.Error("unexpected error", err)
+	}
+}
+
+func TestDialCancel(t *testing.T) {
+	port, closeHole := blackHole(t)
+	defer closeHole()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(100*time.Millisecond, cancel)
+	if _, err := Dial(ctx, testClientConfig(port)); context.Canceled != err {
+		t.Error("unexpected error", err)
+	}
+	if IsRetryableError(context.Canceled) {
+		t.Error("cancellation retried")
+	}
+
+	// the connection is usable afterwards
+	ts := newTestServer(t)
+	defer ts.close()
+	conn := newTestConnection(ts.port())
+	if err := conn.ClientConnectContext(ctx); context.Canceled != err {
+		t.Error("unexpected error", err)
+	}
+	if err := conn.ClientConnectContext(context.Background()); nil != err {
+		t.Fatal(err)
+	}
+	conn.Disconnect()
+}
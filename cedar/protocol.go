@@ -2,15 +2,17 @@ package cedar
 
 import (
 	"bytes"
+	"context"
 	"crypto/tls"
+	"crypto/x509"
 	"errors"
 	"go-softether/mayaqua"
 	"io/ioutil"
+	"math/bits"
 	"math/rand"
 	"net"
 	"net/http"
 	"net/url"
-	"strconv"
 )
 
 var sessionCache tls.ClientSessionCache
@@ -21,24 +23,61 @@ func init() {
 
 // ClientConnectToServer Client connect to server
 func (c *Connection) ClientConnectToServer() (*mayaqua.Sock, error) {
-	tlsConf := tls.Config{
-		InsecureSkipVerify: c.InsecureSkipVerify,
-		ServerName:         c.Host,
-		ClientSessionCache: sessionCache,
-	}
+	return c.ClientConnectToServerContext(context.Background())
+}
 
-	if r, err := net.Dial("tcp", c.Host+":"+strconv.Itoa(c.Port)); nil != err {
+// ClientConnectToServerContext Client connect to server, aborted when ctx is done
+func (c *Connection) ClientConnectToServerContext(ctx context.Context) (*mayaqua.Sock, error) {
+	if sock, trust, err := c.dialServer(ctx); nil != err {
 		return nil, err
 	} else {
-		s := tls.Client(r, &tlsConf)
-		sock := mayaqua.NewSock(s, r)
 		c.firstSock = sock
+		c.ServerCertTrust = trust
 		return sock, nil
 	}
 }
 
+// dialServer open a tls stream to the server, telling how its certificate
+// was accepted
+func (c *Connection) dialServer(ctx context.Context) (*mayaqua.Sock, ServerCertTrust, error) {
+	// the certificate is checked by ClientCheckServerCert instead, resumed
+	// sessions included
+	trust := SERVER_CERT_UNVERIFIED
+	tlsConf := tls.Config{
+		InsecureSkipVerify: true,
+		VerifyConnection: func(cs tls.ConnectionState) (err error) {
+			trust, err = c.checkServerCert(cs.PeerCertificates)
+			return err
+		},
+		ServerName:         c.Host,
+		ClientSessionCache: sessionCache,
+	}
+
+	r, err := c.dialTcp(ctx)
+	if nil != err {
+		return nil, trust, mayaqua.ContextError(ctx, err)
+	}
+	s := tls.Client(r, &tlsConf)
+	stop := mayaqua.WatchContext(ctx, s)
+	err = s.Handshake()
+	stop()
+	if nil != err {
+		s.Close()
+		return nil, trust, mayaqua.ContextError(ctx, err)
+	}
+	return mayaqua.NewSock(s, r), trust, nil
+}
+
 // ClientUploadSignature Upload a signature
 func (c *Connection) ClientUploadSignature(s *mayaqua.Sock) (*http.Request, error) {
+	return c.ClientUploadSignatureContext(context.Background(), s)
+}
+
+// ClientUploadSignatureContext Upload a signature, aborted when ctx is done
+func (c *Connection) ClientUploadSignatureContext(ctx context.Context, s *mayaqua.Sock) (*http.Request, error) {
+	stop := mayaqua.WatchContext(ctx, s)
+	defer stop()
+
 	randSize := int(rand.Uint32() % (mayaqua.HTTP_PACK_RAND_SIZE_MAX * 2))
 	waterSize := len(WaterMark) + randSize
 	water := make([]uint8, waterSize)
@@ -61,17 +100,22 @@ func (c *Connection) ClientUploadSignature(s *mayaqua.Sock) (*http.Request, erro
 		ContentLength: int64(waterSize),
 	}
 
-	return req, req.Write(s)
+	return req, mayaqua.ContextError(ctx, req.Write(s))
 }
 
 // ClientDownloadHello Download the Hello packet
-func (c *Connection) ClientDownloadHello(s *mayaqua.Sock, req *http.Request) (err error) {
+func (c *Connection) ClientDownloadHello(s *mayaqua.Sock, req *http.Request) error {
+	return c.ClientDownloadHelloContext(context.Background(), s, req)
+}
+
+// ClientDownloadHelloContext Download the Hello packet, aborted when ctx is done
+func (c *Connection) ClientDownloadHelloContext(ctx context.Context, s *mayaqua.Sock, req *http.Request) (err error) {
 
-	if pack, err := mayaqua.HttpClientRecv(s, req); nil != err {
+	if pack, err := mayaqua.HttpClientRecvContext(ctx, s, req, c.PackLimits); nil != err {
 		return err
 	} else {
 		if e := pack.GetError(); 0 != e {
-			return errors.New("Error code: " + strconv.Itoa(int(e)))
+			return ErrorCode(e)
 		}
 		if random, ver, build, serverStr, err := GetHello(pack); nil != err {
 			return err
@@ -92,6 +136,28 @@ func (c *Connection) ClientDownloadHello(s *mayaqua.Sock, req *http.Request) (er
 // ErrInvalidHello invalid hello
 var ErrInvalidHello = errors.New("Invalid hello")
 
+// ErrPlainPasswordInsecure plain password authentication over an unverified tls connection
+var ErrPlainPasswordInsecure = errors.New("plain password requires a verified server certificate")
+
+// ErrClientCertMismatch the client certificate is missing or does not match the private key
+var ErrClientCertMismatch = errors.New("client certificate and private key mismatch")
+
+// ErrNoHubName the hub to log in to is not set
+var ErrNoHubName = errors.New("hub name is empty")
+
+// ErrNoUsername the user to log in as is not set
+var ErrNoUsername = errors.New("username is empty")
+
+// checkLoginConfig catch the configuration mistakes before dialing the server
+func (c *Connection) checkLoginConfig() error {
+	if "" == c.Session.ClientOption.HubName {
+		return ErrNoHubName
+	} else if "" == c.Session.ClientAuth.Username {
+		return ErrNoUsername
+	}
+	return nil
+}
+
 // GetHello get hello from the pack
 func GetHello(p *mayaqua.Pack) (random [mayaqua.SHA1_SIZE]byte, ver, build uint32, serverStr string, err error) {
 	if serverStr = p.GetStr("hello"); "" == serverStr {
@@ -111,9 +177,18 @@ func GetHello(p *mayaqua.Pack) (random [mayaqua.SHA1_SIZE]byte, ver, build uint3
 
 // ClientUploadAuth client upload auth
 func (c *Connection) ClientUploadAuth() (*http.Request, error) {
+	return c.ClientUploadAuthContext(context.Background())
+}
+
+// ClientUploadAuthContext client upload auth, aborted when ctx is done
+func (c *Connection) ClientUploadAuthContext(ctx context.Context) (*http.Request, error) {
 	a := &c.Session.ClientAuth
 	o := &c.Session.ClientOption
 
+	if err := c.checkLoginConfig(); nil != err {
+		return nil, err
+	}
+
 	var p *mayaqua.Pack
 	if !c.UseTicket {
 		switch a.AuthType {
@@ -123,15 +198,25 @@ func (c *Connection) ClientUploadAuth() (*http.Request, error) {
 			securePassword := SecurePassword(a.HashedPassword, c.Random)
 			p = PackLoginWithPassword(o.HubName, a.Username, securePassword)
 		case CLIENT_AUTHTYPE_PLAIN_PASSWORD:
-			panic("unsafe!")
+			// the password leaves in clear inside the tls stream, never hand it
+			// to a server we have not verified, nor to one met for the first time
+			if !c.ServerCertTrust.Verified() {
+				return nil, ErrPlainPasswordInsecure
+			}
+			p = PackLoginWithPlainPassword(o.HubName, a.Username, a.PlainPassword)
 		case CLIENT_AUTHTYPE_CERT:
-			panic("unimplemented")
-		case CLIENT_AUTHTYPE_OPENSSLENGINE:
-			panic("unimplemented")
-		case CLIENT_AUTHTYPE_SECURE:
-			panic("unimplemented")
+			if !mayaqua.CheckXandK(a.ClientX, a.ClientK) {
+				return nil, ErrClientCertMismatch
+			}
+			// prove the key by signing the random of the server
+			if sign, err := mayaqua.SignEx(a.ClientK, c.Random[:]); nil != err {
+				return nil, err
+			} else {
+				p = PackLoginWithCert(o.HubName, a.Username, a.ClientX, sign)
+			}
 		default:
-			panic("invalid")
+			// secure device & openssl engine included
+			return nil, ERR_AUTHTYPE_NOT_SUPPORTED
 		}
 	} else {
 		p = &mayaqua.Pack{}
@@ -161,8 +246,8 @@ func (c *Connection) ClientUploadAuth() (*http.Request, error) {
 	p.AddInt("max_connection", o.MaxConnection)
 	// Flag to use of cryptography
 	p.AddBool("use_encrypt", o.UseEncrypt)
-	// Data compression flag
-	p.AddBool("use_compress", o.UseCompress)
+	// Data compression flag, compressed tcp blocks are not supported
+	p.AddBool("use_compress", false)
 	// Half connection flag
 	p.AddBool("half_connection", o.HalfConnection)
 
@@ -187,8 +272,14 @@ func (c *Connection) ClientUploadAuth() (*http.Request, error) {
 	p.AddData("unique_id", unique[:])
 
 	// UDP acceleration function using flag
-	if o.NoUdpAcceleration == false && nil != c.Session.UdpAccel {
-		// TODO: UDP acceleration
+	if ua := c.Session.udpAccel(); o.NoUdpAcceleration == false && nil != ua {
+		p.AddBool("use_udp_acceleration", true)
+		p.AddInt("udp_acceleration_version", ua.Version)
+		p.AddIp("udp_acceleration_client_ip", ua.MyIp)
+		p.AddInt("udp_acceleration_client_port", ua.MyPort)
+		p.AddData("udp_acceleration_client_key", ua.MyKey[:])
+		p.AddData("udp_acceleration_client_key_v2", ua.MyKeyV2[:])
+		p.AddInt("udp_acceleration_max_version", UDP_ACCELERATION_MAX_VERSION)
 	}
 
 	p.AddInt("rudp_bulk_max_version", 2)
@@ -198,22 +289,31 @@ func (c *Connection) ClientUploadAuth() (*http.Request, error) {
 
 	// Node information
 	info := c.CreateNodeInfo()
-	OutRpcNodeInfo(p, info)
+	if err := OutRpcNodeInfo(p, info); nil != err {
+		return nil, err
+	}
 
 	// OS information
 	v := GetWinVer()
-	OutRpcWinVer(p, v)
+	if err := OutRpcWinVer(p, v); nil != err {
+		return nil, err
+	}
 
-	return mayaqua.HttpClientSend(c.firstSock, p)
+	return mayaqua.HttpClientSendContext(ctx, c.firstSock, p)
 }
 
 // ClientUploadAuth2 client upload additional auth
-func (c *Connection) ClientUploadAuth2() (*http.Request, error) {
+func (c *Connection) ClientUploadAuth2(s *mayaqua.Sock) (*http.Request, error) {
+	return c.ClientUploadAuth2Context(context.Background(), s)
+}
+
+// ClientUploadAuth2Context client upload additional auth, aborted when ctx is done
+func (c *Connection) ClientUploadAuth2Context(ctx context.Context, s *mayaqua.Sock) (*http.Request, error) {
 	p := &mayaqua.Pack{}
 	p.AddStr("method", "additional_connect")
 	p.AddData("session_key", c.Session.SessionKey[:])
 	c.PackAddClientVersion(p)
-	return mayaqua.HttpClientSend(c.firstSock, p)
+	return mayaqua.HttpClientSendContext(ctx, s, p)
 }
 
 // PackLoginWithAnonymous pack login with anonymous
@@ -249,6 +349,42 @@ func PackLoginWithPassword(hubname, username string, securePassword mayaqua.Sha1
 	return p
 }
 
+// PackLoginWithPlainPassword pack login with plain password, for hubs
+// authenticating users against RADIUS or NT domain
+func PackLoginWithPlainPassword(hubname, username, plainPassword string) *mayaqua.Pack {
+	// Validate arguments
+	if hubname == "" || username == "" {
+		return nil
+	}
+
+	p := &mayaqua.Pack{}
+	p.AddStr("method", "login")
+	p.AddStr("hubname", hubname)
+	p.AddStr("username", username)
+	p.AddInt("authtype", uint32(CLIENT_AUTHTYPE_PLAIN_PASSWORD))
+	p.AddStr("plain_password", plainPassword)
+
+	return p
+}
+
+// PackLoginWithCert pack login with certificate
+func PackLoginWithCert(hubname, username string, x *x509.Certificate, sign []byte) *mayaqua.Pack {
+	// Validate arguments
+	if hubname == "" || username == "" || nil == x || len(sign) == 0 {
+		return nil
+	}
+
+	p := &mayaqua.Pack{}
+	p.AddStr("method", "login")
+	p.AddStr("hubname", hubname)
+	p.AddStr("username", username)
+	p.AddInt("authtype", uint32(CLIENT_AUTHTYPE_CERT))
+	p.AddData("cert", x.Raw)
+	p.AddData("sign", sign)
+
+	return p
+}
+
 // PackAddClientVersion pack add client version
 func (c *Connection) PackAddClientVersion(p *mayaqua.Pack) {
 	p.AddStr("client_str", c.ClientStr)
@@ -267,7 +403,7 @@ func GenerateMachineUniqueHash() mayaqua.Sha1Sum {
 // CreateNodeInfo create node info
 func (c *Connection) CreateNodeInfo() NodeInfo {
 	// TODO:
-	return NodeInfo{
+	info := NodeInfo{
 		ClientProductName:  "",
 		ClientProductVer:   0,
 		ClientProductBuild: 0,
@@ -293,6 +429,38 @@ func (c *Connection) CreateNodeInfo() NodeInfo {
 		ProxyIpAddress6:    [16]byte{},
 		Padding:            [256]byte{},
 	}
+
+	// ports in network byte order as SoftEther's
+	info.ServerHostname = c.Host
+	info.ServerPort = bits.ReverseBytes32(uint32(c.Port))
+	if PROXY_DIRECT != c.ProxyType {
+		info.ProxyHostname = c.ProxyHost
+		info.ProxyPort = bits.ReverseBytes32(uint32(c.ProxyPort))
+	}
+
+	if nil != c.firstSock {
+		if a, ok := c.firstSock.LocalAddr().(*net.TCPAddr); ok {
+			nodeInfoIp(a.IP, &info.ClientIpAddress, &info.ClientIpAddress6)
+		}
+		if a, ok := c.firstSock.RemoteAddr().(*net.TCPAddr); ok && PROXY_DIRECT == c.ProxyType {
+			nodeInfoIp(a.IP, &info.ServerIpAddress, &info.ServerIpAddress6)
+		} else if ok {
+			// the server is only known by name to us
+			nodeInfoIp(a.IP, &info.ProxyIpAddress, &info.ProxyIpAddress6)
+			nodeInfoIp(net.ParseIP(c.Host), &info.ServerIpAddress, &info.ServerIpAddress6)
+		}
+	}
+
+	return info
+}
+
+// nodeInfoIp set an address of node info, IPv4 as uint32 or IPv6 as its bytes
+func nodeInfoIp(ip net.IP, ip4 *uint32, ip6 *[16]byte) {
+	if nil != ip.To4() {
+		*ip4 = mayaqua.IPToUINT(ip)
+	} else if nil != ip.To16() {
+		copy(ip6[:], ip.To16())
+	}
 }
 
 // ParseWelcomeFromPack parse welcome from pack
@@ -306,64 +474,11 @@ func ParseWelcomeFromPack(p *mayaqua.Pack) (sessionName, connectionName string,
 
 // PackGetPolicy get policy from pack
 func PackGetPolicy(p *mayaqua.Pack) Policy {
-	po := Policy{}
-	PackGetPolicyBool := func(k string) bool {
-		return p.GetBool("policy:" + k)
-	}
-
-	po.Access = PackGetPolicyBool("Access")
-	po.DHCPFilter = PackGetPolicyBool("DHCPFilter")
-	po.DHCPNoServer = PackGetPolicyBool("DHCPNoServer")
-	po.DHCPForce = PackGetPolicyBool("DHCPForce")
-	po.NoBridge = PackGetPolicyBool("NoBridge")
-	po.NoRouting = PackGetPolicyBool("NoRouting")
-	po.PrivacyFilter = PackGetPolicyBool("PrivacyFilter")
-	po.NoServer = PackGetPolicyBool("NoServer")
-	po.CheckMac = PackGetPolicyBool("CheckMac")
-	po.CheckIP = PackGetPolicyBool("CheckIP")
-	po.ArpDhcpOnly = PackGetPolicyBool("ArpDhcpOnly")
-	po.MonitorPort = PackGetPolicyBool("MonitorPort")
-	po.NoBroadcastLimiter = PackGetPolicyBool("NoBroadcastLimiter")
-	po.FixPassword = PackGetPolicyBool("FixPassword")
-	po.NoQoS = PackGetPolicyBool("NoQoS")
-	// Ver 3
-	po.RSandRAFilter = PackGetPolicyBool("RSandRAFilter")
-	po.RAFilter = PackGetPolicyBool("RAFilter")
-	po.DHCPv6Filter = PackGetPolicyBool("DHCPv6Filter")
-	po.DHCPv6NoServer = PackGetPolicyBool("DHCPv6NoServer")
-	po.NoRoutingV6 = PackGetPolicyBool("NoRoutingV6")
-	po.CheckIPv6 = PackGetPolicyBool("CheckIPv6")
-	po.NoServerV6 = PackGetPolicyBool("NoServerV6")
-	po.NoSavePassword = PackGetPolicyBool("NoSavePassword")
-	po.FilterIPv4 = PackGetPolicyBool("FilterIPv4")
-	po.FilterIPv6 = PackGetPolicyBool("FilterIPv6")
-	po.FilterNonIP = PackGetPolicyBool("FilterNonIP")
-	po.NoIPv6DefaultRouterInRA = PackGetPolicyBool("NoIPv6DefaultRouterInRA")
-	po.NoIPv6DefaultRouterInRAWhenIPv6 = PackGetPolicyBool("NoIPv6DefaultRouterInRAWhenIPv6")
-
-	PackGetPolicyUint := func(k string) uint32 {
-		return p.GetInt("policy:" + k)
-	}
-
-	// UINT value
-	// Ver 2
-	po.MaxConnection = PackGetPolicyUint("MaxConnection")
-	po.TimeOut = PackGetPolicyUint("TimeOut")
-	po.MaxMac = PackGetPolicyUint("MaxMac")
-	po.MaxIP = PackGetPolicyUint("MaxIP")
-	po.MaxUpload = PackGetPolicyUint("MaxUpload")
-	po.MaxDownload = PackGetPolicyUint("MaxDownload")
-	po.MultiLogins = PackGetPolicyUint("MultiLogins")
-	// Ver 3
-	po.MaxIPv6 = PackGetPolicyUint("MaxIPv6")
-	po.AutoDisconnect = PackGetPolicyUint("AutoDisconnect")
-	po.VLanId = PackGetPolicyUint("VLanId")
-
-	// Ver 3 flag
-	po.Ver3 = PackGetPolicyBool("Ver3")
-
-	return po
-
+	po := struct {
+		Policy `pack:",prefix=policy:"`
+	}{}
+	mayaqua.Unmarshal(p, &po)
+	return po.Policy
 }
 
 // ErrInvalidSessionKey invalid session key
@@ -0,0 +1,342 @@
+package cedar
+
+import (
+	"bufio"
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"go-softether/mayaqua"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func testClientCert(t *testing.T, k crypto.Signer) *x509.Certificate {
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "user"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, k.Public(), k)
+	if nil != err {
+		t.Fatal(err)
+	}
+	x, err := x509.ParseCertificate(der)
+	if nil != err {
+		t.Fatal(err)
+	}
+	return x
+}
+
+// certTestWelcome accept a login whose signature of random is made by the key of its certificate
+func certTestWelcome(auth *mayaqua.Pack, random []byte) *mayaqua.Pack {
+	reject := &mayaqua.Pack{}
+	reject.AddInt("error", uint32(ERR_AUTH_FAILED))
+
+	if ClientAuthType(auth.GetInt("authtype")) != CLIENT_AUTHTYPE_CERT {
+		return reject
+	}
+	x, err := x509.ParseCertificate(auth.GetData("cert"))
+	if nil != err {
+		return reject
+	}
+
+	hash := sha1.Sum(random)
+	sign := auth.GetData("sign")
+	switch pub := x.PublicKey.(type) {
+	case *rsa.PublicKey:
+		if nil != rsa.VerifyPKCS1v15(pub, crypto.SHA1, hash[:], sign) {
+			return reject
+		}
+	case *ecdsa.PublicKey:
+		if !ecdsa.VerifyASN1(pub, hash[:], sign) {
+			return reject
+		}
+	default:
+		return reject
+	}
+
+	return defaultTestWelcome(auth)
+}
+
+func TestClientCertAuth(t *testing.T) {
+	ts := newTestServer(t)
+	defer ts.close()
+	ts.welcome = certTestWelcome
+
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if nil != err {
+		t.Fatal(err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if nil != err {
+		t.Fatal(err)
+	}
+
+	for _, k := range []crypto.Signer{rsaKey, ecKey} {
+		conn := newTestConnection(ts.port())
+		conn.Session.ClientAuth.AuthType = CLIENT_AUTHTYPE_CERT
+		conn.Session.ClientAuth.ClientX = testClientCert(t, k)
+		conn.Session.ClientAuth.ClientK = k
+		if err := conn.ClientConnect(); nil != err {
+			t.Fatal(err)
+		}
+		conn.Disconnect()
+	}
+
+	// a key not matching the certificate never reaches the server
+	conn := newTestConnection(ts.port())
+	conn.Session.ClientAuth.AuthType = CLIENT_AUTHTYPE_CERT
+	conn.Session.ClientAuth.ClientX = testClientCert(t, rsaKey)
+	conn.Session.ClientAuth.ClientK = ecKey
+	if err := conn.ClientConnect(); err != ErrClientCertMismatch {
+		t.Error("mismatched key:", err)
+	}
+}
+
+func TestPackLoginWithPlainPassword(t *testing.T) {
+	p := PackLoginWithPlainPassword("DEFAULT", "user", "secret")
+	if ClientAuthType(p.GetInt("authtype")) != CLIENT_AUTHTYPE_PLAIN_PASSWORD {
+		t.Error("authtype", p.GetInt("authtype"))
+	}
+	if "secret" != p.GetStr("plain_password") || "user" != p.GetStr("username") || "DEFAULT" != p.GetStr("hubname") {
+		t.Error("unexpected pack")
+	}
+	if nil != PackLoginWithPlainPassword("", "user", "secret") {
+		t.Error("empty hub name accepted")
+	}
+}
+
+func TestPlainPasswordInsecure(t *testing.T) {
+	ts := newTestServer(t)
+	defer ts.close()
+
+	conn := newTestConnection(ts.port())
+	conn.Session.ClientAuth.AuthType = CLIENT_AUTHTYPE_PLAIN_PASSWORD
+	conn.Session.ClientAuth.PlainPassword = "secret"
+	if err := conn.ClientConnect(); err != ErrPlainPasswordInsecure {
+		t.Fatal(err)
+	}
+	if 0 != atomic.LoadInt32(&ts.logins) {
+		t.Error("the password was sent")
+	}
+}
+
+func TestPlainPasswordFirstUse(t *testing.T) {
+	cert := testCertificate(t)
+	ts := newTestServerWithCert(t, cert)
+	defer ts.close()
+
+	dir, err := ioutil.TempDir("", "known_hosts")
+	if nil != err {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	conn := newTestConnection(ts.port())
+	conn.InsecureSkipVerify = false
+	conn.KnownHosts = NewKnownHostsFile(filepath.Join(dir, "known_hosts"))
+	conn.Session.ClientAuth.AuthType = CLIENT_AUTHTYPE_PLAIN_PASSWORD
+	conn.Session.ClientAuth.PlainPassword = "secret"
+
+	// anybody passes the first use
+	if err := conn.ClientConnect(); err != ErrPlainPasswordInsecure {
+		t.Fatal(err)
+	}
+	if SERVER_CERT_FIRST_USE != conn.ServerCertTrust || 0 != atomic.LoadInt32(&ts.logins) {
+		t.Error("the password was sent", conn.ServerCertTrust)
+	}
+
+	// known from now on
+	if err := conn.ClientConnect(); nil != err {
+		t.Fatal(err)
+	}
+	conn.Disconnect()
+	if SERVER_CERT_KNOWN_HOST != conn.ServerCertTrust || 1 != atomic.LoadInt32(&ts.logins) {
+		t.Error("unexpected login", conn.ServerCertTrust)
+	}
+
+	// pinned
+	x, err := x509.ParseCertificate(cert.Certificate[0])
+	if nil != err {
+		t.Fatal(err)
+	}
+	sum := sha1.Sum(x.Raw)
+	conn.KnownHosts = nil
+	conn.ServerCertFingerprints = [][]byte{sum[:]}
+	if err := conn.ClientConnect(); nil != err {
+		t.Fatal(err)
+	}
+	conn.Disconnect()
+	if SERVER_CERT_PINNED != conn.ServerCertTrust {
+		t.Error("unexpected trust", conn.ServerCertTrust)
+	}
+}
+
+func TestClientNoCompression(t *testing.T) {
+	ts := newTestServer(t)
+	defer ts.close()
+	var useCompress int32 = -1
+	ts.welcome = func(auth *mayaqua.Pack, random []byte) *mayaqua.Pack {
+		if nil != auth.GetElement("use_compress", mayaqua.VALUE_INT) {
+			atomic.StoreInt32(&useCompress, int32(auth.GetInt("use_compress")))
+		}
+		return defaultTestWelcome(auth)
+	}
+
+	conn := newTestConnection(ts.port())
+	conn.Session.ClientOption.UseCompress = true
+	if err := conn.ClientConnect(); nil != err {
+		t.Fatal(err)
+	}
+	conn.Disconnect()
+	if 0 != atomic.LoadInt32(&useCompress) {
+		t.Error("compression requested", useCompress)
+	}
+}
+
+func TestClientUploadAuthUnsupported(t *testing.T) {
+	ts := newTestServer(t)
+	defer ts.close()
+
+	for _, authType := range []ClientAuthType{CLIENT_AUTHTYPE_SECURE, CLIENT_AUTHTYPE_OPENSSLENGINE, 42} {
+		conn := newTestConnection(ts.port())
+		conn.Session.ClientAuth.AuthType = authType
+		if err := conn.ClientConnect(); err != ERR_AUTHTYPE_NOT_SUPPORTED {
+			t.Error(authType, err)
+		}
+	}
+	if 0 != atomic.LoadInt32(&ts.logins) {
+		t.Error("unsupported login sent")
+	}
+}
+
+func TestClientLoginConfig(t *testing.T) {
+	// nothing listens, the mistake is caught before dialing
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if nil != err {
+		t.Fatal(err)
+	}
+	port := ln.Addr().(*net.TCPAddr).Port
+	ln.Close()
+
+	conn := newTestConnection(port)
+	conn.Session.ClientOption.HubName = ""
+	if err := conn.ClientConnect(); ErrNoHubName != err || IsRetryableError(err) {
+		t.Error("unexpected error", err)
+	}
+	conn = newTestConnection(port)
+	conn.Session.ClientAuth.Username = ""
+	if err := conn.ClientConnect(); ErrNoUsername != err || IsRetryableError(err) {
+		t.Error("unexpected error", err)
+	}
+}
+
+// rawTestServer a tls server answering the signature of the client with reply
+func rawTestServer(t *testing.T, reply []byte) int {
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+		Certificates: []tls.Certificate{testCertificate(t)},
+	})
+	if nil != err {
+		t.Fatal(err)
+	}
+	go func() {
+		conn, err := ln.Accept()
+		ln.Close()
+		if nil != err {
+			return
+		}
+		defer conn.Close()
+		if req, err := http.ReadRequest(bufio.NewReader(conn)); nil == err {
+			io.Copy(ioutil.Discard, req.Body)
+			conn.Write(reply)
+		}
+	}()
+	return ln.Addr().(*net.TCPAddr).Port
+}
+
+func TestClientMalformedReply(t *testing.T) {
+	packReply := func(p *mayaqua.Pack) []byte {
+		b := &bytes.Buffer{}
+		writeTestPack(b, p)
+		return b.Bytes()
+	}
+	bodyReply := func(body []byte) []byte {
+		return append([]byte("HTTP/1.1 200 OK\r\n"+
+			"Content-Type: "+mayaqua.HTTP_CONTENT_TYPE2+"\r\n"+
+			"Content-Length: "+strconv.Itoa(len(body))+"\r\n\r\n"), body...)
+	}
+
+	failed := &mayaqua.Pack{}
+	failed.AddInt("error", uint32(ERR_SERVER_IS_NOT_VPN))
+	noRandom := &mayaqua.Pack{}
+	noRandom.AddStr("hello", "server")
+
+	tests := []struct {
+		name  string
+		reply []byte
+		err   error
+	}{
+		{"not http", []byte("SSH-2.0-OpenSSH\r\n\r\n"), nil},
+		{"not found", []byte("HTTP/1.1 404 Not Found\r\nContent-Length: 0\r\n\r\n"), mayaqua.ERR_SERVER_IS_NOT_VPN},
+		{"chunked", []byte("HTTP/1.1 200 OK\r\nContent-Type: " + mayaqua.HTTP_CONTENT_TYPE2 +
+			"\r\nTransfer-Encoding: chunked\r\n\r\n4\r\n\x00\x00\x00\x00\r\n0\r\n\r\n"), mayaqua.ERR_SERVER_IS_NOT_VPN},
+		{"truncated body", bodyReply([]byte{0, 0, 0, 1, 0, 0, 0, 9})[:60], nil},
+		{"garbage pack", bodyReply([]byte{0, 0, 0, 1, 0, 0, 0, 2, 'a', 0, 0, 0, 9, 0, 0, 0, 1}), mayaqua.INVALID_TYPE},
+		{"error", packReply(failed), ERR_SERVER_IS_NOT_VPN},
+		{"no random", packReply(noRandom), ErrInvalidHello},
+	}
+
+	for _, tt := range tests {
+		conn := newTestConnection(rawTestServer(t, tt.reply))
+		err := conn.ClientConnect()
+		if nil == err || (nil != tt.err && err != tt.err) {
+			t.Errorf("%s: got %v", tt.name, err)
+		}
+	}
+}
+
+func TestClientPackLimits(t *testing.T) {
+	header := func(size int) []byte {
+		return []byte("HTTP/1.1 200 OK\r\n" +
+			"Content-Type: " + mayaqua.HTTP_CONTENT_TYPE2 + "\r\n" +
+			"Content-Length: " + strconv.Itoa(size) + "\r\n\r\n")
+	}
+
+	// refused by its length before reading the body
+	conn := newTestConnection(rawTestServer(t, header(100000)))
+	conn.PackLimits = mayaqua.PackDecoderOptions{MaxTotalBytes: 1024}
+	if err := conn.ClientConnect(); err != mayaqua.BUDGET_EXCEEDED {
+		t.Error("too large:", err)
+	}
+
+	// a length the body does not back
+	body := []byte{0, 0, 0, 1, 0, 0, 0, 2, 'a', 0, 0, 0, 0, 1, 0, 0, 0, 1, 0x10, 0, 0, 0}
+	conn = newTestConnection(rawTestServer(t, append(header(mayaqua.MAX_PACK_SIZE), body...)))
+	if err := conn.ClientConnect(); nil == err {
+		t.Error("truncated body accepted")
+	}
+
+	// too many elements
+	conn = newTestConnection(rawTestServer(t, append(header(8), 0, 0, 0, 9, 0, 0, 0, 0)))
+	conn.PackLimits = mayaqua.PackDecoderOptions{MaxElements: 8}
+	if err := conn.ClientConnect(); err != mayaqua.NUMBER_EXCEEDS {
+		t.Error("too many elements:", err)
+	}
+}
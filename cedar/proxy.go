@@ -0,0 +1,216 @@
+package cedar
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"go-softether/mayaqua"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// ProxyType type of the proxy to the server
+type ProxyType uint32
+
+const (
+	PROXY_DIRECT = ProxyType(0) // Direct TCP connection
+	PROXY_HTTP   = ProxyType(1) // Connection via HTTP proxy server
+	PROXY_SOCKS5 = ProxyType(3) // Connection via SOCKS5 proxy server
+)
+
+// CONNECTING_TIMEOUT_PROXY timeout of the proxy handshake
+const CONNECTING_TIMEOUT_PROXY = 15 * time.Second
+
+// DEFAULT_PROXY_USER_AGENT user agent sent to HTTP proxies
+const DEFAULT_PROXY_USER_AGENT = "Mozilla/5.0 (Windows NT 6.3; WOW64; rv:29.0) Gecko/20100101 Firefox/29.0"
+
+// dialTcp open a tcp stream to the server, through the proxy if any
+func (c *Connection) dialTcp(ctx context.Context) (net.Conn, error) {
+	d := net.Dialer{}
+	if PROXY_DIRECT == c.ProxyType {
+		return d.DialContext(ctx, "tcp", net.JoinHostPort(c.Host, strconv.Itoa(c.Port)))
+	}
+
+	var handshake func(net.Conn) (net.Conn, error)
+	switch c.ProxyType {
+	case PROXY_HTTP:
+		handshake = c.httpProxyConnect
+	case PROXY_SOCKS5:
+		handshake = c.socks5ProxyConnect
+	default:
+		return nil, ERR_PROXY_ERROR
+	}
+
+	r, err := d.DialContext(ctx, "tcp", net.JoinHostPort(c.ProxyHost, strconv.Itoa(c.ProxyPort)))
+	if nil != err {
+		if e := mayaqua.ContextError(ctx, err); err != e {
+			return nil, e
+		}
+		return nil, ERR_PROXY_CONNECT_FAILED
+	}
+	hctx, cancel := context.WithTimeout(ctx, CONNECTING_TIMEOUT_PROXY)
+	defer cancel()
+	stop := mayaqua.WatchContext(hctx, r)
+	conn, err := handshake(r)
+	stop()
+	if nil != err {
+		r.Close()
+		// the proxy error codes hide why the handshake stopped
+		if e := mayaqua.ContextDone(ctx); nil != e {
+			return nil, e
+		}
+		return nil, err
+	}
+	return conn, nil
+}
+
+// httpProxyConnect open a tunnel to the server with the CONNECT method
+func (c *Connection) httpProxyConnect(r net.Conn) (net.Conn, error) {
+	addr := net.JoinHostPort(c.Host, strconv.Itoa(c.Port))
+	userAgent := c.ProxyUserAgent
+	if "" == userAgent {
+		userAgent = DEFAULT_PROXY_USER_AGENT
+	}
+	req := &http.Request{
+		Method:     "CONNECT",
+		URL:        &url.URL{Opaque: addr},
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Host:       addr,
+		Header: http.Header{
+			"User-Agent":       []string{userAgent},
+			"Proxy-Connection": []string{"Keep-Alive"},
+			"Pragma":           []string{"no-cache"},
+		},
+	}
+	if "" != c.ProxyUsername {
+		auth := base64.StdEncoding.EncodeToString([]byte(c.ProxyUsername + ":" + c.ProxyPassword))
+		req.Header.Set("Proxy-Authorization", "Basic "+auth)
+	}
+	if err := req.Write(r); nil != err {
+		return nil, ERR_PROXY_CONNECT_FAILED
+	}
+
+	br := bufio.NewReader(r)
+	res, err := http.ReadResponse(br, req)
+	if nil != err {
+		return nil, ERR_PROXY_ERROR
+	}
+	res.Body.Close()
+	switch {
+	case http.StatusUnauthorized == res.StatusCode, http.StatusProxyAuthRequired == res.StatusCode:
+		return nil, ERR_PROXY_AUTH_FAILED
+	case 2 != res.StatusCode/100:
+		return nil, ERR_PROXY_CONNECT_FAILED
+	}
+
+	if br.Buffered() > 0 {
+		return &bufferedConn{Conn: r, r: br}, nil
+	}
+	return r, nil
+}
+
+// bufferedConn a connection some of whose bytes were read ahead
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+// socks5ProxyConnect open a tunnel to the server as RFC 1928, with the
+// username/password authentication of RFC 1929, the server name is resolved
+// by the proxy
+func (c *Connection) socks5ProxyConnect(r net.Conn) (net.Conn, error) {
+	const (
+		version           = 5
+		methodNone        = 0
+		methodPassword    = 2
+		methodUnavailable = 0xff
+		cmdConnect        = 1
+		atypIPv4          = 1
+		atypDomain        = 3
+		atypIPv6          = 4
+	)
+
+	methods := []byte{methodNone}
+	if "" != c.ProxyUsername {
+		methods = append(methods, methodPassword)
+	}
+	if _, err := r.Write(append([]byte{version, byte(len(methods))}, methods...)); nil != err {
+		return nil, ERR_PROXY_CONNECT_FAILED
+	}
+	buf := make([]byte, 2)
+	if _, err := io.ReadFull(r, buf); nil != err || version != buf[0] {
+		return nil, ERR_PROXY_ERROR
+	}
+	switch buf[1] {
+	case methodNone:
+	case methodPassword:
+		if "" == c.ProxyUsername || len(c.ProxyUsername) > 255 || len(c.ProxyPassword) > 255 {
+			return nil, ERR_PROXY_AUTH_FAILED
+		}
+		b := []byte{1, byte(len(c.ProxyUsername))}
+		b = append(b, c.ProxyUsername...)
+		b = append(b, byte(len(c.ProxyPassword)))
+		b = append(b, c.ProxyPassword...)
+		if _, err := r.Write(b); nil != err {
+			return nil, ERR_PROXY_ERROR
+		}
+		if _, err := io.ReadFull(r, buf); nil != err {
+			return nil, ERR_PROXY_ERROR
+		} else if 0 != buf[1] {
+			return nil, ERR_PROXY_AUTH_FAILED
+		}
+	case methodUnavailable:
+		return nil, ERR_PROXY_AUTH_FAILED
+	default:
+		return nil, ERR_PROXY_ERROR
+	}
+
+	req := []byte{version, cmdConnect, 0}
+	if ip := net.ParseIP(c.Host); nil != ip && nil != ip.To4() {
+		req = append(append(req, atypIPv4), ip.To4()...)
+	} else if nil != ip {
+		req = append(append(req, atypIPv6), ip.To16()...)
+	} else if len(c.Host) > 255 {
+		return nil, ERR_PROXY_ERROR
+	} else {
+		req = append(append(req, atypDomain, byte(len(c.Host))), c.Host...)
+	}
+	req = append(req, byte(c.Port>>8), byte(c.Port))
+	if _, err := r.Write(req); nil != err {
+		return nil, ERR_PROXY_ERROR
+	}
+
+	// version, reply, reserved, the type of the bound address and its first byte
+	res := make([]byte, 5)
+	if _, err := io.ReadFull(r, res); nil != err || version != res[0] {
+		return nil, ERR_PROXY_ERROR
+	} else if 0 != res[1] {
+		return nil, ERR_PROXY_CONNECT_FAILED
+	}
+	rest := 0
+	switch res[3] {
+	case atypIPv4:
+		rest = net.IPv4len - 1 + 2
+	case atypIPv6:
+		rest = net.IPv6len - 1 + 2
+	case atypDomain:
+		rest = int(res[4]) + 2
+	default:
+		return nil, ERR_PROXY_ERROR
+	}
+	if _, err := io.ReadFull(r, make([]byte, rest)); nil != err {
+		return nil, ERR_PROXY_ERROR
+	}
+
+	return r, nil
+}
@@ -0,0 +1,436 @@
+package cedar
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/binary"
+	"go-softether/mayaqua"
+	"io"
+	"math/bits"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+// httpTestProxy an HTTP proxy stand-in tunnelling CONNECT requests
+type httpTestProxy struct {
+	ln       net.Listener
+	auth     string // expected Proxy-Authorization, none if empty
+	reply    string // answered instead of connecting, if not empty
+	connects int32
+
+	mu        sync.Mutex
+	userAgent string
+	target    string
+}
+
+func newHttpTestProxy(t *testing.T) *httpTestProxy {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if nil != err {
+		t.Fatal(err)
+	}
+	p := &httpTestProxy{ln: ln}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if nil != err {
+				return
+			}
+			go p.handle(conn)
+		}
+	}()
+	return p
+}
+
+func (p *httpTestProxy) port() int {
+	return p.ln.Addr().(*net.TCPAddr).Port
+}
+
+func (p *httpTestProxy) close() {
+	p.ln.Close()
+}
+
+func (p *httpTestProxy) handle(conn net.Conn) {
+	defer conn.Close()
+	br := bufio.NewReader(conn)
+	req, err := http.ReadRequest(br)
+	if nil != err || "CONNECT" != req.Method {
+		return
+	}
+	atomic.AddInt32(&p.connects, 1)
+	p.mu.Lock()
+	p.userAgent, p.target = req.UserAgent(), req.Host
+	p.mu.Unlock()
+
+	if "" != p.auth && req.Header.Get("Proxy-Authorization") != p.auth {
+		io.WriteString(conn, "HTTP/1.1 407 Proxy Authentication Required\r\nProxy-Authenticate: Basic realm=\"test\"\r\nContent-Length: 0\r\n\r\n")
+		return
+	}
+	if "" != p.reply {
+		io.WriteString(conn, p.reply)
+		return
+	}
+
+	target, err := net.Dial("tcp", req.Host)
+	if nil != err {
+		io.WriteString(conn, "HTTP/1.1 502 Bad Gateway\r\nContent-Length: 0\r\n\r\n")
+		return
+	}
+	defer target.Close()
+	io.WriteString(conn, "HTTP/1.1 200 Connection established\r\n\r\n")
+	go io.Copy(target, br)
+	io.Copy(conn, target)
+}
+
+func TestHttpProxy(t *testing.T) {
+	ts := newTestServer(t)
+	defer ts.close()
+	proxy := newHttpTestProxy(t)
+	defer proxy.close()
+	proxy.auth = "Basic " + base64.StdEncoding.EncodeToString([]byte("proxyuser:proxypass"))
+
+	var info *mayaqua.Pack
+	ts.welcome = func(auth *mayaqua.Pack, random []byte) *mayaqua.Pack {
+		info = auth
+		return defaultTestWelcome(auth)
+	}
+
+	conn := newTestConnection(ts.port())
+	conn.ProxyType = PROXY_HTTP
+	conn.ProxyHost = "127.0.0.1"
+	conn.ProxyPort = proxy.port()
+	conn.ProxyUsername = "proxyuser"
+	conn.ProxyPassword = "proxypass"
+	conn.ProxyUserAgent = "test-agent"
+	if err := conn.ClientConnect(); nil != err {
+		t.Fatal(err)
+	}
+	defer conn.Disconnect()
+
+	// additional connections take the same way
+	if ts, err := conn.ClientAdditionalConnect(); nil != err {
+		t.Fatal(err)
+	} else {
+		ts.Sock.Close()
+	}
+	if 2 != atomic.LoadInt32(&proxy.connects) {
+		t.Error("connects", proxy.connects)
+	}
+	proxy.mu.Lock()
+	if "test-agent" != proxy.userAgent || "127.0.0.1:"+strconv.Itoa(ts.port()) != proxy.target {
+		t.Error("unexpected request", proxy.userAgent, proxy.target)
+	}
+	proxy.mu.Unlock()
+
+	if "127.0.0.1" != info.GetStr("ProxyHostname") || bits.ReverseBytes32(uint32(proxy.port())) != info.GetInt("ProxyPort") ||
+		!info.GetIp("ProxyIpAddress").Equal(net.IPv4(127, 0, 0, 1)) || !info.GetIp("ServerIpAddress").Equal(net.IPv4(127, 0, 0, 1)) {
+		t.Error("unexpected node info")
+	}
+	if info.GetBool("use_udp_acceleration") {
+		t.Error("udp acceleration through a proxy")
+	}
+}
+
+func TestHttpProxyErrors(t *testing.T) {
+	ts := newTestServer(t)
+	defer ts.close()
+
+	closed, err := net.Listen("tcp", "127.0.0.1:0")
+	if nil != err {
+		t.Fatal(err)
+	}
+	closedPort := closed.Addr().(*net.TCPAddr).Port
+	closed.Close()
+
+	tests := []struct {
+		name   string
+		auth   string
+		reply  string
+		target int
+		err    error
+	}{
+		{"wrong password", "Basic other", "", ts.port(), ERR_PROXY_AUTH_FAILED},
+		{"unreachable server", "", "", closedPort, ERR_PROXY_CONNECT_FAILED},
+		{"forbidden", "", "HTTP/1.1 403 Forbidden\r\nContent-Length: 0\r\n\r\n", ts.port(), ERR_PROXY_CONNECT_FAILED},
+		{"not http", "", "SSH-2.0-OpenSSH\r\n", ts.port(), ERR_PROXY_ERROR},
+	}
+	for _, tt := range tests {
+		proxy := newHttpTestProxy(t)
+		proxy.auth, proxy.reply = tt.auth, tt.reply
+		conn := newTestConnection(tt.target)
+		conn.ProxyType = PROXY_HTTP
+		conn.ProxyHost = "127.0.0.1"
+		conn.ProxyPort = proxy.port()
+		conn.ProxyUsername = "proxyuser"
+		if err := conn.ClientConnect(); err != tt.err {
+			t.Errorf("%s: got %v", tt.name, err)
+		}
+		proxy.close()
+	}
+
+	// no proxy listening
+	conn := newTestConnection(ts.port())
+	conn.ProxyType = PROXY_HTTP
+	conn.ProxyHost = "127.0.0.1"
+	conn.ProxyPort = closedPort
+	if err := conn.ClientConnect(); err != ERR_PROXY_CONNECT_FAILED {
+		t.Error("no proxy:", err)
+	}
+	if IsRetryableError(ERR_PROXY_AUTH_FAILED) {
+		t.Error("authentication failure retried")
+	}
+}
+
+// socks5TestProxy a SOCKS5 proxy stand-in resolving the names it is given
+type socks5TestProxy struct {
+	ln       net.Listener
+	username string // username/password authentication required, if not empty
+	password string
+	rep      byte // reply of the connect request, unless 0
+	connects int32
+
+	mu     sync.Mutex
+	atyp   byte
+	target string
+}
+
+func newSocks5TestProxy(t *testing.T) *socks5TestProxy {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if nil != err {
+		t.Fatal(err)
+	}
+	p := &socks5TestProxy{ln: ln}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if nil != err {
+				return
+			}
+			go p.handle(conn)
+		}
+	}()
+	return p
+}
+
+func (p *socks5TestProxy) port() int {
+	return p.ln.Addr().(*net.TCPAddr).Port
+}
+
+func (p *socks5TestProxy) close() {
+	p.ln.Close()
+}
+
+func (p *socks5TestProxy) handle(conn net.Conn) {
+	defer conn.Close()
+	buf := make([]byte, 256)
+	if _, err := io.ReadFull(conn, buf[:2]); nil != err || 5 != buf[0] {
+		return
+	}
+	methods := buf[2 : 2+buf[1]]
+	if _, err := io.ReadFull(conn, methods); nil != err {
+		return
+	}
+	want := byte(0)
+	if "" != p.username {
+		want = 2
+	}
+	found := false
+	for _, m := range methods {
+		found = found || want == m
+	}
+	if !found {
+		conn.Write([]byte{5, 0xff})
+		return
+	}
+	conn.Write([]byte{5, want})
+
+	if 2 == want {
+		// version, username, password
+		if _, err := io.ReadFull(conn, buf[:2]); nil != err {
+			return
+		}
+		user := make([]byte, buf[1])
+		io.ReadFull(conn, user)
+		io.ReadFull(conn, buf[:1])
+		pass := make([]byte, buf[0])
+		io.ReadFull(conn, pass)
+		if p.username != string(user) || p.password != string(pass) {
+			conn.Write([]byte{1, 1})
+			return
+		}
+		conn.Write([]byte{1, 0})
+	}
+
+	if _, err := io.ReadFull(conn, buf[:4]); nil != err || 1 != buf[1] {
+		return
+	}
+	atyp, host := buf[3], ""
+	switch atyp {
+	case 1:
+		io.ReadFull(conn, buf[:net.IPv4len])
+		host = net.IP(buf[:net.IPv4len]).String()
+	case 4:
+		io.ReadFull(conn, buf[:net.IPv6len])
+		host = net.IP(buf[:net.IPv6len]).String()
+	case 3:
+		io.ReadFull(conn, buf[:1])
+		name := make([]byte, buf[0])
+		io.ReadFull(conn, name)
+		host = string(name)
+	default:
+		return
+	}
+	if _, err := io.ReadFull(conn, buf[:2]); nil != err {
+		return
+	}
+	addr := net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(buf[:2]))))
+	atomic.AddInt32(&p.connects, 1)
+	p.mu.Lock()
+	p.atyp, p.target = atyp, addr
+	p.mu.Unlock()
+
+	// bound to a domain name, the client must skip it whatever its type
+	bound := []byte{5, p.rep, 0, 3, 5, 'p', 'r', 'o', 'x', 'y', 0, 0}
+	if 0 != p.rep {
+		conn.Write(bound)
+		return
+	}
+	target, err := net.Dial("tcp", addr)
+	if nil != err {
+		bound[1] = 5 // connection refused
+		conn.Write(bound)
+		return
+	}
+	defer target.Close()
+	conn.Write(bound)
+	go io.Copy(target, conn)
+	io.Copy(conn, target)
+}
+
+func TestSocks5Proxy(t *testing.T) {
+	ts := newTestServer(t)
+	defer ts.close()
+	proxy := newSocks5TestProxy(t)
+	defer proxy.close()
+	proxy.username, proxy.password = "proxyuser", "proxypass"
+
+	var info *mayaqua.Pack
+	ts.welcome = func(auth *mayaqua.Pack, random []byte) *mayaqua.Pack {
+		info = auth
+		return defaultTestWelcome(auth)
+	}
+
+	// the name is resolved by the proxy
+	conn := newTestConnection(ts.port())
+	conn.Host = "localhost"
+	conn.ProxyType = PROXY_SOCKS5
+	conn.ProxyHost = "127.0.0.1"
+	conn.ProxyPort = proxy.port()
+	conn.ProxyUsername = "proxyuser"
+	conn.ProxyPassword = "proxypass"
+	if err := conn.ClientConnect(); nil != err {
+		t.Fatal(err)
+	}
+	defer conn.Disconnect()
+
+	if ts, err := conn.ClientAdditionalConnect(); nil != err {
+		t.Fatal(err)
+	} else {
+		ts.Sock.Close()
+	}
+	if 2 != atomic.LoadInt32(&proxy.connects) {
+		t.Error("connects", proxy.connects)
+	}
+	proxy.mu.Lock()
+	if 3 != proxy.atyp || "localhost:"+strconv.Itoa(ts.port()) != proxy.target {
+		t.Error("unexpected request", proxy.atyp, proxy.target)
+	}
+	proxy.mu.Unlock()
+
+	if "localhost" != info.GetStr("ServerHostname") || "127.0.0.1" != info.GetStr("ProxyHostname") ||
+		bits.ReverseBytes32(uint32(proxy.port())) != info.GetInt("ProxyPort") || !info.GetIp("ProxyIpAddress").Equal(net.IPv4(127, 0, 0, 1)) {
+		t.Error("unexpected node info")
+	}
+	if info.GetBool("use_udp_acceleration") {
+		t.Error("udp acceleration through a proxy")
+	}
+
+	// addresses are sent as such
+	conn = newTestConnection(ts.port())
+	conn.ProxyType = PROXY_SOCKS5
+	conn.ProxyHost = "127.0.0.1"
+	conn.ProxyPort = proxy.port()
+	conn.ProxyUsername = "proxyuser"
+	conn.ProxyPassword = "proxypass"
+	if err := conn.ClientConnect(); nil != err {
+		t.Fatal(err)
+	}
+	conn.Disconnect()
+	proxy.mu.Lock()
+	if 1 != proxy.atyp || "127.0.0.1:"+strconv.Itoa(ts.port()) != proxy.target {
+		t.Error("unexpected request", proxy.atyp, proxy.target)
+	}
+	proxy.mu.Unlock()
+}
+
+func TestSocks5ProxyErrors(t *testing.T) {
+	ts := newTestServer(t)
+	defer ts.close()
+
+	closed, err := net.Listen("tcp", "127.0.0.1:0")
+	if nil != err {
+		t.Fatal(err)
+	}
+	closedPort := closed.Addr().(*net.TCPAddr).Port
+	closed.Close()
+
+	tests := []struct {
+		name     string
+		username string
+		rep      byte
+		target   int
+		err      error
+	}{
+		{"wrong password", "other", 0, ts.port(), ERR_PROXY_AUTH_FAILED},
+		{"no password", "", 0, ts.port(), ERR_PROXY_AUTH_FAILED},
+		{"unreachable server", "proxyuser", 0, closedPort, ERR_PROXY_CONNECT_FAILED},
+		{"not allowed", "proxyuser", 2, ts.port(), ERR_PROXY_CONNECT_FAILED},
+	}
+	for _, tt := range tests {
+		proxy := newSocks5TestProxy(t)
+		proxy.username, proxy.password, proxy.rep = "proxyuser", "proxypass", tt.rep
+		conn := newTestConnection(tt.target)
+		conn.ProxyType = PROXY_SOCKS5
+		conn.ProxyHost = "127.0.0.1"
+		conn.ProxyPort = proxy.port()
+		conn.ProxyUsername = tt.username
+		conn.ProxyPassword = "proxypass"
+		if err := conn.ClientConnect(); err != tt.err {
+			t.Errorf("%s: got %v", tt.name, err)
+		}
+		proxy.close()
+	}
+
+	// not a socks server
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if nil != err {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		if c, err := ln.Accept(); nil == err {
+			io.WriteString(c, "HTTP/1.1 400 Bad Request\r\n\r\n")
+			c.Close()
+		}
+	}()
+	conn := newTestConnection(ts.port())
+	conn.ProxyType = PROXY_SOCKS5
+	conn.ProxyHost = "127.0.0.1"
+	conn.ProxyPort = ln.Addr().(*net.TCPAddr).Port
+	if err := conn.ClientConnect(); err != ERR_PROXY_ERROR {
+		t.Error("not socks:", err)
+	}
+}
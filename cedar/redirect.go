@@ -0,0 +1,91 @@
+package cedar
+
+import (
+	"crypto/x509"
+	"go-softether/mayaqua"
+	"net"
+)
+
+// MAX_PUBLIC_PORT_NUM Maximum number of ports of a farm member
+const MAX_PUBLIC_PORT_NUM = 128
+
+// Redirect farm member a cluster controller sends the client to
+type Redirect struct {
+	Ip     net.IP
+	Ports  []uint32 // Public ports of the member
+	Ticket [mayaqua.SHA1_SIZE]byte
+	Cert   *x509.Certificate // Certificate of the member, if the controller knows it
+}
+
+// GetRedirectFromPack get redirect from the welcome pack of a controller
+func GetRedirectFromPack(p *mayaqua.Pack) (*Redirect, error) {
+	r := &Redirect{Ip: p.GetIp("Ip")}
+	if nil == r.Ip || r.Ip.IsUnspecified() {
+		return nil, ERR_PROTOCOL_ERROR
+	}
+
+	if e := p.GetElement("Port", mayaqua.VALUE_INT); nil != e {
+		for i := uint32(0); i < e.NumValue() && i < MAX_PUBLIC_PORT_NUM; i++ {
+			if port := e.GetIntValue(i); 0 != port {
+				r.Ports = append(r.Ports, port)
+			}
+		}
+	}
+	if 0 == len(r.Ports) {
+		return nil, ERR_PROTOCOL_ERROR
+	}
+
+	if t := p.GetData("Ticket"); int(mayaqua.SHA1_SIZE) != len(t) {
+		return nil, ERR_PROTOCOL_ERROR
+	} else {
+		copy(r.Ticket[:], t)
+	}
+
+	if b := p.GetData("Cert"); 0 != len(b) {
+		if x, err := x509.ParseCertificate(b); nil != err {
+			return nil, ERR_PROTOCOL_ERROR
+		} else {
+			r.Cert = x
+		}
+	}
+
+	return r, nil
+}
+
+// redirectHome where the login started before a redirect
+type redirectHome struct {
+	host      string
+	port      int
+	useTicket bool
+	ticket    [mayaqua.SHA1_SIZE]byte
+}
+
+// redirectTo log in to the farm member with the ticket from now on, the
+// current port is kept if the member listens on it
+func (c *Connection) redirectTo(r *Redirect) {
+	if nil == c.home {
+		c.home = &redirectHome{c.Host, c.Port, c.UseTicket, c.Ticket}
+	}
+
+	port := r.Ports[0]
+	for _, p := range r.Ports {
+		if uint32(c.Port) == p {
+			port = p
+		}
+	}
+	c.Host = r.Ip.String()
+	c.Port = int(port)
+	c.UseTicket = true
+	c.Ticket = r.Ticket
+	c.redirectCert = r.Cert
+}
+
+// goHome back to the server the login started with, tickets are good for
+// one login only
+func (c *Connection) goHome() {
+	if nil != c.home {
+		c.Host, c.Port, c.UseTicket, c.Ticket = c.home.host, c.home.port, c.home.useTicket, c.home.ticket
+		c.home = nil
+	}
+	c.redirectCert = nil
+}
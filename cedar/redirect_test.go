@@ -0,0 +1,220 @@
+package cedar
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/x509"
+	"go-softether/mayaqua"
+	"net"
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestGetRedirectFromPack(t *testing.T) {
+	ticket := bytes.Repeat([]byte{7}, int(mayaqua.SHA1_SIZE))
+	p := &mayaqua.Pack{}
+	p.AddInt("Redirect", 1)
+	p.AddIp("Ip", net.IPv4(10, 0, 0, 2))
+	p.AddIntEx("Port", 443, 0, 3)
+	p.AddIntEx("Port", 0, 1, 3)
+	p.AddIntEx("Port", 5555, 2, 3)
+	p.AddData("Ticket", ticket)
+	if r, err := GetRedirectFromPack(p); nil != err {
+		t.Fatal(err)
+	} else if !r.Ip.Equal(net.IPv4(10, 0, 0, 2)) || 2 != len(r.Ports) || 443 != r.Ports[0] || 5555 != r.Ports[1] ||
+		!bytes.Equal(ticket, r.Ticket[:]) || nil != r.Cert {
+		t.Error("unexpected redirect", r)
+	}
+
+	broken := []func(p *mayaqua.Pack){
+		func(p *mayaqua.Pack) { p.AddIp("Ip", net.IPv4zero) },
+		func(p *mayaqua.Pack) { p.AddIp("Ip", net.IPv4(10, 0, 0, 2)); p.AddData("Ticket", ticket) },
+		func(p *mayaqua.Pack) {
+			p.AddIp("Ip", net.IPv4(10, 0, 0, 2))
+			p.AddInt("Port", 443)
+			p.AddData("Ticket", ticket[1:])
+		},
+		func(p *mayaqua.Pack) {
+			p.AddIp("Ip", net.IPv4(10, 0, 0, 2))
+			p.AddInt("Port", 443)
+			p.AddData("Ticket", ticket)
+			p.AddData("Cert", []byte{1, 2, 3})
+		},
+	}
+	for i, f := range broken {
+		p := &mayaqua.Pack{}
+		p.AddInt("Redirect", 1)
+		f(p)
+		if _, err := GetRedirectFromPack(p); ERR_PROTOCOL_ERROR != err {
+			t.Error(i, err)
+		}
+	}
+}
+
+func TestRedirectTo(t *testing.T) {
+	conn := newTestConnection(5555)
+	r := &Redirect{Ip: net.IPv4(10, 0, 0, 2), Ports: []uint32{443, 5555}}
+	r.Ticket[0] = 1
+	conn.redirectTo(r)
+	if "10.0.0.2" != conn.Host || 5555 != conn.Port || !conn.UseTicket || r.Ticket != conn.Ticket {
+		t.Error("current port not kept", conn.Host, conn.Port)
+	}
+
+	// a member redirecting again leaves the way home alone
+	conn.redirectTo(&Redirect{Ip: net.IPv4(10, 0, 0, 3), Ports: []uint32{443}})
+	if "10.0.0.3" != conn.Host || 443 != conn.Port {
+		t.Error("first port not taken", conn.Host, conn.Port)
+	}
+	conn.goHome()
+	if "127.0.0.1" != conn.Host || 5555 != conn.Port || conn.UseTicket || [mayaqua.SHA1_SIZE]byte{} != conn.Ticket {
+		t.Error("not back home", conn.Host, conn.Port)
+	}
+}
+
+// testCluster a controller redirecting every login to its member
+type testCluster struct {
+	controller, member *testServer
+	controllerCert     *x509.Certificate
+	memberCert         *x509.Certificate
+	ticket             []byte // given by the controller
+	accepted           []byte // accepted by the member
+	redirectCert       []byte // certificate given to the client, the member's by default
+	leaves             int32  // empty packs received by the controller
+}
+
+func newTestCluster(t *testing.T) *testCluster {
+	tc := &testCluster{ticket: bytes.Repeat([]byte{9}, int(mayaqua.SHA1_SIZE))}
+	tc.accepted = tc.ticket
+
+	cert := testCertificate(t)
+	tc.controllerCert, _ = x509.ParseCertificate(cert.Certificate[0])
+	tc.controller = newTestServerWithCert(t, cert)
+	cert = testCertificate(t)
+	tc.memberCert, _ = x509.ParseCertificate(cert.Certificate[0])
+	tc.member = newTestServerWithCert(t, cert)
+	tc.redirectCert = tc.memberCert.Raw
+
+	tc.controller.welcome = func(auth *mayaqua.Pack, random []byte) *mayaqua.Pack {
+		p := &mayaqua.Pack{}
+		p.AddInt("Redirect", 1)
+		p.AddIp("Ip", net.IPv4(127, 0, 0, 1))
+		p.AddIntEx("Port", uint32(tc.member.port()), 0, 2)
+		p.AddIntEx("Port", 1, 1, 2)
+		p.AddData("Ticket", tc.ticket)
+		if nil != tc.redirectCert {
+			p.AddData("Cert", tc.redirectCert)
+		}
+		return p
+	}
+	tc.controller.tunnel = func(login int32, c *testServerConn) {
+		if req, err := http.ReadRequest(c.r); nil == err && mayaqua.HTTP_VPN_TARGET == req.URL.Path {
+			atomic.AddInt32(&tc.leaves, 1)
+		}
+	}
+	tc.member.welcome = func(auth *mayaqua.Pack, random []byte) *mayaqua.Pack {
+		if uint32(AUTHTYPE_TICKET) != auth.GetInt("authtype") || !bytes.Equal(tc.accepted, auth.GetData("ticket")) ||
+			"DEFAULT" != auth.GetStr("hubname") {
+			p := &mayaqua.Pack{}
+			p.AddInt("error", uint32(ERR_AUTH_FAILED))
+			return p
+		}
+		return defaultTestWelcome(auth)
+	}
+	return tc
+}
+
+func (tc *testCluster) close() {
+	tc.controller.close()
+	tc.member.close()
+}
+
+// newConnection connection to the controller trusting its certificate only
+func (tc *testCluster) newConnection() *Connection {
+	conn := newTestConnection(tc.controller.port())
+	conn.InsecureSkipVerify = false
+	sum := sha256.Sum256(tc.controllerCert.Raw)
+	conn.ServerCertFingerprints = [][]byte{sum[:]}
+	return conn
+}
+
+func TestClientRedirect(t *testing.T) {
+	tc := newTestCluster(t)
+	defer tc.close()
+
+	conn := tc.newConnection()
+	if err := conn.ClientConnect(); nil != err {
+		t.Fatal(err)
+	}
+	if "127.0.0.1" != conn.Host || tc.member.port() != conn.Port || !conn.UseTicket {
+		t.Error("not redirected", conn.Host, conn.Port)
+	}
+	if 1 != atomic.LoadInt32(&tc.controller.logins) || 1 != atomic.LoadInt32(&tc.member.logins) {
+		t.Error("logins", tc.controller.logins, tc.member.logins)
+	}
+
+	// additional connections go to the member
+	if ts, err := conn.ClientAdditionalConnect(); nil != err {
+		t.Fatal(err)
+	} else {
+		ts.Sock.Close()
+	}
+	if 1 != atomic.LoadInt32(&tc.member.additional) || 0 != atomic.LoadInt32(&tc.controller.additional) {
+		t.Error("additional", tc.controller.additional, tc.member.additional)
+	}
+
+	// reconnects start over from the controller
+	if err := conn.ClientConnect(); nil != err {
+		t.Fatal(err)
+	}
+	conn.Disconnect()
+	if 2 != atomic.LoadInt32(&tc.controller.logins) || 2 != atomic.LoadInt32(&tc.member.logins) {
+		t.Error("logins", tc.controller.logins, tc.member.logins)
+	}
+
+	deadline := time.Now().Add(time.Second)
+	for 2 != atomic.LoadInt32(&tc.leaves) && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if 2 != atomic.LoadInt32(&tc.leaves) {
+		t.Error("controller left without a word", tc.leaves)
+	}
+}
+
+func TestClientRedirectErrors(t *testing.T) {
+	tc := newTestCluster(t)
+	defer tc.close()
+
+	// the member is not the one the controller told about
+	tc.redirectCert = tc.controllerCert.Raw
+	conn := tc.newConnection()
+	if e, ok := conn.ClientConnect().(*ServerCertError); !ok || ERR_CERT_NOT_TRUSTED != e.Code || !tc.memberCert.Equal(e.Cert) {
+		t.Error("unexpected error", e)
+	}
+
+	// no certificate from the controller, the member is checked as any server
+	tc.redirectCert = nil
+	if _, ok := conn.ClientConnect().(*ServerCertError); !ok {
+		t.Error("member trusted")
+	}
+	sum := sha256.Sum256(tc.memberCert.Raw)
+	conn.ServerCertFingerprints = append(conn.ServerCertFingerprints, sum[:])
+	if err := conn.ClientConnect(); nil != err {
+		t.Error(err)
+	}
+	conn.Disconnect()
+
+	// a ticket the member does not know
+	tc.accepted = bytes.Repeat([]byte{8}, int(mayaqua.SHA1_SIZE))
+	if err := conn.ClientConnect(); ERR_AUTH_FAILED != err {
+		t.Error("unexpected error", err)
+	}
+	tc.accepted = tc.ticket
+
+	// members do not redirect
+	tc.member.welcome = tc.controller.welcome
+	if err := conn.ClientConnect(); ERR_PROTOCOL_ERROR != err {
+		t.Error("unexpected error", err)
+	}
+}
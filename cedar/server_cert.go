@@ -0,0 +1,238 @@
+package cedar
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"go-softether/mayaqua"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrInvalidFingerprint the fingerprint is neither a SHA-1 nor a SHA-256 one
+var ErrInvalidFingerprint = errors.New("ErrInvalidFingerprint")
+
+// ServerCertError the certificate of the server is refused, with what it
+// takes to ask the user
+type ServerCertError struct {
+	Code   ErrorCode // ERR_CERT_NOT_TRUSTED or ERR_SERVER_CERT_EXPIRES
+	Host   string    // host:port of the server
+	Cert   *x509.Certificate
+	Sha1   mayaqua.Sha1Sum
+	Sha256 [mayaqua.SHA256_SIZE]byte
+	Known  []byte // fingerprint recorded for the host, if it changed
+}
+
+func newServerCertError(code ErrorCode, host string, x *x509.Certificate) *ServerCertError {
+	return &ServerCertError{
+		Code:   code,
+		Host:   host,
+		Cert:   x,
+		Sha1:   sha1.Sum(x.Raw),
+		Sha256: sha256.Sum256(x.Raw),
+	}
+}
+
+func (e *ServerCertError) Error() string {
+	what := "not trusted"
+	if ERR_SERVER_CERT_EXPIRES == e.Code {
+		what = "expired"
+	} else if nil != e.Known {
+		what = "changed"
+	}
+	return fmt.Sprintf("%s: certificate of %s %s, subject %q issuer %q valid %s to %s, SHA-256 %s",
+		e.Code.Error(), e.Host, what, e.Cert.Subject.String(), e.Cert.Issuer.String(),
+		e.Cert.NotBefore.Format(time.RFC3339), e.Cert.NotAfter.Format(time.RFC3339), FormatFingerprint(e.Sha256[:]))
+}
+
+// Unwrap the error code
+func (e *ServerCertError) Unwrap() error {
+	return e.Code
+}
+
+// ServerCertTrust how the certificate of the server was accepted
+type ServerCertTrust uint32
+
+const (
+	SERVER_CERT_UNVERIFIED ServerCertTrust = 0 // Not checked, InsecureSkipVerify
+	SERVER_CERT_PINNED     ServerCertTrust = 1 // Fingerprint in ServerCertFingerprints
+	SERVER_CERT_CA         ServerCertTrust = 2 // Issued by RootCAs or the system authorities
+	SERVER_CERT_KNOWN_HOST ServerCertTrust = 3 // Recorded in the known hosts before
+	SERVER_CERT_FIRST_USE  ServerCertTrust = 4 // Unknown to the known hosts, recorded now
+	SERVER_CERT_REDIRECT   ServerCertTrust = 5 // Given by the cluster controller
+)
+
+// Verified whether the certificate was checked against something configured
+// or learned before this connection, anybody can pass the first use
+func (t ServerCertTrust) Verified() bool {
+	switch t {
+	case SERVER_CERT_PINNED, SERVER_CERT_CA, SERVER_CERT_KNOWN_HOST:
+		return true
+	}
+	return false
+}
+
+// KnownHosts certificates trusted on first use, by host:port
+type KnownHosts interface {
+	Lookup(host string) (fingerprint []byte, ok bool, err error)
+	Add(host string, fingerprint []byte) error
+}
+
+// KnownHostsFile known hosts kept in a file, one "host:port fingerprint" line
+// each, the fingerprint being the SHA-256 one in hex
+type KnownHostsFile struct {
+	Path string
+	lock sync.Mutex
+}
+
+// NewKnownHostsFile known hosts of the file at path, created on first use
+func NewKnownHostsFile(path string) *KnownHostsFile {
+	return &KnownHostsFile{Path: path}
+}
+
+// Lookup the fingerprint recorded for host
+func (k *KnownHostsFile) Lookup(host string) ([]byte, bool, error) {
+	k.lock.Lock()
+	defer k.lock.Unlock()
+
+	f, err := os.Open(k.Path)
+	if os.IsNotExist(err) {
+		return nil, false, nil
+	} else if nil != err {
+		return nil, false, err
+	}
+	defer f.Close()
+
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		fields := strings.Fields(s.Text())
+		if len(fields) < 2 || strings.HasPrefix(fields[0], "#") || host != fields[0] {
+			continue
+		}
+		if fp, err := ParseFingerprint(fields[1]); nil != err {
+			return nil, false, err
+		} else {
+			return fp, true, nil
+		}
+	}
+	return nil, false, s.Err()
+}
+
+// Add record the fingerprint of host
+func (k *KnownHostsFile) Add(host string, fingerprint []byte) error {
+	k.lock.Lock()
+	defer k.lock.Unlock()
+
+	f, err := os.OpenFile(k.Path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if nil != err {
+		return err
+	}
+	if _, err := fmt.Fprintf(f, "%s %s\n", host, hex.EncodeToString(fingerprint)); nil != err {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// ParseFingerprint parse a SHA-1 or SHA-256 fingerprint in hex, colons and
+// spaces between the bytes are allowed
+func ParseFingerprint(s string) ([]byte, error) {
+	s = strings.NewReplacer(":", "", " ", "").Replace(s)
+	if fp, err := hex.DecodeString(s); nil != err {
+		return nil, ErrInvalidFingerprint
+	} else if int(mayaqua.SHA1_SIZE) != len(fp) && int(mayaqua.SHA256_SIZE) != len(fp) {
+		return nil, ErrInvalidFingerprint
+	} else {
+		return fp, nil
+	}
+}
+
+// FormatFingerprint format a fingerprint as colon separated hex bytes
+func FormatFingerprint(fp []byte) string {
+	parts := make([]string, len(fp))
+	for i, b := range fp {
+		parts[i] = strings.ToUpper(hex.EncodeToString([]byte{b}))
+	}
+	return strings.Join(parts, ":")
+}
+
+// ClientCheckServerCert check the certificate chain presented by the server,
+// it is trusted if its fingerprint is pinned, if it is issued by RootCAs, or
+// by the system authorities when RootCAs is nil, and otherwise by the known
+// hosts which learn it on first use, farm members must present the
+// certificate their controller gave
+func (c *Connection) ClientCheckServerCert(chain []*x509.Certificate) error {
+	_, err := c.checkServerCert(chain)
+	return err
+}
+
+// checkServerCert ClientCheckServerCert telling how the certificate was accepted
+func (c *Connection) checkServerCert(chain []*x509.Certificate) (ServerCertTrust, error) {
+	if c.InsecureSkipVerify {
+		return SERVER_CERT_UNVERIFIED, nil
+	}
+	host := net.JoinHostPort(c.Host, strconv.Itoa(c.Port))
+	if 0 == len(chain) {
+		return SERVER_CERT_UNVERIFIED, ERR_CERT_NOT_TRUSTED
+	}
+	x := chain[0]
+
+	if now := time.Now(); now.Before(x.NotBefore) || now.After(x.NotAfter) {
+		return SERVER_CERT_UNVERIFIED, newServerCertError(ERR_SERVER_CERT_EXPIRES, host, x)
+	}
+
+	if nil != c.redirectCert {
+		// the controller we trusted told us what the farm member presents
+		if x.Equal(c.redirectCert) {
+			return SERVER_CERT_REDIRECT, nil
+		}
+		return SERVER_CERT_UNVERIFIED, newServerCertError(ERR_CERT_NOT_TRUSTED, host, x)
+	}
+
+	sum1, sum256 := sha1.Sum(x.Raw), sha256.Sum256(x.Raw)
+	for _, fp := range c.ServerCertFingerprints {
+		if bytes.Equal(fp, sum1[:]) || bytes.Equal(fp, sum256[:]) {
+			return SERVER_CERT_PINNED, nil
+		}
+	}
+
+	// the system authorities unless RootCAs is set, before the known hosts so
+	// that renewed certificates are not taken for changed ones
+	opts := x509.VerifyOptions{
+		DNSName:       c.Host,
+		Roots:         c.RootCAs,
+		Intermediates: x509.NewCertPool(),
+	}
+	for _, i := range chain[1:] {
+		opts.Intermediates.AddCert(i)
+	}
+	if _, err := x.Verify(opts); nil == err {
+		return SERVER_CERT_CA, nil
+	}
+
+	if nil != c.KnownHosts {
+		if fp, ok, err := c.KnownHosts.Lookup(host); nil != err {
+			return SERVER_CERT_UNVERIFIED, err
+		} else if !ok {
+			// trust on first use
+			return SERVER_CERT_FIRST_USE, c.KnownHosts.Add(host, sum256[:])
+		} else if bytes.Equal(fp, sum1[:]) || bytes.Equal(fp, sum256[:]) {
+			return SERVER_CERT_KNOWN_HOST, nil
+		} else {
+			e := newServerCertError(ERR_CERT_NOT_TRUSTED, host, x)
+			e.Known = fp
+			return SERVER_CERT_UNVERIFIED, e
+		}
+	}
+
+	return SERVER_CERT_UNVERIFIED, newServerCertError(ERR_CERT_NOT_TRUSTED, host, x)
+}
@@ -0,0 +1,187 @@
+package cedar
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/x509"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseFingerprint(t *testing.T) {
+	sum := sha256.Sum256([]byte("cert"))
+	if fp, err := ParseFingerprint(FormatFingerprint(sum[:])); nil != err || !bytes.Equal(sum[:], fp) {
+		t.Error("round trip", fp, err)
+	}
+	sum1 := sha1.Sum([]byte("cert"))
+	if fp, err := ParseFingerprint(strings.ToLower(FormatFingerprint(sum1[:]))); nil != err || !bytes.Equal(sum1[:], fp) {
+		t.Error("sha1", fp, err)
+	}
+	for _, s := range []string{"", "00:11", "zz" + strings.Repeat("00", 19)} {
+		if _, err := ParseFingerprint(s); ErrInvalidFingerprint != err {
+			t.Error(s, err)
+		}
+	}
+}
+
+// checkServerCert the ServerCertError of a login with conn, nil if it succeeds
+func checkServerCert(t *testing.T, conn *Connection) *ServerCertError {
+	err := conn.ClientConnect()
+	conn.Disconnect()
+	if nil == err {
+		return nil
+	} else if e, ok := err.(*ServerCertError); ok {
+		return e
+	}
+	t.Fatal("unexpected error", err)
+	return nil
+}
+
+func TestClientCheckServerCert(t *testing.T) {
+	cert := testCertificate(t)
+	x, err := x509.ParseCertificate(cert.Certificate[0])
+	if nil != err {
+		t.Fatal(err)
+	}
+	ts := newTestServerWithCert(t, cert)
+	defer ts.close()
+
+	newConn := func() *Connection {
+		conn := newTestConnection(ts.port())
+		conn.InsecureSkipVerify = false
+		return conn
+	}
+
+	// self-signed, unknown to the system
+	conn := newConn()
+	if e := checkServerCert(t, conn); nil == e || ERR_CERT_NOT_TRUSTED != e.Code || !x.Equal(e.Cert) || sha256.Sum256(x.Raw) != e.Sha256 {
+		t.Fatal("self-signed certificate trusted", e)
+	} else if IsRetryableError(e) || !strings.Contains(e.Error(), FormatFingerprint(e.Sha256[:])) {
+		t.Error("unexpected error", e)
+	}
+
+	// pinned
+	sum1, sum256 := sha1.Sum(x.Raw), sha256.Sum256(x.Raw)
+	for _, fp := range [][]byte{sum1[:], sum256[:]} {
+		conn = newConn()
+		conn.ServerCertFingerprints = [][]byte{make([]byte, len(fp)), fp}
+		if e := checkServerCert(t, conn); nil != e {
+			t.Error("pinned certificate refused", e)
+		}
+	}
+	conn = newConn()
+	conn.ServerCertFingerprints = [][]byte{make([]byte, len(sum256))}
+	if e := checkServerCert(t, conn); nil == e || ERR_CERT_NOT_TRUSTED != e.Code {
+		t.Error("other certificate trusted", e)
+	}
+
+	// issued by a custom authority
+	conn = newConn()
+	conn.RootCAs = x509.NewCertPool()
+	conn.RootCAs.AddCert(x)
+	if e := checkServerCert(t, conn); nil != e {
+		t.Error("certificate of the authority refused", e)
+	}
+	conn = newConn()
+	conn.RootCAs = x509.NewCertPool()
+	if e := checkServerCert(t, conn); nil == e || ERR_CERT_NOT_TRUSTED != e.Code {
+		t.Error("certificate of another authority trusted", e)
+	}
+}
+
+func TestClientCheckServerCertExpires(t *testing.T) {
+	cert := testCertificateValid(t, time.Now().Add(-2*time.Hour), time.Now().Add(-time.Hour))
+	x, err := x509.ParseCertificate(cert.Certificate[0])
+	if nil != err {
+		t.Fatal(err)
+	}
+	ts := newTestServerWithCert(t, cert)
+	defer ts.close()
+
+	// even when pinned
+	sum := sha256.Sum256(x.Raw)
+	conn := newTestConnection(ts.port())
+	conn.InsecureSkipVerify = false
+	conn.ServerCertFingerprints = [][]byte{sum[:]}
+	if e := checkServerCert(t, conn); nil == e || ERR_SERVER_CERT_EXPIRES != e.Code {
+		t.Error("expired certificate trusted", e)
+	}
+
+	conn = newTestConnection(ts.port())
+	if e := checkServerCert(t, conn); nil != e {
+		t.Error("expiry checked when skipping verification", e)
+	}
+}
+
+func TestKnownHosts(t *testing.T) {
+	cert := testCertificate(t)
+	ts := newTestServerWithCert(t, cert)
+	defer ts.close()
+
+	dir, err := ioutil.TempDir("", "known_hosts")
+	if nil != err {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	known := NewKnownHostsFile(filepath.Join(dir, "known_hosts"))
+	host := net.JoinHostPort("127.0.0.1", strconv.Itoa(ts.port()))
+
+	// first use
+	conn := newTestConnection(ts.port())
+	conn.InsecureSkipVerify = false
+	conn.KnownHosts = known
+	if e := checkServerCert(t, conn); nil != e {
+		t.Fatal("first use refused", e)
+	}
+	fp, ok, err := known.Lookup(host)
+	if nil != err || !ok || len(fp) != sha256.Size {
+		t.Fatal("not recorded", fp, ok, err)
+	}
+
+	// same certificate, with additional connections
+	if err := conn.ClientConnect(); nil != err {
+		t.Fatal(err)
+	}
+	if ts, err := conn.ClientAdditionalConnect(); nil != err {
+		t.Error(err)
+	} else {
+		ts.Sock.Close()
+	}
+	conn.Disconnect()
+
+	// changed certificate
+	other := NewKnownHostsFile(filepath.Join(dir, "other"))
+	if err := other.Add(host, make([]byte, sha256.Size)); nil != err {
+		t.Fatal(err)
+	}
+	conn.KnownHosts = other
+	if e := checkServerCert(t, conn); nil == e || ERR_CERT_NOT_TRUSTED != e.Code || !bytes.Equal(make([]byte, sha256.Size), e.Known) {
+		t.Error("changed certificate trusted", e)
+	} else if !strings.Contains(e.Error(), "changed") {
+		t.Error("unexpected message", e)
+	}
+	if fp, ok, err := other.Lookup(host); nil != err || !ok || !bytes.Equal(make([]byte, sha256.Size), fp) {
+		t.Error("known host overwritten", fp, ok, err)
+	}
+
+	// renewed by a trusted authority
+	x, err := x509.ParseCertificate(cert.Certificate[0])
+	if nil != err {
+		t.Fatal(err)
+	}
+	conn.RootCAs = x509.NewCertPool()
+	conn.RootCAs.AddCert(x)
+	if e := checkServerCert(t, conn); nil != e {
+		t.Error("renewed certificate refused", e)
+	}
+	if fp, ok, err := other.Lookup(host); nil != err || !ok || !bytes.Equal(make([]byte, sha256.Size), fp) {
+		t.Error("known host overwritten", fp, ok, err)
+	}
+}
@@ -0,0 +1,380 @@
+package cedar
+
+import (
+	"bufio"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"go-softether/adapter"
+	"go-softether/mayaqua"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// testServer a stand-in SoftEther server on loopback, just enough of the
+// protocol to log in and relay blocks
+type testServer struct {
+	t  *testing.T
+	ln net.Listener
+
+	// welcome build the welcome pack for a login given the random of the
+	// hello pack, the default one accepts everybody
+	welcome func(auth *mayaqua.Pack, random []byte) *mayaqua.Pack
+	// tunnel serve a tunneling connection, the default one echoes every block
+	tunnel func(login int32, c *testServerConn)
+
+	logins     int32
+	additional int32
+
+	// half grant half-connection, blocks uploaded by the client are echoed
+	// back through the download streams
+	half        bool
+	echo        chan []adapter.Packet
+	misdirected int32
+
+	// udp grant udp acceleration, the stand-in peer echoes every frame back
+	// over udp unless udpDrop is set, udpVersion caps the negotiated version
+	udp        bool
+	udpDrop    bool
+	udpVersion uint32
+	udpFrames  int32
+}
+
+// testServerConn a server side tcp stream in tunneling mode
+type testServerConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *testServerConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+func newTestServer(t *testing.T) *testServer {
+	return newTestServerWithCert(t, testCertificate(t))
+}
+
+func newTestServerWithCert(t *testing.T, cert tls.Certificate) *testServer {
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+		Certificates: []tls.Certificate{cert},
+	})
+	if nil != err {
+		t.Fatal(err)
+	}
+
+	ts := &testServer{t: t, ln: ln}
+	go ts.serve()
+	return ts
+}
+
+func testCertificate(t *testing.T) tls.Certificate {
+	return testCertificateValid(t, time.Now().Add(-time.Hour), time.Now().Add(time.Hour))
+}
+
+func testCertificateValid(t *testing.T, notBefore, notAfter time.Time) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if nil != err {
+		t.Fatal(err)
+	}
+
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "127.0.0.1"},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		NotBefore:    notBefore,
+		NotAfter:     notAfter,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if nil != err {
+		t.Fatal(err)
+	}
+
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+func (ts *testServer) port() int {
+	return ts.ln.Addr().(*net.TCPAddr).Port
+}
+
+func (ts *testServer) close() {
+	ts.ln.Close()
+}
+
+func (ts *testServer) serve() {
+	for {
+		conn, err := ts.ln.Accept()
+		if nil != err {
+			return
+		}
+		go func() {
+			defer conn.Close()
+			ts.handle(conn)
+		}()
+	}
+}
+
+func (ts *testServer) handle(conn net.Conn) {
+	r := bufio.NewReader(conn)
+
+	// signature
+	if req, err := http.ReadRequest(r); nil != err {
+		return
+	} else if _, err := io.Copy(ioutil.Discard, req.Body); nil != err {
+		return
+	} else if req.URL.Path != mayaqua.HTTP_VPN_TARGET2 {
+		return
+	}
+
+	hello := &mayaqua.Pack{}
+	hello.AddStr("hello", "Stand-in SoftEther VPN Server")
+	hello.AddInt("version", 443)
+	hello.AddInt("build", 9999)
+	random := make([]byte, mayaqua.SHA1_SIZE)
+	rand.Read(random)
+	hello.AddData("random", random)
+	if err := writeTestPack(conn, hello); nil != err {
+		return
+	}
+
+	// auth
+	var auth *mayaqua.Pack
+	if req, err := http.ReadRequest(r); nil != err {
+		return
+	} else if p, err := mayaqua.ReadPack(req.Body); nil != err {
+		return
+	} else {
+		auth = p
+	}
+
+	if "additional_connect" == auth.GetStr("method") {
+		n := atomic.AddInt32(&ts.additional, 1)
+		reply := &mayaqua.Pack{}
+		direction := TCP_BOTH
+		if ts.half {
+			direction = TCP_CLIENT_TO_SERVER
+			if n%2 == 1 {
+				direction = TCP_SERVER_TO_CLIENT
+			}
+			reply.AddInt("direction", uint32(direction))
+		}
+		if err := writeTestPack(conn, reply); nil != err {
+			return
+		}
+
+		c := &testServerConn{Conn: conn, r: r}
+		if ts.half {
+			ts.halfTunnel(c, direction)
+		} else {
+			echoTestTunnel(c)
+		}
+		return
+	}
+
+	login := atomic.AddInt32(&ts.logins, 1)
+
+	welcome := defaultTestWelcome(auth)
+	if nil != ts.welcome {
+		welcome = ts.welcome(auth, random)
+	}
+	if ts.half {
+		welcome.AddBool("half_connection", true)
+	}
+	if ts.udp && auth.GetBool("use_udp_acceleration") {
+		ua := ts.udpPeer(auth, conn)
+		if nil == ua {
+			return
+		}
+		defer ua.Close()
+		welcome.AddBool("use_udp_acceleration", true)
+		welcome.AddInt("udp_acceleration_version", ua.Version)
+		welcome.AddIp("udp_acceleration_server_ip", net.IPv4zero)
+		welcome.AddInt("udp_acceleration_server_port", ua.MyPort)
+		welcome.AddData("udp_acceleration_server_key", ua.MyKey[:])
+		welcome.AddData("udp_acceleration_server_key_v2", ua.MyKeyV2[:])
+		welcome.AddInt("udp_acceleration_server_cookie", ua.MyCookie)
+		welcome.AddInt("udp_acceleration_client_cookie", ua.YourCookie)
+	}
+	if err := writeTestPack(conn, welcome); nil != err {
+		return
+	}
+	if 0 != welcome.GetError() {
+		return
+	}
+
+	c := &testServerConn{Conn: conn, r: r}
+	if nil != ts.tunnel {
+		ts.tunnel(login, c)
+	} else if ts.half {
+		ts.halfTunnel(c, TCP_CLIENT_TO_SERVER)
+	} else {
+		echoTestTunnel(c)
+	}
+}
+
+// udpPeer the server side of udp acceleration
+func (ts *testServer) udpPeer(auth *mayaqua.Pack, conn net.Conn) *UdpAccel {
+	ua, err := NewUdpAccel(net.IPv4(127, 0, 0, 1))
+	if nil != err {
+		return nil
+	}
+
+	ip := auth.GetIp("udp_acceleration_client_ip")
+	if nil == ip || ip.IsUnspecified() {
+		ip = conn.RemoteAddr().(*net.TCPAddr).IP
+	}
+	version := auth.GetInt("udp_acceleration_max_version")
+	if 0 != ts.udpVersion && version > ts.udpVersion {
+		version = ts.udpVersion
+	}
+	key := auth.GetData("udp_acceleration_client_key")
+	if 2 == version {
+		key = auth.GetData("udp_acceleration_client_key_v2")
+	}
+	if err := ua.Init(version, key, ip,
+		auth.GetInt("udp_acceleration_client_port"), 1111, 2222); nil != err {
+		ua.Close()
+		return nil
+	}
+
+	if ts.udpDrop {
+		return ua
+	}
+
+	go func() {
+		for {
+			if err := ua.SendKeepAlive(); nil != err {
+				return
+			}
+			time.Sleep(100 * time.Millisecond)
+		}
+	}()
+	go func() {
+		for {
+			p, err := ua.Recv()
+			if nil != err {
+				return
+			}
+			atomic.AddInt32(&ts.udpFrames, 1)
+			ua.Send(p)
+		}
+	}()
+
+	return ua
+}
+
+// halfTunnel serve a single direction stream, anything the client sends on
+// a download stream is counted as misdirected
+func (ts *testServer) halfTunnel(c *testServerConn, direction TcpDirection) {
+	if direction == TCP_CLIENT_TO_SERVER {
+		for {
+			ps, err := recvBlocks(c)
+			if nil != err {
+				return
+			}
+			if nil != ps {
+				ts.echo <- ps
+			}
+		}
+	}
+
+	go func() {
+		if _, err := recvBlocks(c); nil == err {
+			atomic.AddInt32(&ts.misdirected, 1)
+		}
+		c.Close()
+	}()
+	for ps := range ts.echo {
+		if err := sendBlocks(c, ps); nil != err {
+			return
+		}
+	}
+}
+
+func defaultTestWelcome(auth *mayaqua.Pack) *mayaqua.Pack {
+	p := &mayaqua.Pack{}
+	p.AddStr("session_name", "SID-"+auth.GetStr("username"))
+	p.AddStr("connection_name", "CID-1")
+	key := make([]byte, mayaqua.SHA1_SIZE)
+	rand.Read(key)
+	p.AddData("session_key", key)
+	p.AddInt("session_key_32", 1234)
+	p.AddBool("use_encrypt", true)
+	p.AddInt("max_connection", auth.GetInt("max_connection"))
+	p.AddBool("policy:Access", true)
+	return p
+}
+
+func writeTestPack(w io.Writer, p *mayaqua.Pack) error {
+	b, err := p.ToBuf()
+	if nil != err {
+		return err
+	}
+
+	head := "HTTP/1.1 200 OK\r\n" +
+		"Content-Type: " + mayaqua.HTTP_CONTENT_TYPE2 + "\r\n" +
+		"Content-Length: " + strconv.Itoa(len(b)) + "\r\n\r\n"
+	_, err = w.Write(append([]byte(head), b...))
+	return err
+}
+
+func echoTestTunnel(c *testServerConn) {
+	for {
+		ps, err := recvBlocks(c)
+		if nil != err {
+			return
+		}
+		if nil == ps {
+			continue
+		}
+		if err := sendBlocks(c, ps); nil != err {
+			return
+		}
+	}
+}
+
+func newTestConnection(port int) *Connection {
+	session := &Session{}
+	session.ClientAuth.AuthType = CLIENT_AUTHTYPE_PASSWORD
+	session.ClientAuth.Username = "user"
+	session.ClientOption.HubName = "DEFAULT"
+	session.ClientOption.MaxConnection = 1
+	session.ClientOption.UseEncrypt = true
+
+	conn := &Connection{
+		Cedar:              NewCedar(),
+		Host:               "127.0.0.1",
+		Port:               port,
+		ClientStr:          "test",
+		Session:            session,
+		InsecureSkipVerify: true,
+	}
+	session.Connection = conn
+
+	return conn
+}
+
+// readPackets read from an adapter in the background until it fails
+func readPackets(a adapter.Adapter) <-chan []adapter.Packet {
+	c := make(chan []adapter.Packet, 16)
+	go func() {
+		defer close(c)
+		for {
+			p, err := a.Read()
+			if nil != err {
+				return
+			}
+			c <- p
+		}
+	}()
+	return c
+}
@@ -1,12 +1,14 @@
 package cedar
 
 import (
+	"context"
 	"encoding/binary"
 	"go-softether/adapter"
 	"go-softether/mayaqua"
 	"io"
 	"io/ioutil"
 	"math/rand"
+	"sync"
 	"time"
 )
 
@@ -22,6 +24,15 @@ type Session struct {
 	Policy       Policy
 	SessionKey   mayaqua.Sha1Sum
 	SessionKey32 uint32
+
+	HalfConnection bool // each tcp stream carries a single direction, as granted by the server
+
+	OnRetry     func(cause error) // Called before each reconnect attempt, from the session goroutine
+	OnReconnect func()            // Called once logged in again, from the session goroutine
+
+	lock sync.Mutex
+	done chan struct{} // closed when the session is over
+	err  error         // why the session is over
 }
 
 // NodeInfo node information
@@ -36,13 +47,13 @@ type NodeInfo struct {
 	ClientOsVer        string // Client OS version
 	ClientOsProductId  string // Client OS Product ID
 	ClientHostname     string // Client host name
-	ClientIpAddress    uint32 // Client IP address
+	ClientIpAddress    uint32 `pack:",ip"` // Client IP address
 	ClientPort         uint32 // Client port number
 	ServerHostname     string // Server host name
-	ServerIpAddress    uint32 // Server IP address
-	ServerPort         uint32 // Server port number
+	ServerIpAddress    uint32 `pack:",ip"`         // Server IP address
+	ServerPort         uint32 `pack:"ServerPort2"` // Server port number
 	ProxyHostname      string // Proxy host name
-	ProxyIpAddress     uint32 // Proxy Server IP Address
+	ProxyIpAddress     uint32 `pack:",ip"` // Proxy Server IP Address
 	ProxyPort          uint32 // Proxy port number
 	HubName            string // HUB name
 
@@ -51,13 +62,11 @@ type NodeInfo struct {
 	ClientIpAddress6 [16]byte             // Client IPv6 address
 	ServerIpAddress6 [16]byte             // Server IP address
 	ProxyIpAddress6  [16]byte             // Proxy Server IP Address
-	Padding          [304 - (16 * 3)]byte // Padding
+	Padding          [304 - (16 * 3)]byte `pack:"-"` // Padding
 }
 
-// Main main
+// Main start tunneling, the returned adapter survives reconnects
 func (se *Session) Main() (adapter.Adapter, error) {
-	s := se.Connection.tcp[0]
-
 	// WTF: I don't know why the following line is needed, other wise, an OpenSSL protocol version unsupported error is returned
 	// s.WTFWriteRaw([]byte{0, 1, 2, 3, 4})
 
@@ -65,62 +74,491 @@ func (se *Session) Main() (adapter.Adapter, error) {
 		Session: se,
 		l2r:     make(chan []adapter.Packet, 16),
 		r2l:     make(chan []adapter.Packet, 16),
+		quit:    make(chan struct{}),
 	}
 
-	go func() {
-		// remote to local
-		for {
-			sz := uint32(0)
-			if err := binary.Read(s, binary.BigEndian, &sz); nil != err {
-				// TODO: reconnect
+	go se.mainLoop(sessionAdapter)
+
+	return sessionAdapter, nil
+}
+
+func (se *Session) mainLoop(a *sessionAdapter) {
+	var err error
+	defer func() {
+		se.Connection.Disconnect()
+		se.setErr(err)
+		close(a.r2l)
+	}()
+
+	for {
+		err = se.tunnel(a)
+
+		select {
+		case <-a.quit:
+			err = ERR_USER_CANCEL
+			return
+		default:
+		}
+
+		if err = se.reconnect(a, err); nil != err {
+			return
+		}
+	}
+}
+
+// Done closed when the session is over for good, that is when it is
+// destroyed or can not be reconnected
+func (se *Session) Done() <-chan struct{} {
+	se.lock.Lock()
+	defer se.lock.Unlock()
+
+	if nil == se.done {
+		se.done = make(chan struct{})
+	}
+	return se.done
+}
+
+// Err why the session is over, nil while it is still alive
+func (se *Session) Err() error {
+	se.lock.Lock()
+	defer se.lock.Unlock()
+
+	return se.err
+}
+
+func (se *Session) udpAccel() *UdpAccel {
+	se.lock.Lock()
+	defer se.lock.Unlock()
+
+	return se.UdpAccel
+}
+
+func (se *Session) setUdpAccel(ua *UdpAccel) {
+	se.lock.Lock()
+	defer se.lock.Unlock()
+
+	se.UdpAccel = ua
+}
+
+func (se *Session) setErr(err error) {
+	if nil == err {
+		err = ERR_DISCONNECTED
+	}
+
+	se.lock.Lock()
+	defer se.lock.Unlock()
+
+	se.err = err
+	if nil == se.done {
+		se.done = make(chan struct{})
+	}
+	close(se.done)
+}
+
+// tunnel relay packets over the tcp streams of the current login until they
+// all break or the adapter is destroyed, up to maxConnection() streams are
+// kept open by adding more of them in the background
+func (se *Session) tunnel(a *sessionAdapter) error {
+	c := se.Connection
+	max := se.maxConnection()
+
+	type relayResult struct {
+		ts  *TcpSock
+		err error
+	}
+	relayErr := make(chan relayResult, MAX_TCP_CONNECTION)
+	added := make(chan *TcpSock, MAX_TCP_CONNECTION)
+	failed := make(chan error, MAX_TCP_CONNECTION)
+
+	ctx, cancel := a.quitContext()
+	defer cancel()
+
+	alive, pending := 0, 0
+	start := func(ts *TcpSock) {
+		alive++
+		go func() {
+			relayErr <- relayResult{ts, se.relay(ts, a)}
+		}()
+	}
+	for _, ts := range c.tcp {
+		start(ts)
+	}
+
+	timer := time.NewTicker(se.additionalConnectionInterval())
+	defer timer.Stop()
+
+	if ua := se.udpAccel(); nil != ua {
+		udpDone := make(chan struct{})
+		go func() {
+			se.udpLoop(ua, a)
+			close(udpDone)
+		}()
+		defer func() {
+			ua.Close()
+			<-udpDone
+		}()
+	}
+
+	var err error
+	for alive > 0 {
+		select {
+		case r := <-relayErr:
+			alive--
+			err = r.err
+			c.removeSock(r.ts)
+
+		case ts := <-added:
+			pending--
+			c.tcp = append(c.tcp, ts)
+			start(ts)
+
+		case e := <-failed:
+			pending--
+			if e == ERR_TOO_MANY_CONNECTION && alive+pending < max {
+				// the server knows better
+				max = alive + pending
 			}
 
-			if sz == KEEP_ALIVE_MAGIC {
-				binary.Read(s, binary.BigEndian, &sz)
-				io.CopyN(ioutil.Discard, s, int64(sz))
-			} else {
-				ps := make([]adapter.Packet, 0, sz)
-				for idx := int64(sz); idx > 0; idx-- {
-					binary.Read(s, binary.BigEndian, &sz)
-					buf := make([]uint8, sz)
-					io.ReadFull(s, buf)
-					ps = append(ps, buf)
-				}
-				sessionAdapter.r2l <- ps
+		case <-timer.C:
+			if alive+pending < max {
+				pending++
+				go func() {
+					if ts, err := c.ClientAdditionalConnectContext(ctx); nil != err {
+						failed <- err
+					} else {
+						added <- ts
+					}
+				}()
+			}
+
+		case <-a.quit:
+			// every relay stops on its own
+			for alive > 0 {
+				<-relayErr
+				alive--
 			}
 		}
+	}
+
+	// late additional connections are useless now
+	for ; pending > 0; pending-- {
+		select {
+		case ts := <-added:
+			ts.Sock.Close()
+		case <-failed:
+		}
+	}
+
+	return err
+}
+
+// udpLoop receive frames over udp and keep the udp path alive until ua is closed
+func (se *Session) udpLoop(ua *UdpAccel, a *sessionAdapter) {
+	stop := make(chan struct{})
+	defer close(stop)
 
-	}()
 	go func() {
-		// local to remote
-		timer := time.NewTicker(time.Second * 3)
-		rand := rand.New(rand.NewSource(time.Now().Unix()))
 		for {
+			if err := ua.SendKeepAlive(); err == ErrUdpAccelClosed {
+				return
+			}
+
 			select {
-			case ps := <-sessionAdapter.l2r:
-				sz := uint32(len(ps))
-				binary.Write(s, binary.BigEndian, sz)
-				for _, p := range ps {
-					sz = uint32(len(p))
-					binary.Write(s, binary.BigEndian, sz)
-					s.Write(p)
-				}
-
-			case <-timer.C:
-				sz := KEEP_ALIVE_MAGIC
-				if err := binary.Write(s, binary.BigEndian, sz); nil != err {
-					// TODO: reconnect
-					return
-				}
-				sz = uint32(rand.Intn(int(MAX_KEEPALIVE_SIZE)))
-				if sz == 0 {
-					sz = 1
-				}
-				binary.Write(s, binary.BigEndian, sz)
-				io.CopyN(s, rand, int64(sz))
+			case <-time.After(udpAccelKeepAliveInterval()):
+			case <-stop:
+				return
 			}
 		}
 	}()
 
-	return sessionAdapter, nil
+	for {
+		p, err := ua.Recv()
+		if nil != err {
+			return
+		}
+
+		select {
+		case a.r2l <- []adapter.Packet{p}:
+		case <-a.quit:
+			return
+		}
+	}
+}
+
+// relay relay packets over a single tcp stream until it breaks or the
+// adapter is destroyed, honoring the direction of the stream
+func (se *Session) relay(ts *TcpSock, a *sessionAdapter) error {
+	s := ts.Sock
+
+	// the server sends nothing, not even keep-alives, on upload streams
+	timeout := se.timeout()
+	if ts.Direction == TCP_CLIENT_TO_SERVER {
+		timeout = 0
+	}
+
+	recvErr := make(chan error, 1)
+	go func() {
+		recvErr <- se.recvLoop(s, a, timeout)
+	}()
+
+	var recvDone bool
+	var err error
+	if ts.Direction == TCP_SERVER_TO_CLIENT {
+		select {
+		case err = <-recvErr:
+			recvDone = true
+		case <-a.quit:
+		}
+	} else {
+		recvDone, err = se.sendLoop(s, a, recvErr)
+	}
+	s.Close()
+	if !recvDone {
+		<-recvErr
+	}
+
+	return err
+}
+
+// maxConnection number of tcp streams the client asked for, capped by the server
+func (se *Session) maxConnection() int {
+	max := se.ClientOption.MaxConnection
+	if 0 != se.Policy.MaxConnection && se.Policy.MaxConnection < max {
+		max = se.Policy.MaxConnection
+	}
+	if max > MAX_TCP_CONNECTION {
+		max = MAX_TCP_CONNECTION
+	}
+	if max < 1 {
+		max = 1
+	}
+	return int(max)
+}
+
+func (se *Session) additionalConnectionInterval() time.Duration {
+	if 0 != se.ClientOption.AdditionalConnectionInterval {
+		return time.Duration(se.ClientOption.AdditionalConnectionInterval) * time.Second
+	}
+	return time.Duration(ADDITIONAL_CONNECTION_INTERVAL_DEFAULT) * time.Second
+}
+
+func (se *Session) timeout() time.Duration {
+	if se.Policy.TimeOut != 0 {
+		return time.Duration(se.Policy.TimeOut) * time.Second
+	}
+	return time.Duration(TIMEOUT_DEFAULT) * time.Second
+}
+
+// recvLoop remote to local, silence longer than timeout (if not 0) means a dead stream
+func (se *Session) recvLoop(s *mayaqua.Sock, a *sessionAdapter, timeout time.Duration) error {
+	for {
+		if 0 != timeout {
+			if err := s.SetReadDeadline(time.Now().Add(timeout)); nil != err {
+				return err
+			}
+		}
+
+		ps, err := recvBlocks(s)
+		if nil != err {
+			return err
+		}
+		if nil == ps {
+			continue
+		}
+
+		select {
+		case a.r2l <- ps:
+		case <-a.quit:
+			return nil
+		}
+	}
+}
+
+// sendLoop local to remote, returns whether the error comes from recvLoop
+func (se *Session) sendLoop(s *mayaqua.Sock, a *sessionAdapter, recvErr <-chan error) (bool, error) {
+	timer := time.NewTicker(time.Duration(KEEP_ALIVE_INTERVAL) * time.Second)
+	defer timer.Stop()
+	rand := rand.New(rand.NewSource(time.Now().UnixNano()))
+
+	for {
+		select {
+		case ps := <-a.l2r:
+			if err := sendBlocks(s, ps); nil != err {
+				return false, err
+			}
+
+		case <-timer.C:
+			if err := sendKeepAlive(s, rand); nil != err {
+				return false, err
+			}
+
+		case err := <-recvErr:
+			return true, err
+
+		case <-a.quit:
+			return false, nil
+		}
+	}
+}
+
+// recvBlocks read a block of packets, nil is returned for a keep-alive
+func recvBlocks(r io.Reader) ([]adapter.Packet, error) {
+	num := uint32(0)
+	if err := binary.Read(r, binary.BigEndian, &num); nil != err {
+		return nil, err
+	}
+
+	if num == KEEP_ALIVE_MAGIC {
+		sz := uint32(0)
+		if err := binary.Read(r, binary.BigEndian, &sz); nil != err {
+			return nil, err
+		} else if sz > MAX_KEEPALIVE_SIZE {
+			return nil, ERR_PROTOCOL_ERROR
+		}
+		_, err := io.CopyN(ioutil.Discard, r, int64(sz))
+		return nil, err
+	}
+
+	if num > MAX_BLOCK_NUM {
+		return nil, ERR_PROTOCOL_ERROR
+	}
+
+	ps := make([]adapter.Packet, 0, num)
+	for idx := num; idx > 0; idx-- {
+		sz := uint32(0)
+		if err := binary.Read(r, binary.BigEndian, &sz); nil != err {
+			return nil, err
+		} else if sz > MAX_BLOCK_SIZE {
+			return nil, ERR_PROTOCOL_ERROR
+		}
+		buf := make([]uint8, sz)
+		if _, err := io.ReadFull(r, buf); nil != err {
+			return nil, err
+		}
+		ps = append(ps, buf)
+	}
+
+	return ps, nil
+}
+
+// sendBlocks write a block of packets as a single write
+func sendBlocks(w io.Writer, ps []adapter.Packet) error {
+	sz := 4
+	for _, p := range ps {
+		sz += 4 + len(p)
+	}
+
+	buf := make([]byte, 0, sz)
+	buf = appendUint32(buf, uint32(len(ps)))
+	for _, p := range ps {
+		buf = appendUint32(buf, uint32(len(p)))
+		buf = append(buf, p...)
+	}
+
+	_, err := w.Write(buf)
+	return err
+}
+
+// sendKeepAlive write a keep-alive with random padding
+func sendKeepAlive(w io.Writer, rand *rand.Rand) error {
+	sz := uint32(rand.Intn(int(MAX_KEEPALIVE_SIZE)))
+	if sz == 0 {
+		sz = 1
+	}
+
+	buf := make([]byte, 8+sz)
+	binary.BigEndian.PutUint32(buf[0:], KEEP_ALIVE_MAGIC)
+	binary.BigEndian.PutUint32(buf[4:], sz)
+	rand.Read(buf[8:])
+
+	_, err := w.Write(buf)
+	return err
+}
+
+func appendUint32(b []byte, v uint32) []byte {
+	return append(b, byte(v>>24), byte(v>>16), byte(v>>8), byte(v))
+}
+
+// reconnect re-run the login sequence with exponential backoff until it
+// succeeds, the retries run out or the adapter is destroyed
+func (se *Session) reconnect(a *sessionAdapter, cause error) error {
+	se.Connection.Disconnect()
+
+	ctx, cancel := a.quitContext()
+	defer cancel()
+
+	o := &se.ClientOption
+	for retry := uint32(0); ; retry++ {
+		if o.NumRetry != mayaqua.INFINITE && retry >= o.NumRetry {
+			return cause
+		}
+
+		if nil != se.OnRetry {
+			se.OnRetry(cause)
+		}
+
+		select {
+		case <-time.After(se.retryInterval(retry)):
+		case <-a.quit:
+			return ERR_USER_CANCEL
+		}
+
+		if cause = se.Connection.ClientConnectContext(ctx); nil == cause {
+			if nil != se.OnReconnect {
+				se.OnReconnect()
+			}
+			return nil
+		} else if nil != ctx.Err() {
+			return ERR_USER_CANCEL
+		} else if !IsRetryableError(cause) {
+			return cause
+		}
+	}
+}
+
+// retryInterval full interval doubled on each retry, with the upper half jittered
+func (se *Session) retryInterval(retry uint32) time.Duration {
+	base := se.ClientOption.RetryInterval
+	if base == 0 {
+		base = RETRY_INTERVAL_DEFAULT
+	}
+
+	d := time.Duration(RETRY_INTERVAL_MAX) * time.Second
+	if retry < 16 {
+		if x := time.Duration(base) * time.Second << retry; x < d {
+			d = x
+		}
+	}
+
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+// IsRetryableError whether reconnecting may help, errors the server reports
+// about the account or the hub are final
+func IsRetryableError(err error) bool {
+	if _, ok := err.(*ServerCertError); ok {
+		return false
+	}
+	switch err {
+	case ERR_AUTH_FAILED,
+		ERR_AUTHTYPE_NOT_SUPPORTED,
+		ERR_ACCESS_DENIED,
+		ERR_HUB_NOT_FOUND,
+		ERR_USER_CANCEL,
+		ERR_IP_ADDRESS_DENIED,
+		ERR_MONITOR_MODE_DENIED,
+		ERR_BRIDGE_MODE_DENIED,
+		ERR_BRANDED_C_TO_S,
+		ERR_BRANDED_C_FROM_S,
+		ERR_CERT_NOT_TRUSTED,
+		ERR_PROXY_AUTH_FAILED,
+		ErrUseEncryptFalse,
+		ErrClientCertMismatch,
+		ErrPlainPasswordInsecure,
+		ErrNoHubName,
+		ErrNoUsername,
+		context.Canceled:
+		return false
+	}
+	return true
 }
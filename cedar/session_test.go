@@ -0,0 +1,300 @@
+package cedar
+
+import (
+	"bytes"
+	"go-softether/adapter"
+	"go-softether/mayaqua"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestSessionReconnect(t *testing.T) {
+	ts := newTestServer(t)
+	defer ts.close()
+
+	// the first tcp stream dies right after relaying one block
+	ts.tunnel = func(login int32, c *testServerConn) {
+		if login == 1 {
+			if ps, err := recvBlocks(c); nil == err && nil != ps {
+				sendBlocks(c, ps)
+			}
+			return
+		}
+		echoTestTunnel(c)
+	}
+
+	conn := newTestConnection(ts.port())
+	conn.Session.ClientOption.NumRetry = mayaqua.INFINITE
+	var retries, reconnects int32
+	conn.Session.OnRetry = func(cause error) {
+		atomic.AddInt32(&retries, 1)
+	}
+	conn.Session.OnReconnect = func() {
+		atomic.AddInt32(&reconnects, 1)
+	}
+	if err := conn.ClientConnect(); nil != err {
+		t.Fatal(err)
+	}
+
+	a, err := conn.Session.Main()
+	if nil != err {
+		t.Fatal(err)
+	}
+	defer a.Destroy()
+	packets := readPackets(a)
+
+	frame := adapter.Packet{1, 2, 3, 4}
+	echoed := func() bool {
+		a.Write([]adapter.Packet{frame})
+		select {
+		case ps := <-packets:
+			return len(ps) == 1 && bytes.Equal(ps[0], frame)
+		case <-time.After(200 * time.Millisecond):
+			return false
+		}
+	}
+
+	if !echoed() {
+		t.Fatal("no echo on the first tcp stream")
+	}
+
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		if atomic.LoadInt32(&ts.logins) >= 2 && echoed() {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("no echo after reconnect, logins:", atomic.LoadInt32(&ts.logins))
+		}
+	}
+	if atomic.LoadInt32(&retries) < 1 || 1 != atomic.LoadInt32(&reconnects) {
+		t.Error("retries", retries, "reconnects", reconnects)
+	}
+}
+
+func TestRetryInterval(t *testing.T) {
+	se := &Session{}
+	se.ClientOption.RetryInterval = 2
+
+	for retry, upper := range []time.Duration{2, 4, 8, 16, 32, 60, 60} {
+		upper *= time.Second
+		for i := 0; i < 16; i++ {
+			if d := se.retryInterval(uint32(retry)); d < upper/2 || d > upper {
+				t.Error("retry", retry, "interval", d, "out of", upper/2, upper)
+			}
+		}
+	}
+
+	if d := se.retryInterval(1000); d > time.Duration(RETRY_INTERVAL_MAX)*time.Second {
+		t.Error("interval overflow", d)
+	}
+}
+
+func TestSessionError(t *testing.T) {
+	ts := newTestServer(t)
+	defer ts.close()
+
+	// the server goes away right after the login
+	ts.tunnel = func(login int32, c *testServerConn) {}
+
+	conn := newTestConnection(ts.port())
+	if err := conn.ClientConnect(); nil != err {
+		t.Fatal(err)
+	}
+
+	a, err := conn.Session.Main()
+	if nil != err {
+		t.Fatal(err)
+	}
+	defer a.Destroy()
+
+	select {
+	case <-conn.Session.Done():
+	case <-time.After(10 * time.Second):
+		t.Fatal("session is not over")
+	}
+
+	if err := conn.Session.Err(); nil == err {
+		t.Error("no terminal error")
+	}
+	if _, err := a.Read(); err != conn.Session.Err() {
+		t.Error("unexpected read error", err)
+	}
+	if err := a.Write([]adapter.Packet{{1}}); err != conn.Session.Err() {
+		t.Error("unexpected write error", err)
+	}
+}
+
+func TestSessionDestroy(t *testing.T) {
+	ts := newTestServer(t)
+	defer ts.close()
+
+	conn := newTestConnection(ts.port())
+	if err := conn.ClientConnect(); nil != err {
+		t.Fatal(err)
+	}
+
+	a, err := conn.Session.Main()
+	if nil != err {
+		t.Fatal(err)
+	}
+	a.Destroy()
+
+	if _, err := a.Read(); err != ERR_USER_CANCEL {
+		t.Error("unexpected read error", err)
+	}
+	<-conn.Session.Done()
+}
+
+func TestSessionDestroyReconnecting(t *testing.T) {
+	ts := newTestServer(t)
+	defer ts.close()
+
+	// the server goes away right after the login and stops answering later
+	hang := make(chan struct{})
+	defer close(hang)
+	ts.tunnel = func(login int32, c *testServerConn) {}
+	ts.welcome = func(auth *mayaqua.Pack, random []byte) *mayaqua.Pack {
+		if atomic.LoadInt32(&ts.logins) > 1 {
+			<-hang
+		}
+		return defaultTestWelcome(auth)
+	}
+
+	conn := newTestConnection(ts.port())
+	conn.Session.ClientOption.NumRetry = mayaqua.INFINITE
+	if err := conn.ClientConnect(); nil != err {
+		t.Fatal(err)
+	}
+
+	a, err := conn.Session.Main()
+	if nil != err {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(10 * time.Second)
+	for atomic.LoadInt32(&ts.logins) < 2 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	time.Sleep(50 * time.Millisecond)
+
+	// the pending login does not hold the session back
+	start := time.Now()
+	a.Destroy()
+	select {
+	case <-conn.Session.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("session is not over")
+	}
+	if time.Since(start) > time.Second || ERR_USER_CANCEL != conn.Session.Err() {
+		t.Error("unexpected end", time.Since(start), conn.Session.Err())
+	}
+}
+
+func TestSessionMaxConnection(t *testing.T) {
+	ts := newTestServer(t)
+	defer ts.close()
+
+	conn := newTestConnection(ts.port())
+	conn.Session.ClientOption.MaxConnection = 4
+	if err := conn.ClientConnect(); nil != err {
+		t.Fatal(err)
+	}
+
+	a, err := conn.Session.Main()
+	if nil != err {
+		t.Fatal(err)
+	}
+	defer a.Destroy()
+	packets := readPackets(a)
+
+	deadline := time.Now().Add(10 * time.Second)
+	for atomic.LoadInt32(&ts.additional) < 3 {
+		if time.Now().After(deadline) {
+			t.Fatal("additional connections:", atomic.LoadInt32(&ts.additional))
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	// every block comes back, whichever stream carries it
+	const n = 64
+	go func() {
+		for i := 0; i < n; i++ {
+			a.Write([]adapter.Packet{{byte(i)}})
+		}
+	}()
+
+	seen := make(map[byte]bool)
+	for len(seen) < n {
+		select {
+		case ps := <-packets:
+			for _, p := range ps {
+				seen[p[0]] = true
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("echoed", len(seen), "of", n)
+		}
+	}
+
+	time.Sleep(2 * time.Second)
+	if additional := atomic.LoadInt32(&ts.additional); additional != 3 {
+		t.Error("too many additional connections:", additional)
+	}
+}
+
+func TestSessionHalfConnection(t *testing.T) {
+	ts := newTestServer(t)
+	defer ts.close()
+	ts.half = true
+	ts.echo = make(chan []adapter.Packet, 256)
+
+	conn := newTestConnection(ts.port())
+	conn.Session.ClientOption.MaxConnection = 4
+	conn.Session.ClientOption.HalfConnection = true
+	if err := conn.ClientConnect(); nil != err {
+		t.Fatal(err)
+	}
+	if !conn.Session.HalfConnection {
+		t.Fatal("half-connection is not granted")
+	}
+
+	a, err := conn.Session.Main()
+	if nil != err {
+		t.Fatal(err)
+	}
+	defer a.Destroy()
+	packets := readPackets(a)
+
+	deadline := time.Now().Add(10 * time.Second)
+	for atomic.LoadInt32(&ts.additional) < 3 {
+		if time.Now().After(deadline) {
+			t.Fatal("additional connections:", atomic.LoadInt32(&ts.additional))
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	const n = 64
+	go func() {
+		for i := 0; i < n; i++ {
+			a.Write([]adapter.Packet{{byte(i)}})
+		}
+	}()
+
+	seen := make(map[byte]bool)
+	for len(seen) < n {
+		select {
+		case ps := <-packets:
+			for _, p := range ps {
+				seen[p[0]] = true
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("echoed", len(seen), "of", n)
+		}
+	}
+
+	// keep-alives included, nothing is ever written to a download stream
+	time.Sleep(time.Duration(KEEP_ALIVE_INTERVAL)*time.Second + 500*time.Millisecond)
+	if misdirected := atomic.LoadInt32(&ts.misdirected); 0 != misdirected {
+		t.Error("writes on download streams:", misdirected)
+	}
+}
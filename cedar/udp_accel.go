@@ -1,5 +1,494 @@
 package cedar
 
+import (
+	"bytes"
+	"compress/zlib"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/rc4"
+	"crypto/sha1"
+	"encoding/binary"
+	"errors"
+	"go-softether/adapter"
+	"io"
+	"io/ioutil"
+	mrand "math/rand"
+	"net"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+const (
+	UDP_ACCELERATION_COMMON_KEY_SIZE_V1     = 20    // Common key size
+	UDP_ACCELERATION_PACKET_KEY_SIZE_V1     = 20    // Key size for the packet
+	UDP_ACCELERATION_PACKET_IV_SIZE_V1      = 20    // IV size for the packet
+	UDP_ACCELERATION_COMMON_KEY_SIZE_V2     = 128   // Common key size (V2)
+	UDP_ACCELERATION_PACKET_IV_SIZE_V2      = 12    // IV size for the packet (V2)
+	UDP_ACCELERATION_PACKET_MAC_SIZE_V2     = 16    // MAC size for the packet (V2)
+	UDP_ACCELERATION_MAX_VERSION            = 2     // Highest supported version
+	UDP_ACCELERATION_REPLAY_WINDOW_SIZE     = 1024  // Number of recent datagrams of the peer remembered against replays (V2)
+	UDP_ACCELERATION_TMP_BUF_SIZE           = 2048  // Buffer size
+	UDP_ACCELERATION_WINDOW_SIZE_MSEC       = 30000 // Receive window size (in milliseconds)
+	UDP_ACCELERATION_KEEPALIVE_INTERVAL_MIN = 1000  // Keep-alive interval (minimum, in milliseconds)
+	UDP_ACCELERATION_KEEPALIVE_INTERVAL_MAX = 3000  // Keep-alive interval (maximum, in milliseconds)
+	UDP_ACCELERATION_KEEPALIVE_TIMEOUT      = 9000  // Time to disconnect time by judging as UDP unreachable (in milliseconds)
+	UDP_ACCELERATION_MAX_PADDING_SIZE       = 32    // Maximum padding size
+
+	udpAccelHeaderSize = 4 + 8 + 8 + 2 + 1 // cookie, my tick, your tick, size, flag
+)
+
+var (
+	// ErrUdpAccelClosed udp acceleration is closed
+	ErrUdpAccelClosed = errors.New("udp acceleration closed")
+	// ErrUdpAccelNotReady the peer is not known yet
+	ErrUdpAccelNotReady = errors.New("udp acceleration not ready")
+	// ErrUdpAccelInvalidPacket the datagram is malformed, forged or out of window
+	ErrUdpAccelInvalidPacket = errors.New("invalid udp acceleration packet")
+	// ErrUdpAccelTooLarge the frame does not fit in a datagram
+	ErrUdpAccelTooLarge = errors.New("frame too large for udp acceleration")
+)
+
 // UdpAccel udp acceleration structure
 type UdpAccel struct {
+	Version uint32 // Protocol version, 1 or 2 once negotiated
+
+	MyIp    net.IP // Local address the udp socket is bound to
+	MyPort  uint32 // Local port
+	MyKey   [UDP_ACCELERATION_COMMON_KEY_SIZE_V1]byte
+	MyKeyV2 [UDP_ACCELERATION_COMMON_KEY_SIZE_V2]byte
+
+	YourIp    net.IP // Peer address
+	YourPort  uint32 // Peer port
+	YourKey   [UDP_ACCELERATION_COMMON_KEY_SIZE_V1]byte
+	YourKeyV2 [UDP_ACCELERATION_COMMON_KEY_SIZE_V2]byte
+
+	MyCookie   uint32 // Cookie the peer puts in its packets
+	YourCookie uint32 // Cookie put in our packets
+
+	conn  *net.UDPConn
+	epoch time.Time
+
+	lock             sync.Mutex
+	yourAddr         *net.UDPAddr
+	nextIv           [UDP_ACCELERATION_PACKET_IV_SIZE_V1]byte
+	lastRecvYourTick uint64 // Latest tick of the peer
+	lastRecvMyTick   uint64 // Latest tick of ours the peer echoed back
+	closed           bool
+
+	// V2
+	sendAead cipher.AEAD
+	recvAead cipher.AEAD
+	nextIvV2 [UDP_ACCELERATION_PACKET_IV_SIZE_V2]byte
+	window   udpAccelReplayWindow
+}
+
+// udpAccelReplayWindow refuse V2 datagrams accepted before, the format has no
+// sequence number but every datagram carries a fresh IV and the tick of the
+// peer: the IVs of the latest datagrams are remembered, and once one is
+// forgotten no datagram up to its tick is accepted anymore
+type udpAccelReplayWindow struct {
+	ring  [UDP_ACCELERATION_REPLAY_WINDOW_SIZE]udpAccelSeen
+	seen  map[[UDP_ACCELERATION_PACKET_IV_SIZE_V2]byte]bool
+	next  int
+	floor uint64 // Highest tick of the forgotten datagrams
+}
+
+// udpAccelSeen a datagram remembered by the replay window
+type udpAccelSeen struct {
+	iv   [UDP_ACCELERATION_PACKET_IV_SIZE_V2]byte
+	tick uint64
+}
+
+// NewUdpAccel bind a udp socket on ip with a random port and a fresh key
+func NewUdpAccel(ip net.IP) (*UdpAccel, error) {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: ip})
+	if nil != err {
+		return nil, err
+	}
+
+	a := &UdpAccel{
+		Version: 1,
+		MyIp:    ip,
+		MyPort:  uint32(conn.LocalAddr().(*net.UDPAddr).Port),
+		conn:    conn,
+		epoch:   time.Now(),
+	}
+	if _, err := rand.Read(a.MyKey[:]); nil != err {
+		conn.Close()
+		return nil, err
+	}
+	if _, err := rand.Read(a.MyKeyV2[:]); nil != err {
+		conn.Close()
+		return nil, err
+	}
+	if _, err := rand.Read(a.nextIv[:]); nil != err {
+		conn.Close()
+		return nil, err
+	}
+	if _, err := rand.Read(a.nextIvV2[:]); nil != err {
+		conn.Close()
+		return nil, err
+	}
+
+	return a, nil
+}
+
+// Init set the peer parameters negotiated over tcp, yourKey is the V1 or the
+// V2 key of the peer depending on version
+func (a *UdpAccel) Init(version uint32, yourKey []byte, yourIp net.IP, yourPort uint32, myCookie, yourCookie uint32) error {
+	if nil == yourIp || 0 == yourPort || yourPort > 65535 {
+		return ERR_PROTOCOL_ERROR
+	}
+
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	switch version {
+	case 1:
+		if len(yourKey) != UDP_ACCELERATION_COMMON_KEY_SIZE_V1 {
+			return ERR_PROTOCOL_ERROR
+		}
+		copy(a.YourKey[:], yourKey)
+	case 2:
+		if len(yourKey) != UDP_ACCELERATION_COMMON_KEY_SIZE_V2 {
+			return ERR_PROTOCOL_ERROR
+		}
+		copy(a.YourKeyV2[:], yourKey)
+
+		// ChaCha20-Poly1305 takes the head of the common key
+		var err error
+		if a.sendAead, err = chacha20poly1305.New(a.MyKeyV2[:chacha20poly1305.KeySize]); nil != err {
+			return err
+		}
+		if a.recvAead, err = chacha20poly1305.New(a.YourKeyV2[:chacha20poly1305.KeySize]); nil != err {
+			return err
+		}
+		a.window = udpAccelReplayWindow{}
+	default:
+		return ERR_PROTOCOL_ERROR
+	}
+
+	a.Version = version
+	a.YourIp = yourIp
+	a.YourPort = yourPort
+	a.MyCookie = myCookie
+	a.YourCookie = yourCookie
+	a.yourAddr = &net.UDPAddr{IP: yourIp, Port: int(yourPort)}
+
+	return nil
+}
+
+// Close close the udp socket
+func (a *UdpAccel) Close() {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	if !a.closed {
+		a.closed = true
+		a.conn.Close()
+	}
+}
+
+// now milliseconds since the creation, never 0
+func (a *UdpAccel) now() uint64 {
+	return uint64(time.Since(a.epoch)/time.Millisecond) + 1
+}
+
+// IsSendReady whether the peer echoed our tick recently, that is udp works both ways
+func (a *UdpAccel) IsSendReady() bool {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	if a.closed || nil == a.yourAddr || 0 == a.lastRecvMyTick {
+		return false
+	}
+	return a.now() <= a.lastRecvMyTick+UDP_ACCELERATION_KEEPALIVE_TIMEOUT
+}
+
+// Send send a frame, an empty one is a keep-alive
+func (a *UdpAccel) Send(p adapter.Packet) error {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	if a.closed {
+		return ErrUdpAccelClosed
+	}
+	if nil == a.yourAddr {
+		return ErrUdpAccelNotReady
+	}
+
+	b, err := a.encode(p)
+	if nil != err {
+		return err
+	}
+	_, err = a.conn.WriteToUDP(b, a.yourAddr)
+	return err
+}
+
+// SendKeepAlive send an empty packet so that the peer learns our tick & address
+func (a *UdpAccel) SendKeepAlive() error {
+	return a.Send(nil)
+}
+
+// Recv receive the next frame, keep-alives and invalid datagrams are skipped
+func (a *UdpAccel) Recv() (adapter.Packet, error) {
+	buf := make([]byte, UDP_ACCELERATION_TMP_BUF_SIZE)
+	for {
+		n, from, err := a.conn.ReadFromUDP(buf)
+		if nil != err {
+			return nil, err
+		}
+
+		a.lock.Lock()
+		p, err := a.decode(buf[:n])
+		if nil == err {
+			// follow the peer through NATs
+			a.yourAddr = from
+		}
+		a.lock.Unlock()
+
+		if nil == err && len(p) > 0 {
+			return p, nil
+		}
+	}
+}
+
+// encode build a datagram for the negotiated version
+func (a *UdpAccel) encode(p adapter.Packet) ([]byte, error) {
+	padding := mrand.Intn(UDP_ACCELERATION_MAX_PADDING_SIZE)
+	if 2 == a.Version {
+		return a.encodeV2(p, a.now(), padding)
+	}
+	return a.encodeV1(p, a.now(), padding)
+}
+
+// decode check & decrypt a datagram, the ticks are updated for a valid one
+func (a *UdpAccel) decode(b []byte) (adapter.Packet, error) {
+	if 2 == a.Version {
+		return a.decodeV2(b)
+	}
+	return a.decodeV1(b)
+}
+
+// encodeV1 build a V1 datagram:
+//
+//	IV | RC4(SHA1(MyKey | IV)) { header | data | padding | zero verify }
+//
+// the encrypted verify field becomes the IV of the next datagram
+func (a *UdpAccel) encodeV1(p adapter.Packet, tick uint64, padding int) ([]byte, error) {
+	if len(p) > UDP_ACCELERATION_TMP_BUF_SIZE-UDP_ACCELERATION_PACKET_IV_SIZE_V1*2-udpAccelHeaderSize-UDP_ACCELERATION_MAX_PADDING_SIZE {
+		return nil, ErrUdpAccelTooLarge
+	}
+
+	size := UDP_ACCELERATION_PACKET_IV_SIZE_V1 + udpAccelHeaderSize + len(p) + padding + UDP_ACCELERATION_PACKET_IV_SIZE_V1
+	b := make([]byte, size)
+
+	iv := b[:UDP_ACCELERATION_PACKET_IV_SIZE_V1]
+	copy(iv, a.nextIv[:])
+
+	body := b[UDP_ACCELERATION_PACKET_IV_SIZE_V1:]
+	a.putHeader(body, p, tick)
+	// padding and verify are left zero
+
+	c, err := rc4.NewCipher(udpAccelCalcKey(a.MyKey[:], iv))
+	if nil != err {
+		return nil, err
+	}
+	c.XORKeyStream(body, body)
+
+	copy(a.nextIv[:], b[size-UDP_ACCELERATION_PACKET_IV_SIZE_V1:])
+	return b, nil
+}
+
+// decodeV1 check & decrypt a V1 datagram
+func (a *UdpAccel) decodeV1(b []byte) (adapter.Packet, error) {
+	if len(b) < UDP_ACCELERATION_PACKET_IV_SIZE_V1+udpAccelHeaderSize+UDP_ACCELERATION_PACKET_IV_SIZE_V1 {
+		return nil, ErrUdpAccelInvalidPacket
+	}
+
+	iv := b[:UDP_ACCELERATION_PACKET_IV_SIZE_V1]
+	body := make([]byte, len(b)-UDP_ACCELERATION_PACKET_IV_SIZE_V1)
+	c, err := rc4.NewCipher(udpAccelCalcKey(a.YourKey[:], iv))
+	if nil != err {
+		return nil, err
+	}
+	c.XORKeyStream(body, b[UDP_ACCELERATION_PACKET_IV_SIZE_V1:])
+
+	verify := body[len(body)-UDP_ACCELERATION_PACKET_IV_SIZE_V1:]
+	for _, x := range verify {
+		if 0 != x {
+			return nil, ErrUdpAccelInvalidPacket
+		}
+	}
+
+	return a.parseHeader(body[:len(body)-len(verify)])
+}
+
+// encodeV2 build a V2 datagram as SoftEther's UdpAccelSend:
+//
+//	IV | ChaCha20-Poly1305(MyKeyV2, IV) { header | data | padding } | MAC
+//
+// the first IV is random, the last bytes of each datagram become the IV of
+// the next one
+func (a *UdpAccel) encodeV2(p adapter.Packet, tick uint64, padding int) ([]byte, error) {
+	if nil == a.sendAead {
+		return nil, ErrUdpAccelNotReady
+	}
+	if len(p) > UDP_ACCELERATION_TMP_BUF_SIZE-UDP_ACCELERATION_PACKET_IV_SIZE_V2-udpAccelHeaderSize-UDP_ACCELERATION_MAX_PADDING_SIZE-UDP_ACCELERATION_PACKET_MAC_SIZE_V2 {
+		return nil, ErrUdpAccelTooLarge
+	}
+
+	b := make([]byte, UDP_ACCELERATION_PACKET_IV_SIZE_V2+udpAccelHeaderSize+len(p)+padding, UDP_ACCELERATION_TMP_BUF_SIZE)
+
+	iv := b[:UDP_ACCELERATION_PACKET_IV_SIZE_V2]
+	copy(iv, a.nextIvV2[:])
+
+	body := b[UDP_ACCELERATION_PACKET_IV_SIZE_V2:]
+	a.putHeader(body, p, tick)
+	// padding is left zero
+
+	b = a.sendAead.Seal(b[:len(iv)], iv, body, nil)
+	copy(a.nextIvV2[:], b[len(b)-UDP_ACCELERATION_PACKET_IV_SIZE_V2:])
+	return b, nil
+}
+
+// decodeV2 check & decrypt a V2 datagram, whatever its IV
+func (a *UdpAccel) decodeV2(b []byte) (adapter.Packet, error) {
+	if nil == a.recvAead {
+		return nil, ErrUdpAccelNotReady
+	}
+	if len(b) < UDP_ACCELERATION_PACKET_IV_SIZE_V2+udpAccelHeaderSize+UDP_ACCELERATION_PACKET_MAC_SIZE_V2 {
+		return nil, ErrUdpAccelInvalidPacket
+	}
+
+	var iv [UDP_ACCELERATION_PACKET_IV_SIZE_V2]byte
+	copy(iv[:], b)
+	body, err := a.recvAead.Open(nil, iv[:], b[len(iv):], nil)
+	if nil != err {
+		return nil, ErrUdpAccelInvalidPacket
+	}
+
+	tick := binary.BigEndian.Uint64(body[4:])
+	if !a.window.check(iv, tick) {
+		return nil, ErrUdpAccelInvalidPacket
+	}
+	p, err := a.parseHeader(body)
+	if nil != err {
+		return nil, err
+	}
+	// only an authentic datagram moves the window
+	a.window.update(iv, tick)
+	return p, nil
+}
+
+// putHeader fill the common header and the data of a plain datagram body
+func (a *UdpAccel) putHeader(body []byte, p adapter.Packet, tick uint64) {
+	binary.BigEndian.PutUint32(body[0:], a.YourCookie)
+	binary.BigEndian.PutUint64(body[4:], tick)
+	binary.BigEndian.PutUint64(body[12:], a.lastRecvYourTick)
+	binary.BigEndian.PutUint16(body[20:], uint16(len(p)))
+	body[22] = 0 // not compressed
+	copy(body[udpAccelHeaderSize:], p)
+}
+
+// parseHeader check the common header of a decrypted body, header | data | padding
+func (a *UdpAccel) parseHeader(body []byte) (adapter.Packet, error) {
+	if len(body) < udpAccelHeaderSize {
+		return nil, ErrUdpAccelInvalidPacket
+	}
+
+	cookie := binary.BigEndian.Uint32(body[0:])
+	yourTick := binary.BigEndian.Uint64(body[4:])
+	myTick := binary.BigEndian.Uint64(body[12:])
+	size := int(binary.BigEndian.Uint16(body[20:]))
+	flag := body[22]
+
+	if cookie != a.MyCookie {
+		return nil, ErrUdpAccelInvalidPacket
+	}
+	if udpAccelHeaderSize+size > len(body) {
+		return nil, ErrUdpAccelInvalidPacket
+	}
+
+	// too old
+	if yourTick < a.lastRecvYourTick && a.lastRecvYourTick-yourTick >= UDP_ACCELERATION_WINDOW_SIZE_MSEC {
+		return nil, ErrUdpAccelInvalidPacket
+	}
+
+	data := body[udpAccelHeaderSize : udpAccelHeaderSize+size]
+	var p adapter.Packet
+	if 0 != flag {
+		// compressed by a peer using compression
+		var err error
+		if p, err = udpAccelUncompress(data); nil != err {
+			return nil, ErrUdpAccelInvalidPacket
+		}
+	} else {
+		p = make(adapter.Packet, size)
+		copy(p, data)
+	}
+
+	if yourTick > a.lastRecvYourTick {
+		a.lastRecvYourTick = yourTick
+	}
+	if myTick > a.lastRecvMyTick && myTick <= a.now() {
+		a.lastRecvMyTick = myTick
+	}
+	return p, nil
+}
+
+// udpAccelUncompress inflate the zlib stream of a compressed datagram, as
+// SoftEther's Uncompress, up to UDP_ACCELERATION_TMP_BUF_SIZE bytes
+func udpAccelUncompress(data []byte) (adapter.Packet, error) {
+	r, err := zlib.NewReader(bytes.NewReader(data))
+	if nil != err {
+		return nil, err
+	}
+	defer r.Close()
+	p, err := ioutil.ReadAll(io.LimitReader(r, UDP_ACCELERATION_TMP_BUF_SIZE+1))
+	if nil != err {
+		return nil, err
+	} else if len(p) > UDP_ACCELERATION_TMP_BUF_SIZE {
+		return nil, ErrUdpAccelTooLarge
+	}
+	return p, nil
+}
+
+// udpAccelCalcKey packet key, SHA1(common key | IV)
+func udpAccelCalcKey(commonKey, iv []byte) []byte {
+	h := sha1.New()
+	h.Write(commonKey)
+	h.Write(iv)
+	return h.Sum(nil)
+}
+
+// udpAccelKeepAliveInterval random interval between keep-alives
+func udpAccelKeepAliveInterval() time.Duration {
+	ms := UDP_ACCELERATION_KEEPALIVE_INTERVAL_MIN + mrand.Intn(UDP_ACCELERATION_KEEPALIVE_INTERVAL_MAX-UDP_ACCELERATION_KEEPALIVE_INTERVAL_MIN)
+	return time.Duration(ms) * time.Millisecond
+}
+
+// check whether the datagram of iv sent at tick is new and inside the window
+func (w *udpAccelReplayWindow) check(iv [UDP_ACCELERATION_PACKET_IV_SIZE_V2]byte, tick uint64) bool {
+	return tick > w.floor && !w.seen[iv]
+}
+
+// update remember the datagram, the oldest one is forgotten once full and its
+// tick raises the floor
+func (w *udpAccelReplayWindow) update(iv [UDP_ACCELERATION_PACKET_IV_SIZE_V2]byte, tick uint64) {
+	if nil == w.seen {
+		w.seen = make(map[[UDP_ACCELERATION_PACKET_IV_SIZE_V2]byte]bool, UDP_ACCELERATION_REPLAY_WINDOW_SIZE)
+	}
+	if len(w.seen) >= UDP_ACCELERATION_REPLAY_WINDOW_SIZE {
+		old := w.ring[w.next]
+		delete(w.seen, old.iv)
+		if old.tick > w.floor {
+			w.floor = old.tick
+		}
+	}
+	w.ring[w.next] = udpAccelSeen{iv, tick}
+	w.seen[iv] = true
+	w.next = (w.next + 1) % UDP_ACCELERATION_REPLAY_WINDOW_SIZE
 }
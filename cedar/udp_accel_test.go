@@ -0,0 +1,429 @@
+package cedar
+
+import (
+	"bytes"
+	"compress/zlib"
+	"crypto/rc4"
+	"crypto/sha1"
+	"encoding/binary"
+	"go-softether/adapter"
+	"net"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+// the datagrams below are laid out by hand after SoftEther's UdpAccelSend,
+// the sender keys count up from 0 and the sender is at tick 1000 having last
+// heard the receiver at tick 500
+const (
+	testUdpAccelCookie   = 0x11223344
+	testUdpAccelTick     = 1000
+	testUdpAccelYourTick = 500
+)
+
+func testUdpAccelKeys() ([]byte, []byte) {
+	key := make([]byte, UDP_ACCELERATION_COMMON_KEY_SIZE_V2)
+	for i := range key {
+		key[i] = byte(i)
+	}
+	return key[:UDP_ACCELERATION_COMMON_KEY_SIZE_V1], key
+}
+
+// testUdpAccelPlain cookie | my tick | your tick | size | flag | data | padding
+func testUdpAccelPlain(data []byte, flag byte, padding int) []byte {
+	b := make([]byte, 23+len(data)+padding)
+	binary.BigEndian.PutUint32(b[0:], testUdpAccelCookie)
+	binary.BigEndian.PutUint64(b[4:], testUdpAccelTick)
+	binary.BigEndian.PutUint64(b[12:], testUdpAccelYourTick)
+	binary.BigEndian.PutUint16(b[20:], uint16(len(data)))
+	b[22] = flag
+	copy(b[23:], data)
+	return b
+}
+
+// testUdpAccelV1 IV | RC4(SHA1(key | IV)) { plain | 20 zero bytes }
+func testUdpAccelV1(t *testing.T, iv, plain []byte) []byte {
+	key, _ := testUdpAccelKeys()
+	h := sha1.Sum(append(append([]byte{}, key...), iv...))
+	c, err := rc4.NewCipher(h[:])
+	if nil != err {
+		t.Fatal(err)
+	}
+	body := append(append([]byte{}, plain...), make([]byte, 20)...)
+	c.XORKeyStream(body, body)
+	return append(append([]byte{}, iv...), body...)
+}
+
+// testUdpAccelV2 IV | ChaCha20-Poly1305(key[:32], IV) { plain } | MAC
+func testUdpAccelV2(t *testing.T, iv, plain []byte) []byte {
+	_, key := testUdpAccelKeys()
+	aead, err := chacha20poly1305.New(key[:32])
+	if nil != err {
+		t.Fatal(err)
+	}
+	return aead.Seal(append([]byte{}, iv...), iv, plain, nil)
+}
+
+func testUdpAccelIv(size int, seed byte) []byte {
+	iv := make([]byte, size)
+	for i := range iv {
+		iv[i] = seed + byte(i)*37
+	}
+	return iv
+}
+
+// newTestUdpAccelSender a sender with the keys of the vectors, no socket needed
+func newTestUdpAccelSender(t *testing.T, version uint32) *UdpAccel {
+	key, keyV2 := testUdpAccelKeys()
+	a := &UdpAccel{epoch: time.Now()}
+	copy(a.MyKey[:], key)
+	copy(a.MyKeyV2[:], keyV2)
+	copy(a.nextIv[:], testUdpAccelIv(UDP_ACCELERATION_PACKET_IV_SIZE_V1, 0xa0))
+	copy(a.nextIvV2[:], testUdpAccelIv(UDP_ACCELERATION_PACKET_IV_SIZE_V2, 0xc3))
+
+	peer := keyV2
+	if 1 == version {
+		peer = key
+	}
+	if err := a.Init(version, peer, net.IPv4(127, 0, 0, 1), 1, 0, testUdpAccelCookie); nil != err {
+		t.Fatal(err)
+	}
+	a.lastRecvYourTick = testUdpAccelYourTick
+	return a
+}
+
+// newTestUdpAccelReceiver the receiving side of the vectors, it has been up
+// long enough for the ticks of the vectors to be in the past
+func newTestUdpAccelReceiver(t *testing.T, version uint32) *UdpAccel {
+	key, keyV2 := testUdpAccelKeys()
+	a := &UdpAccel{epoch: time.Now().Add(-time.Hour)}
+	if 2 == version {
+		key = keyV2
+	}
+	if err := a.Init(version, key, net.IPv4(127, 0, 0, 1), 1, testUdpAccelCookie, 0); nil != err {
+		t.Fatal(err)
+	}
+	return a
+}
+
+func TestUdpAccelDecodeVectors(t *testing.T) {
+	compressed := &bytes.Buffer{}
+	w := zlib.NewWriter(compressed)
+	w.Write(bytes.Repeat([]byte("frame"), 100))
+	w.Close()
+
+	tests := []struct {
+		name     string
+		version  uint32
+		datagram []byte
+		data     string
+	}{
+		{"v1", 1, testUdpAccelV1(t, testUdpAccelIv(20, 0xa0), testUdpAccelPlain([]byte("hello"), 0, 3)), "hello"},
+		{"v2", 2, testUdpAccelV2(t, testUdpAccelIv(12, 0xc3), testUdpAccelPlain([]byte("hello"), 0, 0)), "hello"},
+		{"v2 padded", 2, testUdpAccelV2(t, testUdpAccelIv(12, 0x01), testUdpAccelPlain([]byte("hello"), 0, 17)), "hello"},
+		{"v2 zero iv", 2, testUdpAccelV2(t, make([]byte, 12), testUdpAccelPlain([]byte("hello"), 0, 0)), "hello"},
+		{"v2 keep-alive", 2, testUdpAccelV2(t, testUdpAccelIv(12, 0x7f), testUdpAccelPlain(nil, 0, 0)), ""},
+		{"v1 compressed", 1, testUdpAccelV1(t, testUdpAccelIv(20, 0xa0), testUdpAccelPlain(compressed.Bytes(), 1, 0)), strings.Repeat("frame", 100)},
+		{"v2 compressed", 2, testUdpAccelV2(t, testUdpAccelIv(12, 0xc3), testUdpAccelPlain(compressed.Bytes(), 1, 0)), strings.Repeat("frame", 100)},
+	}
+	for _, v := range tests {
+		a := newTestUdpAccelReceiver(t, v.version)
+		if p, err := a.decode(v.datagram); nil != err {
+			t.Fatal(v.name, err)
+		} else if string(p) != v.data {
+			t.Errorf("%s: unexpected frame %q", v.name, p)
+		}
+		if a.lastRecvYourTick != testUdpAccelTick || a.lastRecvMyTick != testUdpAccelYourTick {
+			t.Errorf("%s: ticks not updated, %d %d", v.name, a.lastRecvYourTick, a.lastRecvMyTick)
+		}
+	}
+
+	// the IV of a datagram is the tail of the previous one
+	a := newTestUdpAccelReceiver(t, 2)
+	iv := testUdpAccelIv(12, 0xc3)
+	for _, data := range []string{"one", "two", "three"} {
+		b := testUdpAccelV2(t, iv, testUdpAccelPlain([]byte(data), 0, 0))
+		if p, err := a.decode(b); nil != err || data != string(p) {
+			t.Fatal(data, p, err)
+		}
+		iv = b[len(b)-12:]
+	}
+}
+
+func TestUdpAccelEncode(t *testing.T) {
+	// v1, decrypted by hand
+	a := newTestUdpAccelSender(t, 1)
+	iv := append([]byte{}, a.nextIv[:]...)
+	b, err := a.encodeV1(adapter.Packet("hello"), testUdpAccelTick, 3)
+	if nil != err {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(testUdpAccelV1(t, iv, testUdpAccelPlain([]byte("hello"), 0, 3)), b) {
+		t.Errorf("v1: unexpected datagram %x", b)
+	}
+	if !bytes.Equal(b[len(b)-20:], a.nextIv[:]) {
+		t.Error("v1: next IV not chained")
+	}
+
+	// v2, opened by hand
+	a = newTestUdpAccelSender(t, 2)
+	for i := 0; i < 3; i++ {
+		iv := append([]byte{}, a.nextIvV2[:]...)
+		b, err := a.encodeV2(adapter.Packet("hello"), testUdpAccelTick, i)
+		if nil != err {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(testUdpAccelV2(t, iv, testUdpAccelPlain([]byte("hello"), 0, i)), b) {
+			t.Errorf("v2: unexpected datagram %x", b)
+		}
+		if !bytes.Equal(b[len(b)-12:], a.nextIvV2[:]) {
+			t.Error("v2: next IV not chained")
+		}
+	}
+}
+
+func TestUdpAccelDecodeInvalid(t *testing.T) {
+	valid := func(version uint32) []byte {
+		if 1 == version {
+			return testUdpAccelV1(t, testUdpAccelIv(20, 0xa0), testUdpAccelPlain([]byte("hello"), 0, 3))
+		}
+		return testUdpAccelV2(t, testUdpAccelIv(12, 0xc3), testUdpAccelPlain([]byte("hello"), 0, 3))
+	}
+
+	tests := []struct {
+		name    string
+		version uint32
+		mangle  func(a *UdpAccel, b []byte) []byte
+	}{
+		// V1 has no MAC, only the structure of the body is checked
+		{"v1 flipped size", 1, func(a *UdpAccel, b []byte) []byte { b[40] ^= 1; return b }},
+		{"v1 flipped verify", 1, func(a *UdpAccel, b []byte) []byte { b[len(b)-1] ^= 1; return b }},
+		{"v1 truncated", 1, func(a *UdpAccel, b []byte) []byte { return b[:40] }},
+		{"v1 wrong cookie", 1, func(a *UdpAccel, b []byte) []byte { a.MyCookie++; return b }},
+		{"v1 wrong key", 1, func(a *UdpAccel, b []byte) []byte { a.YourKey[0]++; return b }},
+		{"v1 bad compression", 1, func(a *UdpAccel, b []byte) []byte {
+			return testUdpAccelV1(t, testUdpAccelIv(20, 0xa0), testUdpAccelPlain([]byte("hello"), 1, 0))
+		}},
+		{"v2 flipped data", 2, func(a *UdpAccel, b []byte) []byte { b[20] ^= 1; return b }},
+		{"v2 flipped mac", 2, func(a *UdpAccel, b []byte) []byte { b[len(b)-1] ^= 1; return b }},
+		{"v2 flipped iv", 2, func(a *UdpAccel, b []byte) []byte { b[0] ^= 2; return b }},
+		{"v2 truncated", 2, func(a *UdpAccel, b []byte) []byte { return b[:len(b)-1] }},
+		{"v2 too short", 2, func(a *UdpAccel, b []byte) []byte { return b[:12] }},
+		{"v2 wrong cookie", 2, func(a *UdpAccel, b []byte) []byte { a.MyCookie++; return b }},
+		{"v2 read as v1", 1, func(a *UdpAccel, b []byte) []byte { return valid(2) }},
+		{"v2 replayed", 2, func(a *UdpAccel, b []byte) []byte {
+			if _, err := a.decode(b); nil != err {
+				t.Fatal(err)
+			}
+			return b
+		}},
+		{"v2 behind the replay window", 2, func(a *UdpAccel, b []byte) []byte {
+			a.window.floor = testUdpAccelTick
+			return b
+		}},
+		{"v2 out of the tick window", 2, func(a *UdpAccel, b []byte) []byte {
+			a.lastRecvYourTick = testUdpAccelTick + UDP_ACCELERATION_WINDOW_SIZE_MSEC
+			return b
+		}},
+		{"v2 compression bomb", 2, func(a *UdpAccel, b []byte) []byte {
+			compressed := &bytes.Buffer{}
+			w := zlib.NewWriter(compressed)
+			w.Write(make([]byte, UDP_ACCELERATION_TMP_BUF_SIZE+1))
+			w.Close()
+			return testUdpAccelV2(t, testUdpAccelIv(12, 0xc3), testUdpAccelPlain(compressed.Bytes(), 1, 0))
+		}},
+	}
+
+	for _, tt := range tests {
+		a := newTestUdpAccelReceiver(t, tt.version)
+		b := tt.mangle(a, valid(tt.version))
+		if _, err := a.decode(b); err != ErrUdpAccelInvalidPacket {
+			t.Errorf("%s: got %v", tt.name, err)
+		}
+	}
+
+	// the tick window lets late datagrams in
+	a := newTestUdpAccelReceiver(t, 2)
+	a.lastRecvYourTick = testUdpAccelTick + UDP_ACCELERATION_WINDOW_SIZE_MSEC - 1
+	if _, err := a.decode(valid(2)); nil != err {
+		t.Error("late datagram refused", err)
+	}
+}
+
+func TestUdpAccelReplayWindow(t *testing.T) {
+	var w udpAccelReplayWindow
+	iv := func(i int) (iv [UDP_ACCELERATION_PACKET_IV_SIZE_V2]byte) {
+		binary.BigEndian.PutUint32(iv[:], uint32(i))
+		return iv
+	}
+	// several datagrams within a millisecond
+	tick := func(i int) uint64 {
+		return 10 + uint64(i/4)
+	}
+
+	const n = UDP_ACCELERATION_REPLAY_WINDOW_SIZE + 8
+	for i := 0; i < n; i++ {
+		if !w.check(iv(i), tick(i)) {
+			t.Fatal("refused", i)
+		}
+		w.update(iv(i), tick(i))
+	}
+
+	// remembered or behind the floor, none of them comes back
+	for i := 0; i < n; i++ {
+		if w.check(iv(i), tick(i)) {
+			t.Error("replayed", i)
+		}
+	}
+	if UDP_ACCELERATION_REPLAY_WINDOW_SIZE != len(w.seen) || tick(7) != w.floor {
+		t.Error("window", len(w.seen), w.floor)
+	}
+
+	// new datagrams, late ones included, as long as they are above the floor
+	if !w.check(iv(n), tick(n-1)) || !w.check(iv(n), w.floor+1) {
+		t.Error("new datagram refused")
+	}
+	if w.check(iv(n), w.floor) {
+		t.Error("datagram behind the window accepted")
+	}
+}
+
+func TestUdpAccelRoundTrip(t *testing.T) {
+	for _, version := range []uint32{1, 2} {
+		client, err := NewUdpAccel(net.IPv4(127, 0, 0, 1))
+		if nil != err {
+			t.Fatal(err)
+		}
+		defer client.Close()
+		server, err := NewUdpAccel(net.IPv4(127, 0, 0, 1))
+		if nil != err {
+			t.Fatal(err)
+		}
+		defer server.Close()
+
+		serverKey, clientKey := server.MyKey[:], client.MyKey[:]
+		if 2 == version {
+			serverKey, clientKey = server.MyKeyV2[:], client.MyKeyV2[:]
+		}
+		client.Init(version, serverKey, server.MyIp, server.MyPort, 1, 2)
+		server.Init(version, clientKey, client.MyIp, client.MyPort, 2, 1)
+
+		frame := adapter.Packet{1, 2, 3, 4, 5}
+		for i := 0; i < 3; i++ {
+			b, err := client.encode(frame)
+			if nil != err {
+				t.Fatal(err)
+			}
+			if p, err := server.decode(b); nil != err {
+				t.Fatal(version, err)
+			} else if !bytes.Equal(p, frame) {
+				t.Error("unexpected frame", p)
+			}
+		}
+
+		// only the peer key opens a datagram
+		b, _ := client.encode(frame)
+		if _, err := client.decode(b); err != ErrUdpAccelInvalidPacket {
+			t.Error(version, "datagram accepted with the wrong key")
+		}
+
+		big := make(adapter.Packet, UDP_ACCELERATION_TMP_BUF_SIZE)
+		if _, err := client.encode(big); err != ErrUdpAccelTooLarge {
+			t.Error(version, "oversized frame accepted")
+		}
+	}
+}
+
+func TestSessionUdpAccel(t *testing.T) {
+	for _, version := range []uint32{1, 2} {
+		testSessionUdpAccel(t, version)
+	}
+}
+
+func testSessionUdpAccel(t *testing.T, version uint32) {
+	ts := newTestServer(t)
+	defer ts.close()
+	ts.udp = true
+	ts.udpVersion = version
+
+	conn := newTestConnection(ts.port())
+	if err := conn.ClientConnect(); nil != err {
+		t.Fatal(err)
+	}
+	ua := conn.Session.udpAccel()
+	if nil == ua {
+		t.Fatal("udp acceleration is not granted")
+	}
+	if ua.Version != version {
+		t.Fatal("negotiated version", ua.Version)
+	}
+
+	a, err := conn.Session.Main()
+	if nil != err {
+		t.Fatal(err)
+	}
+	defer a.Destroy()
+	packets := readPackets(a)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for !ua.IsSendReady() {
+		if time.Now().After(deadline) {
+			t.Fatal("udp is not ready")
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	const n = 16
+	for i := 0; i < n; i++ {
+		a.Write([]adapter.Packet{{byte(i)}})
+		select {
+		case ps := <-packets:
+			if len(ps) != 1 || ps[0][0] != byte(i) {
+				t.Error("unexpected echo", ps)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatal("no echo")
+		}
+	}
+
+	if frames := atomic.LoadInt32(&ts.udpFrames); frames != n {
+		t.Error("frames over udp:", frames)
+	}
+}
+
+func TestSessionUdpAccelFallback(t *testing.T) {
+	ts := newTestServer(t)
+	defer ts.close()
+	ts.udp = true
+	ts.udpDrop = true
+
+	conn := newTestConnection(ts.port())
+	if err := conn.ClientConnect(); nil != err {
+		t.Fatal(err)
+	}
+
+	a, err := conn.Session.Main()
+	if nil != err {
+		t.Fatal(err)
+	}
+	defer a.Destroy()
+	packets := readPackets(a)
+
+	// udp is unreachable, tcp carries everything
+	a.Write([]adapter.Packet{{42}})
+	select {
+	case ps := <-packets:
+		if len(ps) != 1 || ps[0][0] != 42 {
+			t.Error("unexpected echo", ps)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("no echo")
+	}
+	if ua := conn.Session.udpAccel(); nil == ua || ua.IsSendReady() {
+		t.Error("unreachable udp is considered ready")
+	}
+}
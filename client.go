@@ -0,0 +1,313 @@
+package softether
+
+import (
+	"context"
+	"crypto"
+	"crypto/x509"
+	"errors"
+	"go-softether/adapter"
+	"go-softether/cedar"
+	"go-softether/mayaqua"
+	"strings"
+	"sync"
+)
+
+var (
+	// ErrAlreadyConnected Connect on a client which is not idle
+	ErrAlreadyConnected = errors.New("ErrAlreadyConnected")
+	// ErrBadHashedPassword the hashed password is not a SHA-1 sum
+	ErrBadHashedPassword = errors.New("ErrBadHashedPassword")
+)
+
+// ClientStatus status of a client, as SoftEther's
+type ClientStatus uint32
+
+const (
+	CLIENT_STATUS_CONNECTING  ClientStatus = 0 // Connecting
+	CLIENT_STATUS_ESTABLISHED ClientStatus = 3 // Connection complete
+	CLIENT_STATUS_RETRY       ClientStatus = 4 // Wait to retry
+	CLIENT_STATUS_IDLE        ClientStatus = 5 // Idle state
+)
+
+func (s ClientStatus) String() string {
+	switch s {
+	case CLIENT_STATUS_CONNECTING:
+		return "connecting"
+	case CLIENT_STATUS_ESTABLISHED:
+		return "established"
+	case CLIENT_STATUS_RETRY:
+		return "retry"
+	case CLIENT_STATUS_IDLE:
+		return "idle"
+	}
+	return "unknown"
+}
+
+// Config configuration of a client, the authentication is chosen by the
+// credentials given: certificate, plain password, password or anonymous
+type Config struct {
+	Host               string
+	Port               int
+	HubName            string
+	InsecureSkipVerify bool // skip certificate and other checks
+
+	ServerCertFingerprints [][]byte         // SHA-1 or SHA-256 fingerprints of trusted server certificates
+	RootCAs                *x509.CertPool   // Authorities issuing the server certificate
+	KnownHosts             cedar.KnownHosts // Server certificates trusted on first use
+
+	Username       string
+	Password       string            // Password, hashed with the username before leaving
+	HashedPassword []byte            // Password already hashed, as cmd/genpwdhash prints
+	PlainPassword  string            // Password sent in clear to hubs using RADIUS or NT domain
+	ClientCert     *x509.Certificate // Client certificate
+	ClientKey      crypto.Signer     // Private key of the client certificate
+
+	ClientStr string // Client name, CEDAR_CLIENT_STR if empty
+
+	MaxConnection     uint32 // Number of tcp streams, 1 if 0
+	HalfConnection    bool
+	NoUdpAcceleration bool
+	NumRetry          uint32 // Number of reconnect attempts, mayaqua.INFINITE for unlimited
+	RetryInterval     uint32 // Initial reconnect interval (in seconds), cedar.RETRY_INTERVAL_DEFAULT if 0
+
+	PackLimits mayaqua.PackDecoderOptions // Limits of the packs received from the server
+
+	ProxyType      cedar.ProxyType
+	ProxyHost      string
+	ProxyPort      int
+	ProxyUsername  string
+	ProxyPassword  string
+	ProxyUserAgent string
+
+	// callbacks, run from the goroutine of the client or of the session
+	OnStatus     func(status ClientStatus, cause error) // cause of the retry or of the disconnection
+	OnDisconnect func(err error)                        // the session is over for good
+}
+
+// Client a VPN client owning its connection and session
+type Client struct {
+	config Config
+
+	lock   sync.Mutex
+	status ClientStatus
+	frames adapter.Adapter
+	err    error
+	idle   chan struct{} // closed when the session is over and the client idle
+
+	cancel     context.CancelFunc // abort the login of Connect
+	connecting chan struct{}      // closed when Connect returns
+}
+
+// NewClient new idle client
+func NewClient(config Config) *Client {
+	return &Client{
+		config: config,
+		status: CLIENT_STATUS_IDLE,
+	}
+}
+
+// clientConfig the config of cedar.Dial
+func (c *Client) clientConfig() (cedar.ClientConfig, error) {
+	cfg := c.config
+	dc := cedar.ClientConfig{
+		Host:               cfg.Host,
+		Port:               cfg.Port,
+		InsecureSkipVerify: cfg.InsecureSkipVerify,
+		ClientStr:          cfg.ClientStr,
+		ClientVer:          CEDAR_VER,
+		ClientBuild:        CEDAR_BUILD,
+		PackLimits:         cfg.PackLimits,
+
+		ServerCertFingerprints: cfg.ServerCertFingerprints,
+		RootCAs:                cfg.RootCAs,
+		KnownHosts:             cfg.KnownHosts,
+
+		ProxyType:      cfg.ProxyType,
+		ProxyHost:      cfg.ProxyHost,
+		ProxyPort:      cfg.ProxyPort,
+		ProxyUsername:  cfg.ProxyUsername,
+		ProxyPassword:  cfg.ProxyPassword,
+		ProxyUserAgent: cfg.ProxyUserAgent,
+	}
+	if "" == dc.ClientStr {
+		dc.ClientStr = CEDAR_CLIENT_STR
+	}
+
+	a := &dc.Auth
+	a.Username = cfg.Username
+	switch {
+	case nil != cfg.ClientCert || nil != cfg.ClientKey:
+		// a partial pair is a mistake, not a request for another auth type
+		if !mayaqua.CheckXandK(cfg.ClientCert, cfg.ClientKey) {
+			return dc, cedar.ErrClientCertMismatch
+		}
+		a.AuthType = cedar.CLIENT_AUTHTYPE_CERT
+		a.ClientX = cfg.ClientCert
+		a.ClientK = cfg.ClientKey
+	case "" != cfg.PlainPassword:
+		a.AuthType = cedar.CLIENT_AUTHTYPE_PLAIN_PASSWORD
+		a.PlainPassword = cfg.PlainPassword
+	case "" != cfg.Password:
+		a.AuthType = cedar.CLIENT_AUTHTYPE_PASSWORD
+		a.HashedPassword = mayaqua.Sha0([]byte(cfg.Password + strings.ToUpper(cfg.Username)))
+	case nil != cfg.HashedPassword:
+		if int(mayaqua.SHA1_SIZE) != len(cfg.HashedPassword) {
+			return dc, ErrBadHashedPassword
+		}
+		a.AuthType = cedar.CLIENT_AUTHTYPE_PASSWORD
+		copy(a.HashedPassword[:], cfg.HashedPassword)
+	default:
+		a.AuthType = cedar.CLIENT_AUTHTYPE_ANONYMOUS
+	}
+
+	o := &dc.Option
+	o.HubName = cfg.HubName
+	o.MaxConnection = cfg.MaxConnection
+	o.HalfConnection = cfg.HalfConnection
+	o.NoUdpAcceleration = cfg.NoUdpAcceleration
+	o.NumRetry = cfg.NumRetry
+	o.RetryInterval = cfg.RetryInterval
+
+	return dc, nil
+}
+
+// Connect log in to the hub and start tunneling, ctx bounds the login only,
+// the session then reconnects on its own as configured until Disconnect
+func (c *Client) Connect(ctx context.Context) error {
+	c.lock.Lock()
+	if CLIENT_STATUS_IDLE != c.status {
+		c.lock.Unlock()
+		return ErrAlreadyConnected
+	}
+	parent := ctx
+	ctx, cancel := context.WithCancel(parent)
+	connecting := make(chan struct{})
+	c.status, c.err = CLIENT_STATUS_CONNECTING, nil
+	c.cancel, c.connecting = cancel, connecting
+	c.lock.Unlock()
+	defer func() {
+		c.lock.Lock()
+		c.cancel, c.connecting = nil, nil
+		c.lock.Unlock()
+		cancel()
+		close(connecting)
+	}()
+	c.notify(CLIENT_STATUS_CONNECTING, nil)
+
+	dc, err := c.clientConfig()
+	if nil != err {
+		c.setIdle(err)
+		return err
+	}
+	session, err := cedar.Dial(ctx, dc)
+	if nil != err {
+		if nil != ctx.Err() && nil == parent.Err() {
+			// cancelled by Disconnect
+			err = cedar.ERR_USER_CANCEL
+		}
+		c.setIdle(err)
+		return err
+	}
+
+	session.OnRetry = func(cause error) {
+		c.setStatus(CLIENT_STATUS_RETRY, cause)
+	}
+	session.OnReconnect = func() {
+		c.setStatus(CLIENT_STATUS_ESTABLISHED, nil)
+	}
+	c.setStatus(CLIENT_STATUS_ESTABLISHED, nil)
+
+	frames, err := session.Main()
+	if nil != err {
+		session.Connection.Disconnect()
+		c.setIdle(err)
+		return err
+	}
+	idle := make(chan struct{})
+	c.lock.Lock()
+	c.frames, c.idle = frames, idle
+	c.lock.Unlock()
+
+	go func() {
+		defer close(idle)
+		<-session.Done()
+		err := session.Err()
+		c.lock.Lock()
+		c.frames = nil
+		c.lock.Unlock()
+		c.setIdle(err)
+		if nil != c.config.OnDisconnect {
+			c.config.OnDisconnect(err)
+		}
+	}()
+	return nil
+}
+
+// Disconnect end the session and wait for the client to be idle, a login in
+// progress is aborted
+func (c *Client) Disconnect() {
+	c.lock.Lock()
+	cancel, connecting := c.cancel, c.connecting
+	c.lock.Unlock()
+
+	if nil != cancel {
+		cancel()
+		<-connecting
+	}
+
+	c.lock.Lock()
+	frames, idle := c.frames, c.idle
+	c.lock.Unlock()
+
+	if nil != frames {
+		frames.Destroy()
+	}
+	if nil != idle {
+		<-idle
+	}
+}
+
+// State status of the client
+func (c *Client) State() ClientStatus {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	return c.status
+}
+
+// Err why the client went idle, nil while connected or never connected
+func (c *Client) Err() error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	return c.err
+}
+
+// Frames the Ethernet frames of the session, nil unless connected, the
+// adapter survives reconnects and fails once the session is over
+func (c *Client) Frames() adapter.Adapter {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	return c.frames
+}
+
+func (c *Client) setStatus(status ClientStatus, cause error) {
+	c.lock.Lock()
+	c.status = status
+	c.lock.Unlock()
+	c.notify(status, cause)
+}
+
+func (c *Client) setIdle(err error) {
+	c.lock.Lock()
+	c.status, c.err = CLIENT_STATUS_IDLE, err
+	c.lock.Unlock()
+	c.notify(CLIENT_STATUS_IDLE, err)
+}
+
+func (c *Client) notify(status ClientStatus, cause error) {
+	if nil != c.config.OnStatus {
+		c.config.OnStatus(status, cause)
+	}
+}
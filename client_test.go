@@ -0,0 +1,282 @@
+package softether
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"go-softether/cedar"
+	"go-softether/mayaqua"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// standInServer a SoftEther server accepting every login and swallowing the
+// tunneled blocks
+func standInServer(t *testing.T) net.Listener {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if nil != err {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if nil != err {
+		t.Fatal(err)
+	}
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+		Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}},
+	})
+	if nil != err {
+		t.Fatal(err)
+	}
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if nil != err {
+				return
+			}
+			go serveStandIn(conn)
+		}
+	}()
+	return ln
+}
+
+func serveStandIn(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+
+	hello := &mayaqua.Pack{}
+	hello.AddStr("hello", "Stand-in")
+	hello.AddData("random", make([]byte, mayaqua.SHA1_SIZE))
+	welcome := &mayaqua.Pack{}
+	welcome.AddStr("session_name", "SID")
+	welcome.AddStr("connection_name", "CID")
+	welcome.AddData("session_key", make([]byte, mayaqua.SHA1_SIZE))
+	welcome.AddBool("use_encrypt", true)
+	welcome.AddInt("max_connection", 1)
+
+	for _, p := range []*mayaqua.Pack{hello, welcome} {
+		if req, err := http.ReadRequest(r); nil != err {
+			return
+		} else if _, err := io.Copy(ioutil.Discard, req.Body); nil != err {
+			return
+		}
+		b, _ := p.ToBuf()
+		res := &http.Response{
+			StatusCode:    http.StatusOK,
+			ProtoMajor:    1,
+			ProtoMinor:    1,
+			Header:        http.Header{"Content-Type": []string{mayaqua.HTTP_CONTENT_TYPE2}},
+			ContentLength: int64(len(b)),
+			Body:          ioutil.NopCloser(bytes.NewReader(b)),
+		}
+		if err := res.Write(conn); nil != err {
+			return
+		}
+	}
+	io.Copy(ioutil.Discard, r)
+}
+
+func TestClientConfig(t *testing.T) {
+	c := NewClient(Config{Username: "user", Password: "pass"})
+	if dc, err := c.clientConfig(); nil != err {
+		t.Fatal(err)
+	} else if cedar.CLIENT_AUTHTYPE_PASSWORD != dc.Auth.AuthType ||
+		mayaqua.Sha0([]byte("pass"+strings.ToUpper("user"))) != dc.Auth.HashedPassword ||
+		CEDAR_CLIENT_STR != dc.ClientStr {
+		t.Error("unexpected config", dc.Auth.AuthType, dc.ClientStr)
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if nil != err {
+		t.Fatal(err)
+	}
+	other, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if nil != err {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{SerialNumber: big.NewInt(1)}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if nil != err {
+		t.Fatal(err)
+	}
+	x, err := x509.ParseCertificate(der)
+	if nil != err {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		config   Config
+		authType cedar.ClientAuthType
+		err      error
+	}{
+		{Config{}, cedar.CLIENT_AUTHTYPE_ANONYMOUS, nil},
+		{Config{HashedPassword: make([]byte, mayaqua.SHA1_SIZE)}, cedar.CLIENT_AUTHTYPE_PASSWORD, nil},
+		{Config{HashedPassword: []byte{1, 2, 3}}, 0, ErrBadHashedPassword},
+		{Config{PlainPassword: "pass", Password: "pass"}, cedar.CLIENT_AUTHTYPE_PLAIN_PASSWORD, nil},
+		{Config{ClientCert: x, ClientKey: key, Password: "pass"}, cedar.CLIENT_AUTHTYPE_CERT, nil},
+		{Config{ClientCert: x, Password: "pass"}, 0, cedar.ErrClientCertMismatch},
+		{Config{ClientKey: key, Password: "pass"}, 0, cedar.ErrClientCertMismatch},
+		{Config{ClientCert: x, ClientKey: other}, 0, cedar.ErrClientCertMismatch},
+	}
+	for i, tt := range tests {
+		dc, err := NewClient(tt.config).clientConfig()
+		if err != tt.err || (nil == err && tt.authType != dc.Auth.AuthType) {
+			t.Error(i, err, dc.Auth.AuthType)
+		}
+	}
+}
+
+func TestClient(t *testing.T) {
+	ln := standInServer(t)
+	defer ln.Close()
+
+	var lock sync.Mutex
+	var statuses []ClientStatus
+	disconnected := make(chan error, 1)
+	c := NewClient(Config{
+		Host:               "127.0.0.1",
+		Port:               ln.Addr().(*net.TCPAddr).Port,
+		HubName:            "DEFAULT",
+		InsecureSkipVerify: true,
+		Username:           "user",
+		Password:           "pass",
+		NoUdpAcceleration:  true,
+		OnStatus: func(status ClientStatus, cause error) {
+			lock.Lock()
+			statuses = append(statuses, status)
+			lock.Unlock()
+		},
+		OnDisconnect: func(err error) {
+			disconnected <- err
+		},
+	})
+
+	if CLIENT_STATUS_IDLE != c.State() || nil != c.Frames() {
+		t.Error("not idle")
+	}
+	if err := c.Connect(context.Background()); nil != err {
+		t.Fatal(err)
+	}
+	if CLIENT_STATUS_ESTABLISHED != c.State() || nil == c.Frames() {
+		t.Error("not established", c.State())
+	}
+	if err := c.Connect(context.Background()); ErrAlreadyConnected != err {
+		t.Error("connected twice", err)
+	}
+
+	c.Disconnect()
+	if CLIENT_STATUS_IDLE != c.State() || nil != c.Frames() || cedar.ERR_USER_CANCEL != c.Err() {
+		t.Error("not disconnected", c.State(), c.Err())
+	}
+	if err := <-disconnected; cedar.ERR_USER_CANCEL != err {
+		t.Error("unexpected disconnection", err)
+	}
+
+	lock.Lock()
+	defer lock.Unlock()
+	if 3 != len(statuses) || CLIENT_STATUS_CONNECTING != statuses[0] || CLIENT_STATUS_ESTABLISHED != statuses[1] || CLIENT_STATUS_IDLE != statuses[2] {
+		t.Error("unexpected statuses", statuses)
+	}
+}
+
+func TestClientConnectError(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if nil != err {
+		t.Fatal(err)
+	}
+	port := ln.Addr().(*net.TCPAddr).Port
+	ln.Close()
+
+	var statuses []ClientStatus
+	c := NewClient(Config{
+		Host: "127.0.0.1",
+		Port: port,
+		OnStatus: func(status ClientStatus, cause error) {
+			statuses = append(statuses, status)
+		},
+	})
+	if err := c.Connect(context.Background()); nil == err {
+		t.Fatal("connected to nothing")
+	} else if err != c.Err() || CLIENT_STATUS_IDLE != c.State() {
+		t.Error("not idle", c.State(), c.Err())
+	}
+	if 2 != len(statuses) || CLIENT_STATUS_IDLE != statuses[1] {
+		t.Error("unexpected statuses", statuses)
+	}
+	// nothing to do
+	c.Disconnect()
+}
+
+func TestClientDisconnectConnecting(t *testing.T) {
+	// a listener which never answers
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if nil != err {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		var conns []net.Conn
+		defer func() {
+			for _, conn := range conns {
+				conn.Close()
+			}
+		}()
+		for {
+			conn, err := ln.Accept()
+			if nil != err {
+				return
+			}
+			conns = append(conns, conn)
+		}
+	}()
+
+	c := NewClient(Config{
+		Host:               "127.0.0.1",
+		Port:               ln.Addr().(*net.TCPAddr).Port,
+		HubName:            "DEFAULT",
+		InsecureSkipVerify: true,
+		Username:           "user",
+	})
+	result := make(chan error, 1)
+	go func() {
+		result <- c.Connect(context.Background())
+	}()
+	time.Sleep(50 * time.Millisecond)
+	if CLIENT_STATUS_CONNECTING != c.State() {
+		t.Fatal("not connecting", c.State(), c.Err())
+	}
+
+	start := time.Now()
+	c.Disconnect()
+	if time.Since(start) > 5*time.Second {
+		t.Error("login not aborted")
+	}
+	select {
+	case err := <-result:
+		if cedar.ERR_USER_CANCEL != err {
+			t.Error("unexpected error", err)
+		}
+	default:
+		t.Fatal("Connect still running")
+	}
+	if CLIENT_STATUS_IDLE != c.State() || nil != c.Frames() {
+		t.Error("not idle", c.State())
+	}
+}
@@ -0,0 +1,256 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"go-softether/mayaqua"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"unicode"
+)
+
+// DATA_PREVIEW_SIZE bytes of data values shown in a table, unless -full
+const DATA_PREVIEW_SIZE = 32
+
+var (
+	// ErrUnknownFormat unknown input or output format
+	ErrUnknownFormat = errors.New("ErrUnknownFormat")
+)
+
+var (
+	inFormat  = flag.String("in", "auto", "input format: auto, raw, hex, base64, http or json")
+	outFormat = flag.String("out", "table", "output format: table, json, raw, hex or base64")
+	full      = flag.Bool("full", false, "show data values in full in a table")
+)
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [options] [file]\n", os.Args[0])
+		fmt.Fprintln(flag.CommandLine.Output(), "Print the elements of a serialized pack read from file or stdin, or build one from json.")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if err := run(); nil != err {
+		fmt.Fprintln(os.Stderr, "error: "+err.Error())
+		os.Exit(1)
+	}
+}
+
+func run() error {
+	var in []byte
+	var err error
+	if flag.NArg() > 0 {
+		in, err = ioutil.ReadFile(flag.Arg(0))
+	} else {
+		in, err = ioutil.ReadAll(os.Stdin)
+	}
+	if nil != err {
+		return err
+	}
+
+	p, err := readPack(in, *inFormat)
+	if nil != err {
+		return err
+	}
+	return writePack(os.Stdout, p, *outFormat)
+}
+
+// detectFormat guess the format of a dump
+func detectFormat(in []byte) string {
+	s := bytes.TrimSpace(in)
+	switch {
+	case bytes.HasPrefix(s, []byte("HTTP/")), bytes.HasPrefix(s, []byte("POST ")), bytes.HasPrefix(s, []byte("GET ")):
+		return "http"
+	case bytes.HasPrefix(s, []byte("{")):
+		return "json"
+	case 0 == len(s):
+		return "raw"
+	}
+
+	isHex, isBase64 := true, true
+	for _, r := range string(s) {
+		if unicode.IsSpace(r) {
+			continue
+		}
+		if !strings.ContainsRune("0123456789abcdefABCDEF", r) {
+			isHex = false
+		}
+		if !strings.ContainsRune("ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789+/=", r) {
+			isBase64 = false
+		}
+	}
+	if isHex {
+		return "hex"
+	} else if isBase64 {
+		return "base64"
+	}
+	return "raw"
+}
+
+// removeSpace strip the white space of text dumps
+func removeSpace(in []byte) string {
+	return strings.Map(func(r rune) rune {
+		if unicode.IsSpace(r) {
+			return -1
+		}
+		return r
+	}, string(in))
+}
+
+// httpBody the body of a captured http request or response
+func httpBody(in []byte) ([]byte, error) {
+	r := bufio.NewReader(bytes.NewReader(in))
+	var body io.ReadCloser
+	if bytes.HasPrefix(bytes.TrimSpace(in), []byte("HTTP/")) {
+		res, err := http.ReadResponse(r, nil)
+		if nil != err {
+			return nil, err
+		}
+		body = res.Body
+	} else {
+		req, err := http.ReadRequest(r)
+		if nil != err {
+			return nil, err
+		}
+		body = req.Body
+	}
+	defer body.Close()
+	return ioutil.ReadAll(body)
+}
+
+func readPack(in []byte, format string) (*mayaqua.Pack, error) {
+	if "auto" == format {
+		format = detectFormat(in)
+	}
+
+	buf := in
+	var err error
+	switch format {
+	case "raw":
+	case "hex":
+		buf, err = hex.DecodeString(removeSpace(in))
+	case "base64":
+		buf, err = base64.StdEncoding.DecodeString(removeSpace(in))
+	case "http":
+		buf, err = httpBody(in)
+	case "json":
+		return mayaqua.PackFromJSON(in)
+	default:
+		return nil, ErrUnknownFormat
+	}
+	if nil != err {
+		return nil, err
+	}
+
+	return mayaqua.ReadPack(bytes.NewReader(buf))
+}
+
+func writePack(w io.Writer, p *mayaqua.Pack, format string) error {
+	if "table" == format {
+		return writeTable(w, p)
+	} else if "json" == format {
+		guessJsonHints(p)
+		b, err := p.ToJSON()
+		if nil != err {
+			return err
+		}
+		_, err = fmt.Fprintln(w, string(b))
+		return err
+	}
+
+	b, err := p.ToBuf()
+	if nil != err {
+		return err
+	}
+	switch format {
+	case "raw":
+		_, err = w.Write(b)
+	case "hex":
+		_, err = fmt.Fprintln(w, hex.EncodeToString(b))
+	case "base64":
+		_, err = fmt.Fprintln(w, base64.StdEncoding.EncodeToString(b))
+	default:
+		return ErrUnknownFormat
+	}
+	return err
+}
+
+// guessJsonHints restore the json hints a pack loses on the wire, arrays are
+// known from their number of values and addresses from their IPv6 flag
+func guessJsonHints(p *mayaqua.Pack) {
+	for _, e := range p.Elements {
+		if e.NumValue() > 1 {
+			e.JsonHint_IsArray = true
+		}
+		if nil == p.GetElement(e.Name+"@ipv6_bool", mayaqua.VALUE_INT) {
+			continue
+		}
+		for _, suffix := range []string{"", "@ipv6_bool", "@ipv6_array", "@ipv6_scope_id"} {
+			if ip := p.GetElement(e.Name+suffix, mayaqua.ValueType(mayaqua.INFINITE)); nil != ip {
+				ip.JsonHint_IsIP = true
+			}
+		}
+	}
+}
+
+var typeNames = map[mayaqua.ValueType]string{
+	mayaqua.VALUE_INT:    "INT",
+	mayaqua.VALUE_DATA:   "DATA",
+	mayaqua.VALUE_STR:    "STR",
+	mayaqua.VALUE_UNISTR: "UNISTR",
+	mayaqua.VALUE_INT64:  "INT64",
+}
+
+// writeTable one line for each value
+func writeTable(w io.Writer, p *mayaqua.Pack) error {
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "NAME\tTYPE\tINDEX\tVALUE")
+	for _, e := range p.Elements {
+		for i := uint32(0); i < e.NumValue(); i++ {
+			index := ""
+			if e.NumValue() > 1 {
+				index = strconv.Itoa(int(i))
+			}
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", e.Name, typeNames[e.Type], index, formatValue(p, e, i))
+		}
+	}
+	return tw.Flush()
+}
+
+func formatValue(p *mayaqua.Pack, e *mayaqua.Element, index uint32) string {
+	switch e.Type {
+	case mayaqua.VALUE_INT:
+		s := strconv.FormatUint(uint64(e.GetIntValue(index)), 10)
+		// the address of an ip element
+		if nil != p.GetElement(e.Name+"@ipv6_bool", mayaqua.VALUE_INT) {
+			if ip := p.GetIpEx(e.Name, index); nil != ip {
+				s += " (" + ip.String() + ")"
+			}
+		}
+		return s
+	case mayaqua.VALUE_INT64:
+		return strconv.FormatUint(e.GetInt64Value(index), 10)
+	case mayaqua.VALUE_STR:
+		return strconv.Quote(e.GetStrValue(index))
+	case mayaqua.VALUE_UNISTR:
+		return strconv.Quote(e.GetUniStrValue(index))
+	case mayaqua.VALUE_DATA:
+		b := e.GetDataValue(index)
+		if !*full && len(b) > DATA_PREVIEW_SIZE {
+			return hex.EncodeToString(b[:DATA_PREVIEW_SIZE]) + "... (" + strconv.Itoa(len(b)) + " bytes)"
+		}
+		return hex.EncodeToString(b)
+	}
+	return ""
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/hex"
+	"go-softether/mayaqua"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func testPack() *mayaqua.Pack {
+	p := &mayaqua.Pack{}
+	p.AddStr("hello", "SoftEther")
+	p.AddInt("version", 444)
+	p.AddData("random", bytes.Repeat([]byte{0xfe}, 20))
+	p.AddIntEx("port", 443, 0, 2)
+	p.AddIntEx("port", 5555, 1, 2)
+	p.AddIp("ip", net.IPv4(10, 1, 2, 3))
+	return p
+}
+
+func checkTestPack(t *testing.T, name string, p *mayaqua.Pack) {
+	if "SoftEther" != p.GetStr("hello") || 444 != p.GetInt("version") ||
+		!bytes.Equal(bytes.Repeat([]byte{0xfe}, 20), p.GetData("random")) ||
+		5555 != p.GetIntEx("port", 1) || !net.IPv4(10, 1, 2, 3).Equal(p.GetIp("ip")) {
+		t.Error(name, "unexpected pack")
+	}
+}
+
+func httpDump(start string, body []byte) []byte {
+	return []byte(start + "\r\nContent-Type: application/octet-stream\r\nContent-Length: " +
+		strconv.Itoa(len(body)) + "\r\n\r\n" + string(body))
+}
+
+func TestDetectFormat(t *testing.T) {
+	raw, err := testPack().ToBuf()
+	if nil != err {
+		t.Fatal(err)
+	}
+
+	for _, c := range []struct {
+		name   string
+		in     []byte
+		format string
+	}{
+		{"empty", nil, "raw"},
+		{"raw", raw, "raw"},
+		{"hex", []byte(hex.EncodeToString(raw)), "hex"},
+		{"hex dump", []byte(" 0000 0001\n0000 05aB\n"), "hex"},
+		{"base64", []byte(base64.StdEncoding.EncodeToString(raw) + "\n"), "base64"},
+		{"response", httpDump("HTTP/1.1 200 OK", raw), "http"},
+		{"request", httpDump("POST /vpnsvc/vpn.cgi HTTP/1.1\r\nHost: vpn", raw), "http"},
+		{"json", []byte("\n{\"hello_str\": \"SoftEther\"}"), "json"},
+		{"text", []byte("hello, world"), "raw"},
+	} {
+		if format := detectFormat(c.in); c.format != format {
+			t.Error(c.name, format)
+		}
+	}
+}
+
+func TestReadPack(t *testing.T) {
+	raw, err := testPack().ToBuf()
+	if nil != err {
+		t.Fatal(err)
+	}
+
+	for _, c := range []struct {
+		name string
+		in   []byte
+	}{
+		{"raw", raw},
+		{"hex", []byte(hex.EncodeToString(raw))},
+		{"base64", []byte(base64.StdEncoding.EncodeToString(raw))},
+		{"response", httpDump("HTTP/1.1 200 OK", raw)},
+		{"request", httpDump("POST /vpnsvc/vpn.cgi HTTP/1.1\r\nHost: vpn", raw)},
+	} {
+		if p, err := readPack(c.in, "auto"); nil != err {
+			t.Error(c.name, err)
+		} else {
+			checkTestPack(t, c.name, p)
+		}
+	}
+
+	if _, err := httpBody([]byte("HTTP/1.1 200 OK\r\nContent-Length: 10\r\n\r\nshort")); nil == err {
+		t.Error("truncated body accepted")
+	}
+	if _, err := readPack(raw, "pcap"); ErrUnknownFormat != err {
+		t.Error("unexpected error", err)
+	}
+	if err := writePack(&bytes.Buffer{}, testPack(), "pcap"); ErrUnknownFormat != err {
+		t.Error("unexpected error", err)
+	}
+}
+
+func TestGuessJsonHints(t *testing.T) {
+	raw, err := testPack().ToBuf()
+	if nil != err {
+		t.Fatal(err)
+	}
+	// the hints do not go over the wire
+	p, err := mayaqua.ReadPack(bytes.NewReader(raw))
+	if nil != err {
+		t.Fatal(err)
+	}
+	guessJsonHints(p)
+
+	if !p.GetElement("port", mayaqua.VALUE_INT).JsonHint_IsArray || p.GetElement("version", mayaqua.VALUE_INT).JsonHint_IsArray {
+		t.Error("unexpected array hints")
+	}
+	for _, name := range []string{"ip", "ip@ipv6_bool", "ip@ipv6_array", "ip@ipv6_scope_id"} {
+		if e := p.GetElement(name, mayaqua.ValueType(mayaqua.INFINITE)); nil == e || !e.JsonHint_IsIP {
+			t.Error(name, "not an address")
+		}
+	}
+	if p.GetElement("version", mayaqua.VALUE_INT).JsonHint_IsIP {
+		t.Error("version taken for an address")
+	}
+
+	var out bytes.Buffer
+	if err := writePack(&out, p, "json"); nil != err {
+		t.Fatal(err)
+	}
+	for _, s := range []string{`"ip_ip":"10.1.2.3"`, `"port_u32":[443,5555]`, `"version_u32":444`} {
+		if !strings.Contains(out.String(), s) {
+			t.Error("missing", s, "in", out.String())
+		}
+	}
+}
+
+func TestJsonToRaw(t *testing.T) {
+	var js bytes.Buffer
+	if err := writePack(&js, testPack(), "json"); nil != err {
+		t.Fatal(err)
+	}
+
+	// -in json -out raw
+	p, err := readPack(js.Bytes(), "json")
+	if nil != err {
+		t.Fatal(err)
+	}
+	var raw bytes.Buffer
+	if err := writePack(&raw, p, "raw"); nil != err {
+		t.Fatal(err)
+	}
+
+	if p, err := readPack(raw.Bytes(), "auto"); nil != err {
+		t.Fatal(err)
+	} else {
+		checkTestPack(t, "json", p)
+	}
+}
@@ -6,13 +6,28 @@ import (
 )
 
 var config struct {
-	Username           string
-	HashedPassword     string
-	Host               string
-	Port               int
-	HubName            string
-	InsecureSkipVerify bool
-	LocalAdapterMAC    string
+	Username               string
+	HashedPassword         string
+	ClientCertFile         string
+	ClientKeyFile          string
+	PlainPasswordEnv       string
+	PlainPasswordFile      string
+	Host                   string
+	Port                   int
+	HubName                string
+	InsecureSkipVerify     bool
+	ServerCertFingerprints []string
+	ServerCAFile           string
+	KnownHostsFile         string
+	LocalAdapterMAC        string
+	MaxConnection          uint32
+	HalfConnection         bool
+	ProxyType              string
+	ProxyHost              string
+	ProxyPort              int
+	ProxyUsername          string
+	ProxyPassword          string
+	ProxyUserAgent         string
 }
 
 func init() {
@@ -1,151 +1,142 @@
 package main
 
 import (
+	"context"
+	"crypto/x509"
 	"encoding/base64"
 	"errors"
 	"fmt"
+	softether "go-softether"
 	"go-softether/adapter"
 	"go-softether/cedar"
 	"go-softether/mayaqua"
+	"io/ioutil"
 	"os"
 	"os/signal"
+	"strings"
 	"syscall"
 )
 
 var (
-	// ErrBadHashedPassword bad hashed password
-	ErrBadHashedPassword = errors.New("ErrBadHashedPassword")
+	// ErrNoPlainPassword the password environment variable or file is empty
+	ErrNoPlainPassword = errors.New("ErrNoPlainPassword")
+	// ErrBadProxyType unknown proxy type
+	ErrBadProxyType = errors.New("ErrBadProxyType")
 )
 
 func main() {
 	if err := connectToServer(config.Host, config.Port, config.Username, config.HashedPassword, config.HubName, config.InsecureSkipVerify); nil != err {
 		fmt.Println("error: " + err.Error())
+		if e, ok := err.(*cedar.ServerCertError); ok && cedar.ERR_CERT_NOT_TRUSTED == e.Code {
+			fmt.Printf("if you trust it, add \"%s\" to ServerCertFingerprints\n", cedar.FormatFingerprint(e.Sha256[:]))
+		}
 	}
 }
 
 func connectToServer(host string, port int, username, hashedPassword, hubName string, insecureSkipVerify bool) error {
-	session := cedar.Session{}
-	session.ClientAuth.AuthType = cedar.CLIENT_AUTHTYPE_PASSWORD
-	session.ClientAuth.Username = username
-
-	conn := cedar.Connection{
-		Cedar:              cedar.NewCedar(),
+	cfg := softether.Config{
 		Host:               host,
 		Port:               port,
-		ClientVer:          1000,
-		ClientBuild:        1000,
-		ClientStr:          "Go-SoftEther Client",
-		Session:            &session,
+		HubName:            hubName,
 		InsecureSkipVerify: insecureSkipVerify,
+		Username:           username,
+		ClientStr:          "Go-SoftEther Client",
+		MaxConnection:      config.MaxConnection,
+		HalfConnection:     config.HalfConnection,
+		NumRetry:           mayaqua.INFINITE,
+		RetryInterval:      cedar.RETRY_INTERVAL_DEFAULT,
+		OnStatus: func(status softether.ClientStatus, cause error) {
+			if nil != cause {
+				fmt.Println("Status:", status, "cause:", cause)
+			} else {
+				fmt.Println("Status:", status)
+			}
+		},
 	}
 
-	session.Connection = &conn
-
-	// conn.Session.ClientAuth.HashedPassword = mayaqua.Sha0([]byte(password + strings.ToUpper(username)))
-	if pwd, err := base64.StdEncoding.DecodeString(hashedPassword); nil != err {
+	if err := setProxy(&cfg); nil != err {
 		return err
-	} else if int(mayaqua.SHA1_SIZE) != len(pwd) {
-		return ErrBadHashedPassword
-	} else {
-		copy(conn.Session.ClientAuth.HashedPassword[:], pwd)
 	}
-	conn.Session.ClientOption.HubName = hubName
-	conn.Session.ClientOption.MaxConnection = 1
-	conn.Session.ClientOption.UseEncrypt = true
-
-	if s, err := conn.ClientConnectToServer(); nil != err {
+	if err := setServerCert(&cfg); nil != err {
 		return err
-	} else {
-
-		// TODO: NewUdpAccel
+	}
 
-		if req, err := conn.ClientUploadSignature(s); nil != err {
-			return err
-		} else if err := conn.ClientDownloadHello(s, req); nil != err {
+	if "" != config.ClientCertFile {
+		if err := loadClientCert(&cfg, config.ClientCertFile, config.ClientKeyFile); nil != err {
 			return err
 		}
-
-		// TODO: IsAdminPackSupportedServerProduct
-
-		// ClientCheckServerCert unnecessary?
-
-		var welcome *mayaqua.Pack
-		if req, err := conn.ClientUploadAuth(); nil != err {
+	} else if "" != config.PlainPasswordEnv || "" != config.PlainPasswordFile {
+		if err := loadPlainPassword(&cfg, config.PlainPasswordEnv, config.PlainPasswordFile); nil != err {
 			return err
-		} else if p, err := mayaqua.HttpClientRecv(s, req); nil != err {
-			return err
-		} else if e := p.GetError(); 0 != e {
-			return cedar.ErrorCode(e)
-		} else if brandedCfroms := p.GetStr("branded_cfroms"); len(brandedCfroms) > 0 && "Branded_VPN" != brandedCfroms {
-			return cedar.ERR_BRANDED_C_FROM_S
-		} else {
-			welcome = p
 		}
+	} else if pwd, err := base64.StdEncoding.DecodeString(hashedPassword); nil != err {
+		return err
+	} else {
+		cfg.HashedPassword = pwd
+	}
 
-		// TODO: client update notification
-
-		if msg := string(welcome.GetData("Msg")); "" != msg {
-			// TODO: msg from server
-		}
-
-		if welcome.GetInt("Redirect") != 0 {
-			// TODO: redirect
-		}
-
-		// fmt.Println("use_fast_rc4:", welcome.GetInt("use_fast_rc4"))
-		sessionName, connectionName, policy := cedar.ParseWelcomeFromPack(welcome)
-		fmt.Println("SessionName:", sessionName, "ConnectionName:", connectionName)
-
-		// fmt.Printf("state: %+v\n", c.Conn.ConnectionState())
-
-		if sessionKey, sessionKey32, err := cedar.GetSessionKeyFromPack(welcome); nil != err {
-			return err
-		} else {
-			conn.Session.SessionKey = sessionKey
-			conn.Session.SessionKey32 = sessionKey32
-		}
-
-		if welcome.GetInt("use_encrypt") == 0 {
-			return errors.New("use_encrypt is false")
-		}
-		conn.Session.Policy.MaxConnection = welcome.GetInt("max_connection")
-
-		// TODO: Deploy and update connection parameters
-
-		conn.Name = connectionName
-
-		conn.Session.Name = sessionName
-		conn.Session.Policy = policy
+	client := softether.NewClient(cfg)
+	if err := client.Connect(context.Background()); nil != err {
+		return err
+	}
+	right := client.Frames()
+	defer client.Disconnect()
+	fmt.Println("SessionName:", right.GetName())
 
-		conn.StartTunnelingMode()
+	left, err := adapter.CreateLocalMachineAdapter("feth0", config.LocalAdapterMAC)
+	if nil != err {
+		return err
+	}
+	defer left.Destroy()
+
+	go func() {
+		_ = adapter.InvokeDHCP(left)
+	}()
+
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-c
+		left.Destroy()
+		client.Disconnect()
+		os.Exit(0)
+	}()
+
+	return pipe(left, right)
+}
 
-		left, err := adapter.CreateLocalMachineAdapter("feth0", config.LocalAdapterMAC)
-		if nil != err {
-			return err
-		}
-		defer left.Destroy()
+// loadClientCert switch to certificate authentication
+func loadClientCert(cfg *softether.Config, certFile, keyFile string) error {
+	if x, err := mayaqua.FileToX(certFile); nil != err {
+		return err
+	} else if k, err := mayaqua.FileToK(keyFile); nil != err {
+		return err
+	} else if !mayaqua.CheckXandK(x, k) {
+		return cedar.ErrClientCertMismatch
+	} else {
+		cfg.ClientCert = x
+		cfg.ClientKey = k
+		return nil
+	}
+}
 
-		right, err := conn.Session.Main()
-		if nil != err {
-			return err
-		}
-		defer right.Destroy()
-
-		go func() {
-			_ = adapter.InvokeDHCP(left)
-		}()
-
-		c := make(chan os.Signal)
-		signal.Notify(c, os.Interrupt, syscall.SIGTERM)
-		go func() {
-			<-c
-			left.Destroy()
-			right.Destroy()
-			os.Exit(0)
-		}()
-
-		return pipe(left, right)
+// loadPlainPassword switch to plain password authentication, the password is
+// kept out of config.json
+func loadPlainPassword(cfg *softether.Config, env, file string) error {
+	password := ""
+	if "" != env {
+		password = os.Getenv(env)
+	} else if b, err := ioutil.ReadFile(file); nil != err {
+		return err
+	} else {
+		password = strings.TrimRight(string(b), "\r\n")
+	}
+	if "" == password {
+		return ErrNoPlainPassword
 	}
+
+	cfg.PlainPassword = password
+	return nil
 }
 
 func pipe(left, right adapter.Adapter) error {
@@ -165,3 +156,46 @@ func pipe(left, right adapter.Adapter) error {
 	go f(left, right)
 	return f(right, left)
 }
+
+// setProxy set the proxy of the config
+func setProxy(cfg *softether.Config) error {
+	switch config.ProxyType {
+	case "":
+		return nil
+	case "http":
+		cfg.ProxyType = cedar.PROXY_HTTP
+	case "socks5":
+		cfg.ProxyType = cedar.PROXY_SOCKS5
+	default:
+		return ErrBadProxyType
+	}
+	cfg.ProxyHost = config.ProxyHost
+	cfg.ProxyPort = config.ProxyPort
+	cfg.ProxyUsername = config.ProxyUsername
+	cfg.ProxyPassword = config.ProxyPassword
+	cfg.ProxyUserAgent = config.ProxyUserAgent
+	return nil
+}
+
+// setServerCert set how the certificate of the server is trusted
+func setServerCert(cfg *softether.Config) error {
+	for _, s := range config.ServerCertFingerprints {
+		if fp, err := cedar.ParseFingerprint(s); nil != err {
+			return err
+		} else {
+			cfg.ServerCertFingerprints = append(cfg.ServerCertFingerprints, fp)
+		}
+	}
+	if "" != config.ServerCAFile {
+		cfg.RootCAs = x509.NewCertPool()
+		if b, err := ioutil.ReadFile(config.ServerCAFile); nil != err {
+			return err
+		} else if !cfg.RootCAs.AppendCertsFromPEM(b) {
+			return mayaqua.ErrInvalidCert
+		}
+	}
+	if "" != config.KnownHostsFile {
+		cfg.KnownHosts = cedar.NewKnownHostsFile(config.KnownHostsFile)
+	}
+	return nil
+}
@@ -1,5 +1,7 @@
-package go_softeher
+package softether
 
 const (
-	CEDAR_CLIENT_STR = "GO SoftEther VPN Client"
+	CEDAR_CLIENT_STR        = "GO SoftEther VPN Client"
+	CEDAR_VER        uint32 = 1000
+	CEDAR_BUILD      uint32 = 1000
 )
@@ -0,0 +1,120 @@
+package mayaqua
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"strings"
+)
+
+var (
+	// ErrInvalidCert the buffer holds no x509 certificate
+	ErrInvalidCert = errors.New("invalid certificate")
+	// ErrInvalidKey the buffer holds no private key
+	ErrInvalidKey = errors.New("invalid private key")
+	// ErrUnsupportedKey only RSA and ECDSA keys are supported
+	ErrUnsupportedKey = errors.New("unsupported private key type")
+)
+
+// FileToX load a certificate file, PEM or DER
+func FileToX(filename string) (*x509.Certificate, error) {
+	if b, err := ioutil.ReadFile(filename); nil != err {
+		return nil, err
+	} else {
+		return BufToX(b)
+	}
+}
+
+// BufToX parse a certificate, PEM or DER, the first one of a PEM chain is taken
+func BufToX(b []byte) (*x509.Certificate, error) {
+	if der := pemBlock(b, "CERTIFICATE"); nil != der {
+		b = der
+	}
+
+	if x, err := x509.ParseCertificate(b); nil != err {
+		return nil, ErrInvalidCert
+	} else {
+		return x, nil
+	}
+}
+
+// FileToK load a private key file, PEM or DER
+func FileToK(filename string) (crypto.Signer, error) {
+	if b, err := ioutil.ReadFile(filename); nil != err {
+		return nil, err
+	} else {
+		return BufToK(b)
+	}
+}
+
+// BufToK parse an RSA or ECDSA private key, PEM or DER, in PKCS#1, SEC 1 or
+// PKCS#8 form
+func BufToK(b []byte) (crypto.Signer, error) {
+	if der := pemBlock(b, "PRIVATE KEY"); nil != der {
+		b = der
+	}
+
+	if k, err := x509.ParsePKCS1PrivateKey(b); nil == err {
+		return k, nil
+	}
+	if k, err := x509.ParseECPrivateKey(b); nil == err {
+		return k, nil
+	}
+	if k, err := x509.ParsePKCS8PrivateKey(b); nil == err {
+		switch k := k.(type) {
+		case *rsa.PrivateKey:
+			return k, nil
+		case *ecdsa.PrivateKey:
+			return k, nil
+		default:
+			return nil, ErrUnsupportedKey
+		}
+	}
+
+	return nil, ErrInvalidKey
+}
+
+// CheckXandK whether k is the private key of x
+func CheckXandK(x *x509.Certificate, k crypto.Signer) bool {
+	if nil == x || nil == k {
+		return false
+	}
+
+	pub, ok := k.Public().(interface {
+		Equal(crypto.PublicKey) bool
+	})
+	return ok && pub.Equal(x.PublicKey)
+}
+
+// SignEx sign the SHA-1 hash of data as SoftEther does, PKCS#1 v1.5 for RSA
+// and ASN.1 for ECDSA
+func SignEx(k crypto.Signer, data []byte) ([]byte, error) {
+	switch k.(type) {
+	case *rsa.PrivateKey, *ecdsa.PrivateKey:
+	default:
+		return nil, ErrUnsupportedKey
+	}
+
+	hash := sha1.Sum(data)
+	return k.Sign(rand.Reader, hash[:], crypto.SHA1)
+}
+
+// pemBlock the first PEM block whose type ends with suffix, nil for a non PEM buffer
+func pemBlock(b []byte, suffix string) []byte {
+	for {
+		block, rest := pem.Decode(b)
+		if nil == block {
+			return nil
+		}
+		if strings.HasSuffix(block.Type, suffix) {
+			return block.Bytes
+		}
+		b = rest
+	}
+}
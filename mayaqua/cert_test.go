@@ -0,0 +1,143 @@
+package mayaqua
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func testCert(t *testing.T, k crypto.Signer) []byte {
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "user"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, k.Public(), k)
+	if nil != err {
+		t.Fatal(err)
+	}
+	return der
+}
+
+func TestBufToXandK(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if nil != err {
+		t.Fatal(err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if nil != err {
+		t.Fatal(err)
+	}
+	ecDer, _ := x509.MarshalECPrivateKey(ecKey)
+	rsaPkcs8, _ := x509.MarshalPKCS8PrivateKey(rsaKey)
+	ecPkcs8, _ := x509.MarshalPKCS8PrivateKey(ecKey)
+
+	tests := []struct {
+		name string
+		k    crypto.Signer
+		der  []byte
+		typ  string
+	}{
+		{"rsa pkcs1", rsaKey, x509.MarshalPKCS1PrivateKey(rsaKey), "RSA PRIVATE KEY"},
+		{"rsa pkcs8", rsaKey, rsaPkcs8, "PRIVATE KEY"},
+		{"ecdsa sec1", ecKey, ecDer, "EC PRIVATE KEY"},
+		{"ecdsa pkcs8", ecKey, ecPkcs8, "PRIVATE KEY"},
+	}
+
+	for _, tt := range tests {
+		certDer := testCert(t, tt.k)
+		certPem := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certDer})
+		keyPem := pem.EncodeToMemory(&pem.Block{Type: tt.typ, Bytes: tt.der})
+
+		for _, b := range [][]byte{certDer, certPem} {
+			x, err := BufToX(b)
+			if nil != err {
+				t.Fatal(tt.name, err)
+			}
+			for _, kb := range [][]byte{tt.der, keyPem} {
+				k, err := BufToK(kb)
+				if nil != err {
+					t.Fatal(tt.name, err)
+				}
+				if !CheckXandK(x, k) {
+					t.Error(tt.name, "key does not match")
+				}
+			}
+		}
+	}
+
+	x, _ := BufToX(testCert(t, rsaKey))
+	if CheckXandK(x, ecKey) {
+		t.Error("mismatched key accepted")
+	}
+
+	if _, err := BufToX([]byte("garbage")); err != ErrInvalidCert {
+		t.Error("garbage certificate", err)
+	}
+	if _, err := BufToK([]byte("garbage")); err != ErrInvalidKey {
+		t.Error("garbage key", err)
+	}
+}
+
+func TestFileToXandK(t *testing.T) {
+	k, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if nil != err {
+		t.Fatal(err)
+	}
+	der, _ := x509.MarshalECPrivateKey(k)
+
+	dir, err := ioutil.TempDir("", "cert")
+	if nil != err {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	certFile := filepath.Join(dir, "user.crt")
+	keyFile := filepath.Join(dir, "user.key")
+	ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: testCert(t, k)}), 0600)
+	// parameters ahead of the key as openssl writes them
+	ioutil.WriteFile(keyFile, append(
+		pem.EncodeToMemory(&pem.Block{Type: "EC PARAMETERS", Bytes: []byte{6, 8, 42, 134, 72, 206, 61, 3, 1, 7}}),
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der})...), 0600)
+
+	if x, err := FileToX(certFile); nil != err {
+		t.Fatal(err)
+	} else if k, err := FileToK(keyFile); nil != err {
+		t.Fatal(err)
+	} else if !CheckXandK(x, k) {
+		t.Error("key does not match")
+	}
+}
+
+func TestSignEx(t *testing.T) {
+	data := make([]byte, SHA1_SIZE)
+	rand.Read(data)
+	hash := sha1.Sum(data)
+
+	rsaKey, _ := rsa.GenerateKey(rand.Reader, 1024)
+	if sign, err := SignEx(rsaKey, data); nil != err {
+		t.Fatal(err)
+	} else if err := rsa.VerifyPKCS1v15(&rsaKey.PublicKey, crypto.SHA1, hash[:], sign); nil != err {
+		t.Error(err)
+	}
+
+	ecKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if sign, err := SignEx(ecKey, data); nil != err {
+		t.Fatal(err)
+	} else if !ecdsa.VerifyASN1(&ecKey.PublicKey, hash[:], sign) {
+		t.Error("bad ecdsa signature")
+	}
+}
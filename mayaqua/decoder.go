@@ -0,0 +1,216 @@
+package mayaqua
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+var (
+	BUDGET_EXCEEDED = errors.New("Budget exceeded")
+)
+
+// PackDecoderOptions limits of a PackDecoder, zero for the protocol maximum
+type PackDecoderOptions struct {
+	MaxTotalBytes int64  // Maximum size of the serialized pack, MAX_PACK_SIZE by default
+	MaxElements   uint32 // Maximum number of elements, MAX_ELEMENT_NUM by default
+}
+
+func (o PackDecoderOptions) withDefaults() PackDecoderOptions {
+	if o.MaxTotalBytes <= 0 {
+		o.MaxTotalBytes = MAX_PACK_SIZE
+	}
+	if 0 == o.MaxElements || o.MaxElements > MAX_ELEMENT_NUM {
+		o.MaxElements = MAX_ELEMENT_NUM
+	}
+	return o
+}
+
+// PackDecoder read a pack from a stream, every length is checked against the
+// bytes left of the budget before reading and memory grows with the bytes
+// actually received, a lying peer fails fast instead of making us allocate
+type PackDecoder struct {
+	r           io.Reader
+	budget      int64 // bytes left
+	maxElements uint32
+	buf         [8]byte
+}
+
+// NewPackDecoder new pack decoder reading r within the limits of opts
+func NewPackDecoder(r io.Reader, opts PackDecoderOptions) *PackDecoder {
+	opts = opts.withDefaults()
+	return &PackDecoder{
+		r:           r,
+		budget:      opts.MaxTotalBytes,
+		maxElements: opts.MaxElements,
+	}
+}
+
+// Decode read a pack
+func (d *PackDecoder) Decode() (*Pack, error) {
+	num, err := d.readUint32()
+	if nil != err {
+		return nil, err
+	}
+	if num > d.maxElements {
+		return nil, NUMBER_EXCEEDS
+	}
+
+	pack := &Pack{}
+	for i := uint32(0); i < num; i++ {
+		if e, err := d.readElement(); nil != err {
+			return nil, err
+		} else if err := pack.AddElement(e); nil != err {
+			return nil, err
+		}
+	}
+
+	return pack, nil
+}
+
+// take count n bytes against the budget
+func (d *PackDecoder) take(n int64) error {
+	if n > d.budget {
+		return BUDGET_EXCEEDED
+	}
+	d.budget -= n
+	return nil
+}
+
+func (d *PackDecoder) readUint32() (uint32, error) {
+	if err := d.take(4); nil != err {
+		return 0, err
+	}
+	if _, err := io.ReadFull(d.r, d.buf[:4]); nil != err {
+		return 0, err
+	}
+	return binary.BigEndian.Uint32(d.buf[:4]), nil
+}
+
+func (d *PackDecoder) readUint64() (uint64, error) {
+	if err := d.take(8); nil != err {
+		return 0, err
+	}
+	if _, err := io.ReadFull(d.r, d.buf[:8]); nil != err {
+		return 0, err
+	}
+	return binary.BigEndian.Uint64(d.buf[:8]), nil
+}
+
+// readBytes read n bytes, the buffer grows as they arrive
+func (d *PackDecoder) readBytes(n uint32) ([]byte, error) {
+	if err := d.take(int64(n)); nil != err {
+		return nil, err
+	}
+	b := &bytes.Buffer{}
+	if _, err := io.CopyN(b, d.r, int64(n)); io.EOF == err {
+		return nil, io.ErrUnexpectedEOF
+	} else if nil != err {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
+
+// readStr read a string whose size counts a terminating NUL which is not sent
+func (d *PackDecoder) readStr(max uint32) (string, error) {
+	num, err := d.readUint32()
+	if nil != err {
+		return "", err
+	}
+	if num == 0 {
+		return "", INVALID_STRING
+	} else if num > MAX_VALUE_SIZE {
+		return "", SIZE_OVER
+	} else if num-1 > max {
+		return "", NAME_TOO_LONG
+	}
+	b, err := d.readBytes(num - 1)
+	if nil != err {
+		return "", err
+	}
+	return string(b), nil
+}
+
+func (d *PackDecoder) readElement() (e *Element, err error) {
+	e = &Element{}
+	if e.Name, err = d.readStr(MAX_ELEMENT_NAME_LEN); nil != err {
+		return nil, err
+	}
+
+	t, err := d.readUint32()
+	if nil != err {
+		return nil, err
+	}
+	e.Type = ValueType(t)
+	if e.Type > VALUE_INT64 {
+		return nil, INVALID_TYPE
+	}
+
+	n, err := d.readUint32()
+	if nil != err {
+		return nil, err
+	} else if n > MAX_VALUE_NUM {
+		return nil, NUMBER_EXCEEDS
+	} else if int64(n)*4 > d.budget {
+		// 4 bytes a value at least
+		return nil, BUDGET_EXCEEDED
+	}
+
+	for i := uint32(0); i < n; i++ {
+		if v, err := d.readValue(e.Type); nil != err {
+			return nil, err
+		} else {
+			e.Values = append(e.Values, v)
+		}
+	}
+
+	return e, nil
+}
+
+func (d *PackDecoder) readValue(t ValueType) (v Value, err error) {
+	switch t {
+	case VALUE_INT:
+		v.IntValue, err = d.readUint32()
+	case VALUE_INT64:
+		v.Int64Value, err = d.readUint64()
+	case VALUE_DATA:
+		s := uint32(0)
+		if s, err = d.readUint32(); nil != err {
+			return v, err
+		} else if s > MAX_VALUE_SIZE {
+			return v, SIZE_OVER
+		}
+		v.Data, err = d.readBytes(s)
+	case VALUE_STR:
+		s := uint32(0)
+		if s, err = d.readUint32(); nil != err {
+			return v, err
+		} else if s > MAX_VALUE_SIZE-1 {
+			return v, SIZE_OVER
+		}
+		b := []byte(nil)
+		if b, err = d.readBytes(s); nil == err {
+			v.Str = string(b)
+		}
+	case VALUE_UNISTR:
+		// UTF-8, the size counts the terminating NUL
+		s := uint32(0)
+		if s, err = d.readUint32(); nil != err {
+			return v, err
+		} else if s > MAX_VALUE_SIZE {
+			return v, SIZE_OVER
+		}
+		b := []byte(nil)
+		if b, err = d.readBytes(s); nil == err {
+			if i := bytes.IndexByte(b, 0); i >= 0 {
+				b = b[:i]
+			}
+			v.UniStr = string(b)
+		}
+	default:
+		return v, INVALID_TYPE
+	}
+
+	return v, err
+}
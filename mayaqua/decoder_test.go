@@ -0,0 +1,90 @@
+package mayaqua
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"runtime"
+	"testing"
+)
+
+// failReader fails the test when the decoder reads past the bytes it was given
+type failReader struct {
+	t *testing.T
+}
+
+func (r failReader) Read(p []byte) (int, error) {
+	r.t.Error("read past the limit")
+	return 0, errors.New("read past the limit")
+}
+
+func TestPackDecoderBudget(t *testing.T) {
+	b := testPackBuf(t)
+	size := int64(len(b))
+
+	if p, err := NewPackDecoder(bytes.NewReader(b), PackDecoderOptions{MaxTotalBytes: size}).Decode(); nil != err {
+		t.Fatal(err)
+	} else if "world" != p.GetStr("hello") {
+		t.Error("unexpected pack")
+	}
+	if _, err := NewPackDecoder(bytes.NewReader(b), PackDecoderOptions{MaxTotalBytes: size - 1}).Decode(); err != BUDGET_EXCEEDED {
+		t.Error(err)
+	}
+	if _, err := NewPackDecoder(bytes.NewReader(b), PackDecoderOptions{MaxElements: 6}).Decode(); err != NUMBER_EXCEEDS {
+		t.Error(err)
+	}
+	if _, err := NewPackDecoder(bytes.NewReader(b), PackDecoderOptions{MaxElements: 7}).Decode(); nil != err {
+		t.Error(err)
+	}
+}
+
+func TestPackDecoderFailFast(t *testing.T) {
+	tests := []struct {
+		name string
+		buf  []byte
+	}{
+		{"huge data", pack(1, element("a", VALUE_DATA, 1, u32(MAX_VALUE_SIZE)))},
+		{"huge str", pack(1, element("a", VALUE_STR, 1, u32(MAX_VALUE_SIZE-1)))},
+		{"huge unistr", pack(1, element("a", VALUE_UNISTR, 1, u32(MAX_VALUE_SIZE)))},
+		{"many values", pack(1, element("a", VALUE_INT, MAX_VALUE_NUM, u32(1), u32(2)))},
+	}
+
+	// the claimed size is refused before anything more is read
+	for _, tt := range tests {
+		r := io.MultiReader(bytes.NewReader(tt.buf), failReader{t})
+		if _, err := NewPackDecoder(r, PackDecoderOptions{MaxTotalBytes: 1024}).Decode(); err != BUDGET_EXCEEDED {
+			t.Errorf("%s: got %v", tt.name, err)
+		}
+	}
+}
+
+func TestPackDecoderAllocation(t *testing.T) {
+	// a value claiming hundreds of megabytes with a few bytes behind
+	b := append(pack(1, element("a", VALUE_DATA, 1, u32(MAX_VALUE_SIZE))), make([]byte, 1000)...)
+
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	if _, err := ReadPack(bytes.NewReader(b)); err != io.ErrUnexpectedEOF {
+		t.Error(err)
+	}
+	runtime.ReadMemStats(&after)
+	if n := after.TotalAlloc - before.TotalAlloc; n > 1<<20 {
+		t.Error("allocated", n)
+	}
+}
+
+func TestPackDecoderStream(t *testing.T) {
+	// the decoder stops at the end of the pack
+	b := testPackBuf(t)
+	r := bytes.NewReader(append(append([]byte{}, b...), b...))
+	d := NewPackDecoder(r, PackDecoderOptions{})
+	if _, err := d.Decode(); nil != err {
+		t.Fatal(err)
+	}
+	if r.Len() != len(b) {
+		t.Error("read", len(b)*2-r.Len())
+	}
+	if _, err := ReadPack(r); nil != err {
+		t.Error(err)
+	}
+}
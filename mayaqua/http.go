@@ -2,7 +2,7 @@ package mayaqua
 
 import (
 	"bytes"
-	"io"
+	"context"
 	"io/ioutil"
 	"net/http"
 	"net/url"
@@ -24,27 +24,40 @@ const (
 
 // HttpClientRecv http client recv
 func HttpClientRecv(s *Sock, req *http.Request) (*Pack, error) {
+	return HttpClientRecvEx(s, req, PackDecoderOptions{})
+}
+
+// HttpClientRecvEx http client recv, the pack is decoded from the body as it
+// arrives within the limits of opts
+func HttpClientRecvEx(s *Sock, req *http.Request, opts PackDecoderOptions) (*Pack, error) {
 	if res, err := http.ReadResponse(s.reader, req); nil != err {
 		return nil, err
 	} else {
 		defer res.Body.Close()
-		if res.ContentLength == 0 ||
+		if res.ContentLength <= 0 ||
 			res.Proto != "HTTP/1.1" ||
 			res.StatusCode != http.StatusOK ||
 			res.Header.Get("Content-Type") != HTTP_CONTENT_TYPE2 ||
 			res.ContentLength > MAX_PACK_SIZE {
 			return nil, ERR_SERVER_IS_NOT_VPN
 		}
-		buf := make([]byte, int(res.ContentLength))
-		if _, err := io.ReadFull(res.Body, buf); nil != err {
-			return nil, err
-		} else {
-			r := bytes.NewReader(buf)
-			return ReadPack(r)
+		opts = opts.withDefaults()
+		if res.ContentLength > opts.MaxTotalBytes {
+			return nil, BUDGET_EXCEEDED
 		}
+		opts.MaxTotalBytes = res.ContentLength
+		return NewPackDecoder(res.Body, opts).Decode()
 	}
 }
 
+// HttpClientRecvContext http client recv, aborted when ctx is done
+func HttpClientRecvContext(ctx context.Context, s *Sock, req *http.Request, opts PackDecoderOptions) (*Pack, error) {
+	stop := WatchContext(ctx, s)
+	defer stop()
+	p, err := HttpClientRecvEx(s, req, opts)
+	return p, ContextError(ctx, err)
+}
+
 // HttpClientSend http client send
 func HttpClientSend(s *Sock, p *Pack) (*http.Request, error) {
 	p.CreateDummyValue()
@@ -75,3 +88,11 @@ func HttpClientSend(s *Sock, p *Pack) (*http.Request, error) {
 	return req, req.Write(s)
 
 }
+
+// HttpClientSendContext http client send, aborted when ctx is done
+func HttpClientSendContext(ctx context.Context, s *Sock, p *Pack) (*http.Request, error) {
+	stop := WatchContext(ctx, s)
+	defer stop()
+	req, err := HttpClientSend(s, p)
+	return req, ContextError(ctx, err)
+}
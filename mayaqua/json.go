@@ -0,0 +1,376 @@
+package mayaqua
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// JSON_DATETIME_FORMAT date time format of the "_dt" members
+const JSON_DATETIME_FORMAT = "2006-01-02T15:04:05.000Z"
+
+// MAX_JSON_DEPTH Maximum nesting of the json of a pack, which needs 3: the
+// pack, the array of a group and its objects
+const MAX_JSON_DEPTH = 8
+
+var (
+	INVALID_JSON  = errors.New("Invalid json")
+	JSON_TOO_DEEP = errors.New("Json nested too deep")
+)
+
+// jsonObject a json object keeping the order of its members
+type jsonObject struct {
+	names  []string
+	values []interface{}
+}
+
+func (o *jsonObject) set(name string, v interface{}) {
+	o.names = append(o.names, name)
+	o.values = append(o.values, v)
+}
+
+// MarshalJSON the members in order
+func (o *jsonObject) MarshalJSON() ([]byte, error) {
+	b := &bytes.Buffer{}
+	b.WriteByte('{')
+	for i, name := range o.names {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		if n, err := json.Marshal(name); nil != err {
+			return nil, err
+		} else {
+			b.Write(n)
+		}
+		b.WriteByte(':')
+		if v, err := json.Marshal(o.values[i]); nil != err {
+			return nil, err
+		} else {
+			b.Write(v)
+		}
+	}
+	b.WriteByte('}')
+	return b.Bytes(), nil
+}
+
+// ToJSON convert to json as SoftEther's PackToJson, the name of each member
+// carries the type of the element as a suffix, array elements of a group
+// become the members of an array of objects named after the group
+func (p *Pack) ToJSON() ([]byte, error) {
+	o := &jsonObject{}
+
+	// groups
+	groups := []string{}
+	addGroup := func(name string) {
+		for _, g := range groups {
+			if strings.EqualFold(g, name) {
+				return
+			}
+		}
+		groups = append(groups, name)
+	}
+	for _, e := range p.Elements {
+		if e.JsonHint_IsArray && "" != e.JsonHint_GroupName {
+			addGroup(e.JsonHint_GroupName)
+		}
+	}
+	for _, name := range p.JSONSubitemNames {
+		if "" != name {
+			addGroup(name)
+		}
+	}
+
+	grouped := map[*Element]bool{}
+	for _, g := range groups {
+		members := []*Element{}
+		count := -1
+		ok := true
+		for _, e := range p.Elements {
+			if e.JsonHint_IsArray && strings.EqualFold(e.JsonHint_GroupName, g) {
+				if -1 == count {
+					count = int(e.NumValue())
+				} else if count != int(e.NumValue()) {
+					ok = false
+				}
+				members = append(members, e)
+			}
+		}
+		if !ok {
+			// rendered as plain arrays below
+			continue
+		}
+		if -1 == count {
+			count = 0
+		}
+
+		items := make([]interface{}, count)
+		for j := range items {
+			item := &jsonObject{}
+			for _, e := range members {
+				p.elementToJSON(item, e, uint32(j))
+			}
+			items[j] = item
+		}
+		o.set(g, items)
+
+		for _, e := range members {
+			grouped[e] = true
+		}
+	}
+
+	// the others
+	for _, e := range p.Elements {
+		if grouped[e] {
+			continue
+		}
+		if !e.JsonHint_IsArray {
+			p.elementToJSON(o, e, 0)
+			continue
+		}
+
+		a := &jsonObject{}
+		for j := uint32(0); j < e.NumValue(); j++ {
+			p.elementToJSON(a, e, j)
+		}
+		if len(a.names) > 0 {
+			o.set(a.names[0], a.values)
+		}
+	}
+
+	return json.Marshal(o)
+}
+
+// elementToJSON set the index-th value of e as a member of o, nothing for the
+// hidden parts of an ip address
+func (p *Pack) elementToJSON(o *jsonObject, e *Element, index uint32) {
+	if e.JsonHint_IsIP {
+		// the address is rendered once, by its IPv4 element
+		if VALUE_INT == e.Type && !strings.Contains(e.Name, "@") {
+			if ip := p.GetIpEx(e.Name, index); nil != ip {
+				o.set(e.Name+"_ip", ip.String())
+			}
+		}
+		return
+	}
+
+	switch e.Type {
+	case VALUE_INT:
+		if e.JsonHint_IsBool {
+			o.set(e.Name+"_bool", e.GetIntValue(index) != 0)
+		} else {
+			o.set(e.Name+"_u32", e.GetIntValue(index))
+		}
+	case VALUE_INT64:
+		if e.JsonHint_IsDateTime {
+			t := msecToTime(int64(e.GetInt64Value(index)))
+			o.set(e.Name+"_dt", t.UTC().Format(JSON_DATETIME_FORMAT))
+		} else {
+			o.set(e.Name+"_u64", e.GetInt64Value(index))
+		}
+	case VALUE_STR:
+		o.set(e.Name+"_str", e.GetStrValue(index))
+	case VALUE_UNISTR:
+		o.set(e.Name+"_utf", e.GetUniStrValue(index))
+	case VALUE_DATA:
+		o.set(e.Name+"_bin", base64.StdEncoding.EncodeToString(e.GetDataValue(index)))
+	}
+}
+
+// PackFromJSON convert json to a pack as SoftEther's JsonToPack, members
+// without a known type suffix are ignored
+func PackFromJSON(b []byte) (*Pack, error) {
+	d := json.NewDecoder(bytes.NewReader(b))
+	d.UseNumber()
+
+	v, err := readJSON(d, MAX_JSON_DEPTH)
+	if nil != err {
+		return nil, err
+	}
+	o, ok := v.(*jsonObject)
+	if !ok {
+		return nil, INVALID_JSON
+	}
+	if d.More() {
+		return nil, INVALID_JSON
+	}
+
+	p := &Pack{}
+	for i, name := range o.names {
+		a, ok := o.values[i].([]interface{})
+		if !ok {
+			p.addJSONValue(name, o.values[i], 0, 1, true)
+			continue
+		}
+
+		if 0 == len(a) {
+			// only a group can be empty
+			p.SetCurrentJsonGroupName(name)
+			p.SetCurrentJsonGroupName("")
+		}
+		for j, item := range a {
+			if obj, ok := item.(*jsonObject); ok {
+				p.SetCurrentJsonGroupName(name)
+				for k, name2 := range obj.names {
+					p.addJSONValue(name2, obj.values[k], uint32(j), uint32(len(a)), false)
+				}
+				p.SetCurrentJsonGroupName("")
+			} else {
+				p.addJSONValue(name, item, uint32(j), uint32(len(a)), false)
+			}
+		}
+	}
+
+	return p, nil
+}
+
+// addJSONValue add a json value according to the type suffix of its name
+func (p *Pack) addJSONValue(name string, v interface{}, index, total uint32, single bool) {
+	if nil == v {
+		return
+	}
+
+	var e *Element
+	if n := strings.TrimSuffix(name, "_bool"); n != name {
+		e = p.AddBoolEx(n, jsonToBool(v), index, total)
+	} else if n := strings.TrimSuffix(name, "_u32"); n != name {
+		e = p.AddIntEx(n, uint32(jsonToUint64(v)), index, total)
+	} else if n := strings.TrimSuffix(name, "_u64"); n != name {
+		e = p.AddInt64Ex(n, jsonToUint64(v), index, total)
+	} else if n := strings.TrimSuffix(name, "_str"); n != name {
+		e = p.AddStrEx(n, jsonToStr(v), index, total)
+	} else if n := strings.TrimSuffix(name, "_utf"); n != name {
+		e = p.AddUniStrEx(n, jsonToStr(v), index, total)
+	} else if n := strings.TrimSuffix(name, "_bin"); n != name {
+		if s, ok := v.(string); ok {
+			if b, err := base64.StdEncoding.DecodeString(s); nil == err {
+				e = p.AddDataEx(n, b, index, total)
+			}
+		}
+	} else if n := strings.TrimSuffix(name, "_dt"); n != name {
+		if s, ok := v.(string); ok {
+			if t, err := time.Parse(time.RFC3339Nano, s); nil == err {
+				e = p.AddTime64Ex(n, uint64(timeToMsec(t)), index, total)
+			}
+		} else if _, ok := v.(json.Number); ok {
+			e = p.AddTime64Ex(n, jsonToUint64(v), index, total)
+		}
+	} else if n := strings.TrimSuffix(name, "_ip"); n != name {
+		if s, ok := v.(string); ok {
+			if ip := net.ParseIP(s); nil != ip {
+				p.addIpEx(n, ip, 0, index, total, single)
+			}
+		}
+	}
+
+	if nil != e && single {
+		e.JsonHint_IsArray = false
+	}
+}
+
+// jsonToBool as SoftEther's ToBool for strings
+func jsonToBool(v interface{}) bool {
+	switch v := v.(type) {
+	case bool:
+		return v
+	case string:
+		s := strings.ToLower(v)
+		for _, prefix := range []string{"true", "yes", "on", "enable"} {
+			if strings.HasPrefix(s, prefix) {
+				return true
+			}
+		}
+	}
+	return jsonToUint64(v) != 0
+}
+
+func jsonToUint64(v interface{}) uint64 {
+	s := ""
+	switch v := v.(type) {
+	case bool:
+		if v {
+			return 1
+		}
+		return 0
+	case json.Number:
+		s = v.String()
+	case string:
+		s = strings.TrimSpace(v)
+	default:
+		return 0
+	}
+
+	if i, err := strconv.ParseUint(s, 10, 64); nil == err {
+		return i
+	} else if f, err := strconv.ParseFloat(s, 64); nil == err && f > 0 {
+		return uint64(f)
+	}
+	return 0
+}
+
+func jsonToStr(v interface{}) string {
+	switch v := v.(type) {
+	case bool:
+		return strconv.FormatBool(v)
+	case json.Number:
+		return v.String()
+	case string:
+		return v
+	}
+	return ""
+}
+
+// readJSON read a value nested depth levels at most, objects keep the order
+// of their members
+func readJSON(d *json.Decoder, depth int) (interface{}, error) {
+	t, err := d.Token()
+	if nil != err {
+		return nil, err
+	}
+
+	switch t {
+	case json.Delim('{'), json.Delim('['):
+		if depth <= 0 {
+			return nil, JSON_TOO_DEEP
+		}
+	}
+
+	switch t {
+	case json.Delim('{'):
+		o := &jsonObject{}
+		for d.More() {
+			name, err := d.Token()
+			if nil != err {
+				return nil, err
+			}
+			v, err := readJSON(d, depth-1)
+			if nil != err {
+				return nil, err
+			}
+			o.set(name.(string), v)
+		}
+		if _, err := d.Token(); nil != err {
+			return nil, err
+		}
+		return o, nil
+	case json.Delim('['):
+		a := []interface{}{}
+		for d.More() {
+			v, err := readJSON(d, depth-1)
+			if nil != err {
+				return nil, err
+			}
+			a = append(a, v)
+		}
+		if _, err := d.Token(); nil != err {
+			return nil, err
+		}
+		return a, nil
+	}
+
+	return t, nil
+}
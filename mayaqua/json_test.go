@@ -0,0 +1,148 @@
+package mayaqua
+
+import (
+	"bytes"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestToJSON(t *testing.T) {
+	p := &Pack{}
+	p.AddInt("NumHub", 2)
+	p.AddBool("Online", true)
+	p.AddInt64("Bytes", 1<<40)
+	p.AddTime64("CreatedTime", 1546300800123)
+	p.AddStr("HubName", "DEFAULT")
+	p.AddUniStr("Note", "日本")
+	p.AddData("Key", []byte{1, 2, 3})
+	p.AddIp32("Ip", IPToUINT(net.IPv4(192, 168, 0, 1)))
+	p.AddIp("Ip6", net.ParseIP("fe80::1"))
+	p.AddIntEx("Ports", 443, 0, 2)
+	p.AddIntEx("Ports", 5555, 1, 2)
+
+	// members of a group share the name space of the pack
+	p.SetCurrentJsonGroupName("HubList")
+	for i, name := range []string{"DEFAULT", "VPN"} {
+		p.AddStrEx("Name", name, uint32(i), 2)
+		p.AddBoolEx("Active", i == 0, uint32(i), 2)
+		p.AddIpEx("Addr", net.IPv4(10, 0, 0, byte(i+1)), uint32(i), 2)
+	}
+	p.SetCurrentJsonGroupName("Empty")
+	p.SetCurrentJsonGroupName("")
+
+	want := `{"HubList":[{"Name_str":"DEFAULT","Active_bool":true,"Addr_ip":"10.0.0.1"},` +
+		`{"Name_str":"VPN","Active_bool":false,"Addr_ip":"10.0.0.2"}],` +
+		`"Empty":[],` +
+		`"NumHub_u32":2,"Online_bool":true,"Bytes_u64":1099511627776,` +
+		`"CreatedTime_dt":"2019-01-01T00:00:00.123Z","HubName_str":"DEFAULT","Note_utf":"日本",` +
+		`"Key_bin":"AQID","Ip_ip":"192.168.0.1","Ip6_ip":"fe80::1","Ports_u32":[443,5555]}`
+
+	b, err := p.ToJSON()
+	if nil != err {
+		t.Fatal(err)
+	}
+	if string(b) != want {
+		t.Errorf("got %s", b)
+	}
+
+	// and back
+	q, err := PackFromJSON(b)
+	if nil != err {
+		t.Fatal(err)
+	}
+	if c, err := q.ToJSON(); nil != err {
+		t.Fatal(err)
+	} else if string(c) != want {
+		t.Errorf("round trip %s", c)
+	}
+	if q.GetInt64("CreatedTime") != 1546300800123 || q.GetUniStr("Note") != "日本" ||
+		!bytes.Equal(q.GetData("Key"), []byte{1, 2, 3}) || q.GetIntEx("Ports", 1) != 5555 {
+		t.Error("unexpected values")
+	}
+	if !q.GetIpEx("Ip6", 0).Equal(net.ParseIP("fe80::1")) || !q.GetIpEx("Ip", 0).Equal(net.IPv4(192, 168, 0, 1)) {
+		t.Error("unexpected addresses")
+	}
+	if e := q.GetElement("Name", VALUE_STR); nil == e || e.JsonHint_GroupName != "HubList" || !e.JsonHint_IsArray {
+		t.Error("group lost")
+	}
+	if e := q.GetElement("NumHub", VALUE_INT); nil == e || e.JsonHint_IsArray {
+		t.Error("single value became an array")
+	}
+}
+
+func TestPackFromJSON(t *testing.T) {
+	// a JSON-RPC request as sent to the admin API, with loose types
+	p, err := PackFromJSON([]byte(`{
+		"HubName_str": "DEFAULT",
+		"Online_bool": "yes",
+		"MaxSession_u32": "100",
+		"Total_u64": 12345678901234,
+		"Port_str": 443,
+		"Created_dt": "2020-02-03T04:05:06+09:00",
+		"Password_bin": "c2VjcmV0",
+		"Unknown": 1,
+		"Nothing_u32": null,
+		"Ip_ip": "::ffff:10.1.2.3",
+		"Names_str": ["a", "b"],
+		"Users": [{"Name_str": "u1", "Id_u32": 1}, {"Name_str": "u2", "Id_u32": 2}]
+	}`))
+	if nil != err {
+		t.Fatal(err)
+	}
+
+	if p.GetStr("HubName") != "DEFAULT" || !p.GetBool("Online") || p.GetInt("MaxSession") != 100 ||
+		p.GetInt64("Total") != 12345678901234 || p.GetStr("Port") != "443" || string(p.GetData("Password")) != "secret" {
+		t.Error("unexpected values")
+	}
+	if p.GetInt64("Created") != 1580670306000 {
+		t.Error("unexpected date time", p.GetInt64("Created"))
+	}
+	if nil != p.GetElement("Unknown", ValueType(INFINITE)) || nil != p.GetElement("Nothing", ValueType(INFINITE)) {
+		t.Error("untyped member added")
+	}
+	if ip := p.GetIpEx("Ip", 0); !ip.Equal(net.IPv4(10, 1, 2, 3)) || p.GetBool("Ip@ipv6_bool") {
+		t.Error("unexpected address", ip)
+	}
+	if p.GetStrEx("Names", 1) != "b" || p.GetStrEx("Name", 1) != "u2" || p.GetIntEx("Id", 1) != 2 {
+		t.Error("unexpected arrays")
+	}
+
+	for _, s := range []string{``, `[]`, `"str"`, `{"a_u32":1} {}`, `{"a_u32":}`, `{"a_u32":1`} {
+		if _, err := PackFromJSON([]byte(s)); nil == err {
+			t.Errorf("%q accepted", s)
+		}
+	}
+
+	// nesting is bounded
+	deep := `{"a":` + strings.Repeat("[", 100000) + strings.Repeat("]", 100000) + `}`
+	if _, err := PackFromJSON([]byte(deep)); JSON_TOO_DEEP != err {
+		t.Error("unexpected error", err)
+	}
+	ok := `{"a":[{"b":[[[[1]]]]}]}`
+	if _, err := PackFromJSON([]byte(ok)); nil != err {
+		t.Error(err)
+	}
+}
+
+func TestJSONDateTimeRange(t *testing.T) {
+	for _, s := range []string{"2300-01-01T00:00:00.250Z", "1600-07-01T12:00:00.999Z", "1970-01-01T00:00:00.000Z"} {
+		tm, _ := time.Parse(time.RFC3339Nano, s)
+		p := &Pack{}
+		p.AddTime64("At", uint64(timeToMsec(tm)))
+
+		b, err := p.ToJSON()
+		if nil != err {
+			t.Fatal(err)
+		}
+		if `{"At_dt":"`+s+`"}` != string(b) {
+			t.Error("unexpected json", string(b))
+		}
+		if q, err := PackFromJSON(b); nil != err {
+			t.Error(err)
+		} else if q.GetInt64("At") != p.GetInt64("At") {
+			t.Error(s, "unexpected date time", q.GetInt64("At"))
+		}
+	}
+}
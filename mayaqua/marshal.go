@@ -0,0 +1,393 @@
+package mayaqua
+
+import (
+	"errors"
+	"net"
+	"reflect"
+	"strings"
+	"time"
+)
+
+var (
+	NOT_A_STRUCT      = errors.New("Not a struct")
+	UNSUPPORTED_FIELD = errors.New("Unsupported field")
+)
+
+var (
+	timeType = reflect.TypeOf(time.Time{})
+	ipType   = reflect.TypeOf(net.IP{})
+)
+
+// packTag the options of a `pack` struct tag
+type packTag struct {
+	name     string
+	skip     bool
+	ip       bool
+	bool     bool
+	datetime bool
+	unistr   bool
+	array    bool
+	prefix   string
+}
+
+func parsePackTag(f reflect.StructField) packTag {
+	tag := packTag{name: f.Name}
+	s, ok := f.Tag.Lookup("pack")
+	if !ok {
+		return tag
+	}
+	if "-" == s {
+		tag.skip = true
+		return tag
+	}
+
+	opts := strings.Split(s, ",")
+	if "" != opts[0] {
+		tag.name = opts[0]
+	}
+	for _, opt := range opts[1:] {
+		switch {
+		case "ip" == opt:
+			tag.ip = true
+		case "bool" == opt:
+			tag.bool = true
+		case "datetime" == opt:
+			tag.datetime = true
+		case "unistr" == opt:
+			tag.unistr = true
+		case "array" == opt:
+			tag.array = true
+		case strings.HasPrefix(opt, "prefix="):
+			tag.prefix = strings.TrimPrefix(opt, "prefix=")
+		}
+	}
+	return tag
+}
+
+// isNested struct fields flattened into the pack
+func isNested(t reflect.Type) bool {
+	return reflect.Struct == t.Kind() && timeType != t
+}
+
+// isArray slice fields stored as array elements
+func isArray(t reflect.Type) bool {
+	return reflect.Slice == t.Kind() && reflect.Uint8 != t.Elem().Kind() && ipType != t
+}
+
+// Marshal convert a struct to a pack, each exported field is an element as
+// described by its `pack` tag:
+//
+//	Name    string  `pack:"name"`            // element name, the field name by default, "-" to skip
+//	Address uint32  `pack:",ip"`             // IPv4 address as SoftEther's uint32, net.IP fields always are addresses
+//	Online  uint32  `pack:",bool"`           // integer flagged as bool, bool fields always are
+//	Created uint64  `pack:",datetime"`       // milliseconds since the unix epoch, time.Time fields always are
+//	Note    string  `pack:",unistr"`         // unicode string instead of ANSI string
+//	Port    uint32  `pack:",array"`          // a single value flagged as array, slices always are arrays
+//	Policy  Policy  `pack:",prefix=policy:"` // struct flattened, the prefix added to the names of its fields
+//	Hubs    []Hub   `pack:"HubList"`         // slice of structs as the arrays of the group HubList
+func Marshal(v interface{}) (*Pack, error) {
+	p := &Pack{}
+	if err := MarshalTo(p, v); nil != err {
+		return nil, err
+	}
+	return p, nil
+}
+
+// MarshalTo add the fields of a struct to p as Marshal, fields whose name
+// already exists in p are not added
+func MarshalTo(p *Pack, v interface{}) error {
+	rv := reflect.Indirect(reflect.ValueOf(v))
+	if reflect.Struct != rv.Kind() {
+		return NOT_A_STRUCT
+	}
+	return p.marshalStruct(rv, "", 0, 1, true)
+}
+
+func (p *Pack) marshalStruct(v reflect.Value, prefix string, index, total uint32, single bool) error {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if "" != f.PkgPath {
+			continue
+		}
+		tag := parsePackTag(f)
+		if tag.skip {
+			continue
+		}
+
+		fv := v.Field(i)
+		name := prefix + tag.name
+		switch {
+		case isNested(f.Type):
+			if err := p.marshalStruct(fv, prefix+tag.prefix, index, total, single); nil != err {
+				return err
+			}
+		case isArray(f.Type):
+			if !single {
+				return UNSUPPORTED_FIELD
+			}
+			n := uint32(fv.Len())
+			if isNested(f.Type.Elem()) {
+				p.SetCurrentJsonGroupName(name)
+				for j := uint32(0); j < n; j++ {
+					if err := p.marshalStruct(fv.Index(int(j)), prefix+tag.prefix, j, n, false); nil != err {
+						p.SetCurrentJsonGroupName("")
+						return err
+					}
+				}
+				p.SetCurrentJsonGroupName("")
+				continue
+			}
+			for j := uint32(0); j < n; j++ {
+				if err := p.marshalValue(name, fv.Index(int(j)), tag, j, n, false); nil != err {
+					return err
+				}
+			}
+		default:
+			if err := p.marshalValue(name, fv, tag, index, total, single); nil != err {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (p *Pack) marshalValue(name string, v reflect.Value, tag packTag, index, total uint32, single bool) error {
+	// an existing element is kept as by AddInt and the others, the Ex
+	// functions would overwrite it
+	if single && nil != p.GetElement(name, ValueType(INFINITE)) {
+		return nil
+	}
+
+	var e *Element
+	switch t := v.Type(); {
+	case timeType == t:
+		// the zero time is 0 as in SoftEther
+		ms := int64(0)
+		if t := v.Interface().(time.Time); !t.IsZero() {
+			ms = timeToMsec(t)
+		}
+		e = p.AddTime64Ex(name, uint64(ms), index, total)
+	case ipType == t:
+		if e = p.addIpEx(name, v.Interface().(net.IP), 0, index, total, single); nil == e {
+			return SAME_NAME_EXISTS
+		}
+		return nil
+	case reflect.Bool == t.Kind():
+		e = p.AddBoolEx(name, v.Bool(), index, total)
+	case reflect.Uint8 == t.Kind(), reflect.Uint16 == t.Kind(), reflect.Uint32 == t.Kind():
+		e = p.marshalInt(name, uint32(v.Uint()), tag, index, total, single)
+	case reflect.Int8 == t.Kind(), reflect.Int16 == t.Kind(), reflect.Int32 == t.Kind():
+		e = p.marshalInt(name, uint32(v.Int()), tag, index, total, single)
+	case reflect.Uint64 == t.Kind(), reflect.Int64 == t.Kind():
+		i := uint64(0)
+		if reflect.Int64 == t.Kind() {
+			i = uint64(v.Int())
+		} else {
+			i = v.Uint()
+		}
+		if tag.datetime {
+			e = p.AddTime64Ex(name, i, index, total)
+		} else {
+			e = p.AddInt64Ex(name, i, index, total)
+		}
+	case reflect.String == t.Kind():
+		if tag.unistr {
+			e = p.AddUniStrEx(name, v.String(), index, total)
+		} else {
+			e = p.AddStrEx(name, v.String(), index, total)
+		}
+	case reflect.Slice == t.Kind() && reflect.Uint8 == t.Elem().Kind():
+		e = p.AddDataEx(name, append([]byte{}, v.Bytes()...), index, total)
+	case reflect.Array == t.Kind() && reflect.Uint8 == t.Elem().Kind():
+		b := make([]byte, v.Len())
+		reflect.Copy(reflect.ValueOf(b), v)
+		e = p.AddDataEx(name, b, index, total)
+	default:
+		return UNSUPPORTED_FIELD
+	}
+
+	if nil == e {
+		return SAME_NAME_EXISTS
+	}
+	if single {
+		e.JsonHint_IsArray = tag.array
+	}
+	return nil
+}
+
+func (p *Pack) marshalInt(name string, i uint32, tag packTag, index, total uint32, single bool) *Element {
+	if tag.ip {
+		return p.addIpEx(name, UINTToIP(i), 0, index, total, single)
+	}
+	e := p.AddIntEx(name, i, index, total)
+	if nil != e && tag.bool {
+		e.JsonHint_IsBool = true
+	}
+	return e
+}
+
+// Unmarshal set the fields of the struct pointed to by v from p, as described
+// for Marshal, fields without an element of their type are left untouched
+func Unmarshal(p *Pack, v interface{}) error {
+	rv := reflect.ValueOf(v)
+	if reflect.Ptr != rv.Kind() || rv.IsNil() || reflect.Struct != rv.Elem().Kind() {
+		return NOT_A_STRUCT
+	}
+	return p.unmarshalStruct(rv.Elem(), "", 0, true)
+}
+
+func (p *Pack) unmarshalStruct(v reflect.Value, prefix string, index uint32, single bool) error {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if "" != f.PkgPath {
+			continue
+		}
+		tag := parsePackTag(f)
+		if tag.skip {
+			continue
+		}
+
+		fv := v.Field(i)
+		name := prefix + tag.name
+		switch {
+		case isNested(f.Type):
+			if err := p.unmarshalStruct(fv, prefix+tag.prefix, index, single); nil != err {
+				return err
+			}
+		case isArray(f.Type):
+			if !single {
+				return UNSUPPORTED_FIELD
+			}
+			if isNested(f.Type.Elem()) {
+				n := p.groupCount(f.Type.Elem(), prefix+tag.prefix)
+				if 0 == n {
+					continue
+				}
+				a := reflect.MakeSlice(f.Type, int(n), int(n))
+				for j := uint32(0); j < n; j++ {
+					if err := p.unmarshalStruct(a.Index(int(j)), prefix+tag.prefix, j, false); nil != err {
+						return err
+					}
+				}
+				fv.Set(a)
+				continue
+			}
+			e := p.GetElement(name, ValueType(INFINITE))
+			if nil == e {
+				continue
+			}
+			n := e.NumValue()
+			a := reflect.MakeSlice(f.Type, int(n), int(n))
+			for j := uint32(0); j < n; j++ {
+				if err := p.unmarshalValue(name, a.Index(int(j)), tag, j); nil != err {
+					return err
+				}
+			}
+			fv.Set(a)
+		default:
+			if err := p.unmarshalValue(name, fv, tag, index); nil != err {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// groupCount the number of items of a group, the longest of the arrays of its fields
+func (p *Pack) groupCount(t reflect.Type, prefix string) uint32 {
+	n := uint32(0)
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if "" != f.PkgPath {
+			continue
+		}
+		tag := parsePackTag(f)
+		if tag.skip {
+			continue
+		}
+		if isNested(f.Type) {
+			if c := p.groupCount(f.Type, prefix+tag.prefix); c > n {
+				n = c
+			}
+		} else if e := p.GetElement(prefix+tag.name, ValueType(INFINITE)); nil != e && e.NumValue() > n {
+			n = e.NumValue()
+		}
+	}
+	return n
+}
+
+func (p *Pack) unmarshalValue(name string, v reflect.Value, tag packTag, index uint32) error {
+	get := func(t ValueType) *Element {
+		if e := p.GetElement(name, t); nil != e && index < e.NumValue() {
+			return e
+		}
+		return nil
+	}
+
+	switch t := v.Type(); {
+	case timeType == t:
+		if e := get(VALUE_INT64); nil != e {
+			if ms := int64(e.GetInt64Value(index)); 0 == ms {
+				v.Set(reflect.ValueOf(time.Time{}))
+			} else {
+				v.Set(reflect.ValueOf(msecToTime(ms)))
+			}
+		}
+	case ipType == t:
+		if ip := p.GetIpEx(name, index); nil != ip {
+			v.Set(reflect.ValueOf(ip))
+		}
+	case reflect.Bool == t.Kind():
+		if e := get(VALUE_INT); nil != e {
+			v.SetBool(e.GetIntValue(index) != 0)
+		}
+	case reflect.Uint8 == t.Kind(), reflect.Uint16 == t.Kind(), reflect.Uint32 == t.Kind(),
+		reflect.Int8 == t.Kind(), reflect.Int16 == t.Kind(), reflect.Int32 == t.Kind():
+		i := uint32(0)
+		if tag.ip {
+			ip := p.GetIpEx(name, index)
+			if nil == ip || nil == ip.To4() {
+				return nil
+			}
+			i = IPToUINT(ip)
+		} else if e := get(VALUE_INT); nil != e {
+			i = e.GetIntValue(index)
+		} else {
+			return nil
+		}
+		if reflect.Int8 <= t.Kind() && t.Kind() <= reflect.Int64 {
+			v.SetInt(int64(int32(i)))
+		} else {
+			v.SetUint(uint64(i))
+		}
+	case reflect.Uint64 == t.Kind(), reflect.Int64 == t.Kind():
+		if e := get(VALUE_INT64); nil != e {
+			if reflect.Int64 == t.Kind() {
+				v.SetInt(int64(e.GetInt64Value(index)))
+			} else {
+				v.SetUint(e.GetInt64Value(index))
+			}
+		}
+	case reflect.String == t.Kind():
+		if tag.unistr {
+			if e := get(VALUE_UNISTR); nil != e {
+				v.SetString(e.GetUniStrValue(index))
+			}
+		} else if e := get(VALUE_STR); nil != e {
+			v.SetString(e.GetStrValue(index))
+		}
+	case reflect.Slice == t.Kind() && reflect.Uint8 == t.Elem().Kind():
+		if e := get(VALUE_DATA); nil != e {
+			v.SetBytes(append([]byte{}, e.GetDataValue(index)...))
+		}
+	case reflect.Array == t.Kind() && reflect.Uint8 == t.Elem().Kind():
+		if e := get(VALUE_DATA); nil != e {
+			reflect.Copy(v, reflect.ValueOf(e.GetDataValue(index)))
+		}
+	default:
+		return UNSUPPORTED_FIELD
+	}
+	return nil
+}
@@ -0,0 +1,240 @@
+package mayaqua
+
+import (
+	"bytes"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+)
+
+type testHub struct {
+	Name   string `pack:"HubName"`
+	Online bool
+	Ip     net.IP
+}
+
+type testLimits struct {
+	MaxSession uint32
+	Enabled    bool
+}
+
+type testRpc struct {
+	Name     string
+	Note     string `pack:",unistr"`
+	Count    uint32
+	Signed   int32
+	Bytes    uint64
+	Flag     uint32 `pack:",bool"`
+	Last     uint64 `pack:",datetime"`
+	Created  time.Time
+	Key      []byte
+	Id       [4]byte
+	Addr     uint32 `pack:",ip"`
+	Addr6    net.IP
+	Ports    []uint32
+	Names    []string
+	Single   uint32     `pack:"One,array"`
+	Limits   testLimits `pack:",prefix=limit:"`
+	Hubs     []testHub  `pack:"HubList"`
+	Ignored  string     `pack:"-"`
+	internal uint32
+}
+
+func testRpcValue() testRpc {
+	return testRpc{
+		Name:    "DEFAULT",
+		Note:    "日本",
+		Count:   3,
+		Signed:  -1,
+		Bytes:   1 << 40,
+		Flag:    1,
+		Last:    1546300800123,
+		Created: time.Unix(1546300800, 123000000),
+		Key:     []byte{1, 2, 3},
+		Id:      [4]byte{4, 5, 6, 7},
+		Addr:    IPToUINT(net.IPv4(192, 168, 0, 1)),
+		Addr6:   net.ParseIP("fe80::1"),
+		Ports:   []uint32{443, 5555},
+		Names:   []string{"a", "b", "c"},
+		Single:  7,
+		Limits:  testLimits{MaxSession: 100, Enabled: true},
+		Hubs: []testHub{
+			{"DEFAULT", true, net.IPv4(10, 0, 0, 1)},
+			{"VPN", false, net.ParseIP("2001:db8::1")},
+		},
+		Ignored:  "x",
+		internal: 1,
+	}
+}
+
+func TestMarshal(t *testing.T) {
+	v := testRpcValue()
+	p, err := Marshal(&v)
+	if nil != err {
+		t.Fatal(err)
+	}
+
+	if p.GetStr("Name") != "DEFAULT" || p.GetUniStr("Note") != "日本" || p.GetInt("Count") != 3 ||
+		p.GetInt("Signed") != 0xffffffff || p.GetInt64("Bytes") != 1<<40 || !p.GetBool("Flag") ||
+		p.GetInt64("Last") != 1546300800123 || p.GetInt64("Created") != 1546300800123 ||
+		!bytes.Equal(p.GetData("Key"), []byte{1, 2, 3}) || !bytes.Equal(p.GetData("Id"), []byte{4, 5, 6, 7}) {
+		t.Error("unexpected values")
+	}
+	if !p.GetIpEx("Addr", 0).Equal(net.IPv4(192, 168, 0, 1)) || !p.GetIpEx("Addr6", 0).Equal(net.ParseIP("fe80::1")) {
+		t.Error("unexpected addresses")
+	}
+	if p.GetIntEx("Ports", 1) != 5555 || p.GetStrEx("Names", 2) != "c" || p.GetInt("One") != 7 {
+		t.Error("unexpected arrays")
+	}
+	if p.GetInt("limit:MaxSession") != 100 || !p.GetBool("limit:Enabled") {
+		t.Error("unexpected prefixed values")
+	}
+	if p.GetStrEx("HubName", 1) != "VPN" || !p.GetBoolEx("Online", 0) || !p.GetIpEx("Ip", 1).Equal(net.ParseIP("2001:db8::1")) {
+		t.Error("unexpected group")
+	}
+	if nil != p.GetElement("Ignored", ValueType(INFINITE)) || nil != p.GetElement("internal", ValueType(INFINITE)) {
+		t.Error("skipped field added")
+	}
+
+	// json hints
+	hints := []struct {
+		name                            string
+		isArray, isBool, isDateTime, ip bool
+		group                           string
+	}{
+		{"Count", false, false, false, false, ""},
+		{"Flag", false, true, false, false, ""},
+		{"Last", false, false, true, false, ""},
+		{"Created", false, false, true, false, ""},
+		{"Addr", false, false, false, true, ""},
+		{"Ports", true, false, false, false, ""},
+		{"One", true, false, false, false, ""},
+		{"HubName", true, false, false, false, "HubList"},
+		{"Online", true, true, false, false, "HubList"},
+	}
+	for _, h := range hints {
+		e := p.GetElement(h.name, ValueType(INFINITE))
+		if nil == e || e.JsonHint_IsArray != h.isArray || e.JsonHint_IsBool != h.isBool ||
+			e.JsonHint_IsDateTime != h.isDateTime || e.JsonHint_IsIP != h.ip || e.JsonHint_GroupName != h.group {
+			t.Errorf("%s: unexpected hints %+v", h.name, e)
+		}
+	}
+}
+
+func TestUnmarshal(t *testing.T) {
+	v := testRpcValue()
+	p, err := Marshal(v)
+	if nil != err {
+		t.Fatal(err)
+	}
+
+	// through the wire
+	b, err := p.ToBuf()
+	if nil != err {
+		t.Fatal(err)
+	}
+	if p, err = ReadPack(bytes.NewReader(b)); nil != err {
+		t.Fatal(err)
+	}
+
+	got := testRpc{Ignored: "kept"}
+	if err := Unmarshal(p, &got); nil != err {
+		t.Fatal(err)
+	}
+	if !got.Created.Equal(v.Created) {
+		t.Error("created", got.Created)
+	}
+	for i, ip := range []net.IP{net.IPv4(10, 0, 0, 1), net.ParseIP("2001:db8::1")} {
+		if !got.Hubs[i].Ip.Equal(ip) {
+			t.Error("hub address", got.Hubs[i].Ip)
+		}
+		got.Hubs[i].Ip = v.Hubs[i].Ip
+	}
+	if !got.Addr6.Equal(v.Addr6) {
+		t.Error("address", got.Addr6)
+	}
+	got.Created, got.Addr6 = v.Created, v.Addr6
+	v.Ignored, v.internal = "kept", 0
+	if !reflect.DeepEqual(got, v) {
+		t.Errorf("got %+v", got)
+	}
+}
+
+func TestMarshalTime(t *testing.T) {
+	type times struct {
+		Zero time.Time
+		Far  time.Time
+		Old  time.Time
+	}
+	v := times{
+		Far: time.Date(2300, 1, 1, 0, 0, 0, 250000000, time.UTC),
+		Old: time.Date(1600, 7, 1, 12, 0, 0, 999000000, time.UTC),
+	}
+	p, err := Marshal(v)
+	if nil != err {
+		t.Fatal(err)
+	}
+	if 0 != p.GetInt64("Zero") {
+		t.Error("zero time", p.GetInt64("Zero"))
+	}
+
+	got := times{Zero: time.Now()}
+	if err := Unmarshal(p, &got); nil != err {
+		t.Fatal(err)
+	}
+	if !got.Zero.IsZero() || !got.Far.Equal(v.Far) || !got.Old.Equal(v.Old) {
+		t.Errorf("got %+v", got)
+	}
+}
+
+func TestUnmarshalMissing(t *testing.T) {
+	p := &Pack{}
+	p.AddStr("Count", "not an int")
+	p.AddInt("Name", 1)
+
+	v := testRpc{Name: "kept", Count: 9, Ports: []uint32{1}}
+	if err := Unmarshal(p, &v); nil != err {
+		t.Fatal(err)
+	}
+	if "kept" != v.Name || 9 != v.Count || len(v.Ports) != 1 || nil != v.Hubs {
+		t.Errorf("fields changed %+v", v)
+	}
+}
+
+func TestMarshalInvalid(t *testing.T) {
+	if _, err := Marshal(1); err != NOT_A_STRUCT {
+		t.Error(err)
+	}
+	if err := Unmarshal(&Pack{}, testRpc{}); err != NOT_A_STRUCT {
+		t.Error(err)
+	}
+	if _, err := Marshal(struct{ F float64 }{}); err != UNSUPPORTED_FIELD {
+		t.Error(err)
+	}
+	if err := Unmarshal(&Pack{}, &struct{ F map[string]string }{}); err != UNSUPPORTED_FIELD {
+		t.Error(err)
+	}
+	if _, err := Marshal(struct{ Hubs []struct{ Ports []uint32 } }{[]struct{ Ports []uint32 }{{}}}); err != UNSUPPORTED_FIELD {
+		t.Error(err)
+	}
+}
+
+func TestMarshalToExisting(t *testing.T) {
+	p := &Pack{}
+	p.AddStr("hubname", "first")
+
+	// names are case insensitive, the existing element is kept
+	v := struct {
+		HubName string
+		Port    uint32
+		A       uint32 `pack:"a"`
+		B       uint32 `pack:"A"`
+	}{"second", 443, 1, 2}
+	if err := MarshalTo(p, v); nil != err {
+		t.Fatal(err)
+	}
+	if p.GetStr("HubName") != "first" || p.GetInt("Port") != 443 || p.GetInt("a") != 1 || len(p.Elements) != 3 {
+		t.Error("unexpected pack")
+	}
+}
@@ -12,20 +12,7 @@ var (
 
 // ReadBufStr read string from buffer
 func ReadBufStr(r io.Reader) (string, error) {
-	num := uint32(0)
-	if err := binary.Read(r, binary.BigEndian, &num); nil != err {
-		return "", err
-	}
-	if num == 0 {
-		return "", INVALID_STRING
-	}
-	num--
-	buf := make([]byte, num)
-	if _, err := io.ReadFull(r, buf); nil != err {
-		return "", err
-	}
-
-	return string(buf), nil
+	return NewPackDecoder(r, PackDecoderOptions{}).readStr(MAX_VALUE_SIZE)
 }
 
 // WriteBufStr write string to buffer
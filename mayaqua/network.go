@@ -1,6 +1,14 @@
 package mayaqua
 
-import "math/rand"
+import (
+	"encoding/binary"
+	"math/rand"
+	"net"
+	"strconv"
+)
+
+// IPV6_UINT IPv4 part of an IPv6 address as set by SoftEther's SetIP6, 223.255.255.254
+const IPV6_UINT = uint32(0xfeffffdf)
 
 // GetError get error
 func (p *Pack) GetError() uint32 {
@@ -14,3 +22,43 @@ func (p *Pack) CreateDummyValue() {
 	rand.Read(buf)
 	p.AddData("pencore", buf)
 }
+
+// IPToUINT IPv4 address as uint32, the address bytes in memory order,
+// IPV6_UINT for IPv6 addresses
+func IPToUINT(ip net.IP) uint32 {
+	if ip4 := ip.To4(); nil != ip4 {
+		return binary.LittleEndian.Uint32(ip4)
+	} else if nil != ip.To16() {
+		return IPV6_UINT
+	}
+	return 0
+}
+
+// UINTToIP reverse of IPToUINT
+func UINTToIP(v uint32) net.IP {
+	ip := make(net.IP, net.IPv4len)
+	binary.LittleEndian.PutUint32(ip, v)
+	return ip
+}
+
+// ZoneToScopeId IPv6 scope id of a zone, either an index or an interface name
+func ZoneToScopeId(zone string) uint32 {
+	if "" == zone {
+		return 0
+	}
+	if i, err := strconv.ParseUint(zone, 10, 32); nil == err {
+		return uint32(i)
+	}
+	if ifi, err := net.InterfaceByName(zone); nil == err {
+		return uint32(ifi.Index)
+	}
+	return 0
+}
+
+// ScopeIdToZone zone of an IPv6 scope id, as its index
+func ScopeIdToZone(scopeId uint32) string {
+	if 0 == scopeId {
+		return ""
+	}
+	return strconv.FormatUint(uint64(scopeId), 10)
+}
@@ -5,7 +5,9 @@ import (
 	"encoding/binary"
 	"errors"
 	"io"
+	"net"
 	"strings"
+	"time"
 )
 
 // We use 64bit only considering golang will do the dirty work for us on 32bit machines
@@ -35,6 +37,7 @@ var (
 	INVALID_TYPE     = errors.New("Invalid type")
 	SAME_NAME_EXISTS = errors.New("Same name exists")
 	ZERO_NUM_VALUE   = errors.New("Zero num value")
+	NAME_TOO_LONG    = errors.New("Name too long")
 )
 
 // Value structure
@@ -66,109 +69,30 @@ func (e *Element) NumValue() uint32 {
 	return uint32(len(e.Values))
 }
 
-// Pack structure
+// Pack structure, Elements is changed by AddElement and RemoveElement only,
+// call Reindex after changing it directly
 type Pack struct {
 	Elements []*Element
 
 	JSONSubitemNames          []string
 	CurrentJsonHint_GroupName string
+
+	index map[string]*Element // Elements by upper case name
 }
 
 // ReadPack read pack from buf
 func ReadPack(r io.Reader) (*Pack, error) {
-	pack := &Pack{}
-	num := uint32(0)
-	if err := binary.Read(r, binary.BigEndian, &num); nil != err {
-		return nil, err
-	}
-	if num > MAX_ELEMENT_NUM {
-		return nil, NUMBER_EXCEEDS
-	}
-
-	pack.Elements = make([]*Element, 0, num)
-
-	for i := uint32(0); i < num; i++ {
-		if e, err := ReadElement(r); nil != err {
-			return nil, err
-		} else if err := pack.AddElement(e); nil != err {
-			return nil, err
-		}
-	}
-
-	return pack, nil
+	return NewPackDecoder(r, PackDecoderOptions{}).Decode()
 }
 
 // ReadElement read element from a reader
 func ReadElement(r io.Reader) (e *Element, err error) {
-	e = &Element{}
-	if e.Name, err = ReadBufStr(r); nil != err {
-		return nil, err
-	}
-
-	if err = binary.Read(r, binary.BigEndian, &e.Type); nil != err {
-		return nil, err
-	}
-
-	n := uint32(0)
-	if err = binary.Read(r, binary.BigEndian, &n); nil != err {
-		return nil, err
-	} else if n > MAX_VALUE_NUM {
-		return nil, NUMBER_EXCEEDS
-	}
-
-	e.Values = make([]Value, 0, n)
-	for i := uint32(0); i < n; i++ {
-		if v, err := ReadValue(r, e.Type); nil != err {
-			return nil, err
-		} else {
-			e.Values = append(e.Values, v)
-		}
-	}
-
-	return e, nil
+	return NewPackDecoder(r, PackDecoderOptions{}).readElement()
 }
 
 // ReadValue read value from a reader
 func ReadValue(r io.Reader, t ValueType) (v Value, err error) {
-	switch t {
-	case VALUE_INT:
-		if err = binary.Read(r, binary.BigEndian, &v.IntValue); nil != err {
-			return v, err
-		}
-	case VALUE_INT64:
-		if err = binary.Read(r, binary.BigEndian, &v.Int64Value); nil != err {
-			return v, err
-		}
-	case VALUE_DATA:
-		s := uint32(0)
-		if err = binary.Read(r, binary.BigEndian, &s); nil != err {
-			return v, err
-		} else if s > MAX_VALUE_SIZE {
-			return v, SIZE_OVER
-		}
-		v.Data = make([]uint8, int(s))
-		if _, err = io.ReadFull(r, v.Data); nil != err {
-			return v, err
-		}
-	case VALUE_STR:
-		s := uint32(0)
-		if err = binary.Read(r, binary.BigEndian, &s); nil != err {
-			return v, err
-		} else if s > MAX_VALUE_SIZE-1 {
-			return v, SIZE_OVER
-		}
-		d := make([]uint8, int(s))
-		if _, err = io.ReadFull(r, d); nil != err {
-			return v, err
-		}
-		v.Str = string(d)
-	case VALUE_UNISTR:
-		panic("unimplemented")
-	default:
-		return v, INVALID_TYPE
-	}
-
-	return v, nil
+	return NewPackDecoder(r, PackDecoderOptions{}).readValue(t)
 }
 
 // AddElement add element
@@ -186,20 +110,55 @@ func (p *Pack) AddElement(e *Element) error {
 
 	e.JsonHint_GroupName = p.CurrentJsonHint_GroupName
 	p.Elements = append(p.Elements, e)
+	if nil == p.index {
+		p.index = make(map[string]*Element)
+	}
+	p.index[strings.ToUpper(e.Name)] = e
 	return nil
 }
 
-// GetElement get element with type
-func (p *Pack) GetElement(name string, t ValueType) *Element {
-	n := strings.ToUpper(name)
+// RemoveElement remove element by case insensitive name
+func (p *Pack) RemoveElement(name string) bool {
+	e := p.lookup(name)
+	if nil == e {
+		return false
+	}
+	for i, x := range p.Elements {
+		if x == e {
+			p.Elements = append(p.Elements[:i], p.Elements[i+1:]...)
+			break
+		}
+	}
+	delete(p.index, strings.ToUpper(name))
+	return true
+}
+
+// Reindex rebuild the name index after Elements has been changed directly,
+// the first of elements with the same name wins
+func (p *Pack) Reindex() {
+	p.index = make(map[string]*Element, len(p.Elements))
 	for _, e := range p.Elements {
-		if n == strings.ToUpper(e.Name) && (t == ValueType(INFINITE) || t == e.Type) {
-			return e
+		n := strings.ToUpper(e.Name)
+		if _, ok := p.index[n]; !ok {
+			p.index[n] = e
 		}
 	}
+}
+
+// GetElement get element with type
+func (p *Pack) GetElement(name string, t ValueType) *Element {
+	if e := p.lookup(name); nil != e && (t == ValueType(INFINITE) || t == e.Type) {
+		return e
+	}
 	return nil
 }
 
+// lookup find an element by case insensitive name, the index is read only
+// here so that concurrent getters are safe
+func (p *Pack) lookup(name string) *Element {
+	return p.index[strings.ToUpper(name)]
+}
+
 // GetInt get integer
 func (p *Pack) GetInt(name string) uint32 {
 	return p.GetIntEx(name, 0)
@@ -214,6 +173,20 @@ func (p *Pack) GetIntEx(name string, index uint32) uint32 {
 	}
 }
 
+// GetInt64 get 64 bit integer
+func (p *Pack) GetInt64(name string) uint64 {
+	return p.GetInt64Ex(name, 0)
+}
+
+// GetInt64Ex get 64 bit integer with index
+func (p *Pack) GetInt64Ex(name string, index uint32) uint64 {
+	if e := p.GetElement(name, VALUE_INT64); nil == e {
+		return 0
+	} else {
+		return e.GetInt64Value(index)
+	}
+}
+
 // GetStr get string
 func (p *Pack) GetStr(name string) string {
 	return p.GetStrEx(name, 0)
@@ -228,6 +201,20 @@ func (p *Pack) GetStrEx(name string, index uint32) string {
 	}
 }
 
+// GetUniStr get unicode string
+func (p *Pack) GetUniStr(name string) string {
+	return p.GetUniStrEx(name, 0)
+}
+
+// GetUniStrEx get unicode string with index
+func (p *Pack) GetUniStrEx(name string, index uint32) string {
+	if e := p.GetElement(name, VALUE_UNISTR); nil == e {
+		return ""
+	} else {
+		return e.GetUniStrValue(index)
+	}
+}
+
 // GetDataEx get data
 func (p *Pack) GetData(name string) []byte {
 	return p.GetDataEx(name, 0)
@@ -264,6 +251,14 @@ func (e *Element) GetIntValue(index uint32) uint32 {
 	return e.Values[index].IntValue
 }
 
+// GetInt64Value get 64 bit integer value
+func (e *Element) GetInt64Value(index uint32) uint64 {
+	if index >= e.NumValue() {
+		return 0
+	}
+	return e.Values[index].Int64Value
+}
+
 // GetStrValue get string value
 func (e *Element) GetStrValue(index uint32) string {
 	if index >= e.NumValue() {
@@ -272,6 +267,14 @@ func (e *Element) GetStrValue(index uint32) string {
 	return e.Values[index].Str
 }
 
+// GetUniStrValue get unicode string value
+func (e *Element) GetUniStrValue(index uint32) string {
+	if index >= e.NumValue() {
+		return ""
+	}
+	return e.Values[index].UniStr
+}
+
 // GetDataValue get data value
 func (e *Element) GetDataValue(index uint32) []byte {
 	if index >= e.NumValue() {
@@ -301,6 +304,19 @@ func (p *Pack) AddStr(name string, str string) *Element {
 	return e
 }
 
+// AddUniStr add unicode string value
+func (p *Pack) AddUniStr(name string, str string) *Element {
+	e := &Element{
+		Name:   name,
+		Type:   VALUE_UNISTR,
+		Values: []Value{{UniStr: str}},
+	}
+	if err := p.AddElement(e); nil != err {
+		return nil
+	}
+	return e
+}
+
 // AddBool add bool (as integer)
 func (p *Pack) AddBool(name string, b bool) *Element {
 	v := uint32(0)
@@ -350,25 +366,220 @@ func (p *Pack) AddData(name string, data []byte) *Element {
 	return e
 }
 
-// AddIp32 add ipv4
-func (p *Pack) AddIp32(name string, ip uint32) *Element {
-	if e := p.AddBool(name+"@ipv6_bool", false); nil != e {
-		e.JsonHint_IsIP = true
+// AddInt64 add 64 bit integer value
+func (p *Pack) AddInt64(name string, i uint64) *Element {
+	e := &Element{
+		Name:   name,
+		Type:   VALUE_INT64,
+		Values: []Value{{Int64Value: i}},
 	}
-	if e := p.AddData(name+"@ipv6_array", make([]byte, 16)); nil != e {
-		e.JsonHint_IsIP = true
+	if err := p.AddElement(e); nil != err {
+		return nil
+	}
+	return e
+}
+
+// AddTime64 add date time, in milliseconds since the unix epoch
+func (p *Pack) AddTime64(name string, t uint64) *Element {
+	e := p.AddInt64(name, t)
+	if nil != e {
+		e.JsonHint_IsDateTime = true
+	}
+	return e
+}
+
+// AddTime64Ex add date time to an array
+func (p *Pack) AddTime64Ex(name string, t uint64, index, total uint32) *Element {
+	e := p.AddInt64Ex(name, t, index, total)
+	if nil != e {
+		e.JsonHint_IsDateTime = true
+	}
+	return e
+}
+
+// timeToMsec milliseconds since the unix epoch, UnixNano overflows out of
+// 1678-2262
+func timeToMsec(t time.Time) int64 {
+	return t.Unix()*1000 + int64(t.Nanosecond()/1e6)
+}
+
+// msecToTime the time at ms milliseconds since the unix epoch
+func msecToTime(ms int64) time.Time {
+	return time.Unix(ms/1000, (ms%1000)*1e6)
+}
+
+// SetCurrentJsonGroupName elements added from now on are rendered as members
+// of the objects of the json array named name, an empty name ends the group
+func (p *Pack) SetCurrentJsonGroupName(name string) {
+	p.CurrentJsonHint_GroupName = name
+	if "" == name {
+		return
+	}
+	for _, n := range p.JSONSubitemNames {
+		if strings.EqualFold(n, name) {
+			return
+		}
+	}
+	p.JSONSubitemNames = append(p.JSONSubitemNames, name)
+}
+
+// addValueEx set the index-th of total values of an array element, the
+// element is created with total zero values by the first call
+func (p *Pack) addValueEx(name string, t ValueType, v Value, index, total uint32) *Element {
+	if total == 0 || index >= total {
+		return nil
 	}
-	if e := p.AddInt(name+"@ipv6_scope_id", 0); nil != e {
-		e.JsonHint_IsIP = true
+
+	e := p.GetElement(name, t)
+	if nil != e {
+		if e.NumValue() < total {
+			return nil
+		}
+		e.Values[index] = v
+	} else {
+		e = &Element{
+			Name:   name,
+			Type:   t,
+			Values: make([]Value, total),
+		}
+		e.Values[index] = v
+		if err := p.AddElement(e); nil != err {
+			return nil
+		}
 	}
 
-	// ? BigEndian?
-	if e := p.AddInt(name, ip); nil != e {
-		e.JsonHint_IsIP = true
+	e.JsonHint_IsArray = true
+	return e
+}
+
+// AddIntEx add integer value to an array
+func (p *Pack) AddIntEx(name string, i uint32, index, total uint32) *Element {
+	return p.addValueEx(name, VALUE_INT, Value{IntValue: i}, index, total)
+}
+
+// AddInt64Ex add 64 bit integer value to an array
+func (p *Pack) AddInt64Ex(name string, i uint64, index, total uint32) *Element {
+	return p.addValueEx(name, VALUE_INT64, Value{Int64Value: i}, index, total)
+}
+
+// AddBoolEx add bool (as integer) to an array
+func (p *Pack) AddBoolEx(name string, b bool, index, total uint32) *Element {
+	v := uint32(0)
+	if b {
+		v = uint32(1)
+	}
+	e := p.AddIntEx(name, v, index, total)
+	if nil != e {
+		e.JsonHint_IsBool = true
+	}
+	return e
+}
+
+// AddStrEx add string value to an array
+func (p *Pack) AddStrEx(name string, str string, index, total uint32) *Element {
+	return p.addValueEx(name, VALUE_STR, Value{Str: str}, index, total)
+}
+
+// AddUniStrEx add unicode string value to an array
+func (p *Pack) AddUniStrEx(name string, str string, index, total uint32) *Element {
+	return p.addValueEx(name, VALUE_UNISTR, Value{UniStr: str}, index, total)
+}
+
+// AddDataEx add data value to an array
+func (p *Pack) AddDataEx(name string, data []byte, index, total uint32) *Element {
+	return p.addValueEx(name, VALUE_DATA, Value{Data: data}, index, total)
+}
+
+// AddIp32 add IPv4 address as SoftEther's uint32
+func (p *Pack) AddIp32(name string, ip uint32) *Element {
+	return p.AddIp(name, UINTToIP(ip))
+}
+
+// AddIp add IPv4 or IPv6 address
+func (p *Pack) AddIp(name string, ip net.IP) *Element {
+	return p.addIpEx(name, ip, 0, 0, 1, true)
+}
+
+// AddIpEx add IPv4 or IPv6 address to an array
+func (p *Pack) AddIpEx(name string, ip net.IP, index, total uint32) *Element {
+	return p.addIpEx(name, ip, 0, index, total, false)
+}
+
+// AddIpAddr add IPv4 or IPv6 address, the zone as the IPv6 scope id
+func (p *Pack) AddIpAddr(name string, addr *net.IPAddr) *Element {
+	return p.addIpEx(name, addr.IP, ZoneToScopeId(addr.Zone), 0, 1, true)
+}
+
+// addIpEx add an address as SoftEther's PackAddIpEx2, the IPv4 element, the
+// IPv6 flag, the IPv6 address and its scope id, single ones are not rendered
+// as json arrays
+func (p *Pack) addIpEx(name string, ip net.IP, scopeId uint32, index, total uint32, single bool) *Element {
+	if nil == ip.To16() {
+		ip = net.IPv4zero
+	}
+	ip4 := ip.To4()
+	ip6 := make([]byte, net.IPv6len)
+	if nil == ip4 {
+		copy(ip6, ip.To16())
+	} else {
+		scopeId = 0
+	}
+
+	hint := func(e *Element) *Element {
+		if nil != e {
+			e.JsonHint_IsIP = true
+			e.JsonHint_IsArray = !single
+		}
 		return e
 	}
+	hint(p.AddBoolEx(name+"@ipv6_bool", nil == ip4, index, total))
+	hint(p.AddDataEx(name+"@ipv6_array", ip6, index, total))
+	hint(p.AddIntEx(name+"@ipv6_scope_id", scopeId, index, total))
+	return hint(p.AddIntEx(name, IPToUINT(ip), index, total))
+}
 
-	return nil
+// GetIp32 get IPv4 address as SoftEther's uint32, 0 if there is none
+func (p *Pack) GetIp32(name string) uint32 {
+	if ip := p.GetIp(name); nil != ip && nil != ip.To4() {
+		return IPToUINT(ip)
+	}
+	return 0
+}
+
+// GetIp get IPv4 or IPv6 address, nil if there is none
+func (p *Pack) GetIp(name string) net.IP {
+	return p.GetIpEx(name, 0)
+}
+
+// GetIpEx get IPv4 or IPv6 address from an array
+func (p *Pack) GetIpEx(name string, index uint32) net.IP {
+	ip, _ := p.getIpEx(name, index)
+	return ip
+}
+
+// GetIpAddr get IPv4 or IPv6 address, the IPv6 scope id as the zone
+func (p *Pack) GetIpAddr(name string) *net.IPAddr {
+	ip, scopeId := p.getIpEx(name, 0)
+	if nil == ip {
+		return nil
+	}
+	return &net.IPAddr{IP: ip, Zone: ScopeIdToZone(scopeId)}
+}
+
+// getIpEx get an address as SoftEther's PackGetIpEx, nil if there is none
+func (p *Pack) getIpEx(name string, index uint32) (net.IP, uint32) {
+	if p.GetBoolEx(name+"@ipv6_bool", index) {
+		if b := p.GetDataEx(name+"@ipv6_array", index); len(b) == net.IPv6len {
+			return append(net.IP(nil), b...), p.GetIntEx(name+"@ipv6_scope_id", index)
+		}
+		return nil, 0
+	}
+
+	if e := p.GetElement(name, VALUE_INT); nil == e || index >= e.NumValue() {
+		return nil, 0
+	} else {
+		return UINTToIP(e.GetIntValue(index)), 0
+	}
 }
 
 // ToBuf To buffer
@@ -425,7 +636,13 @@ func (v *Value) Write(w io.Writer, t ValueType) error {
 		_, err := w.Write(b)
 		return err
 	case VALUE_UNISTR:
-		panic("unimplemented")
+		b := append([]byte(v.UniStr), 0)
+		s := uint32(len(b))
+		if err := binary.Write(w, binary.BigEndian, s); nil != err {
+			return err
+		}
+		_, err := w.Write(b)
+		return err
 	default:
 		return INVALID_TYPE
 	}
@@ -0,0 +1,82 @@
+//go:build go1.18
+// +build go1.18
+
+package mayaqua
+
+import (
+	"bytes"
+	"encoding/hex"
+	"testing"
+)
+
+func addPackSeeds(f *testing.F) {
+	p := &Pack{}
+	p.AddStr("hello", "world")
+	p.AddInt("version", 443)
+	p.AddData("random", make([]byte, SHA1_SIZE))
+	p.AddIp("ip", []byte{127, 0, 0, 1})
+	p.AddInt64("big", 1<<40)
+	p.AddUniStrEx("names", "é", 1, 2)
+	if b, err := p.ToBuf(); nil == err {
+		f.Add(b)
+	}
+	for _, fixture := range uniStrFixtures {
+		b, _ := hex.DecodeString(fixture.hex)
+		f.Add(b)
+	}
+	f.Add(pack(1, element("a", VALUE_DATA, 1, u32(MAX_VALUE_SIZE))))
+}
+
+func FuzzReadPack(f *testing.F) {
+	addPackSeeds(f)
+	f.Fuzz(func(t *testing.T, b []byte) {
+		p, err := ReadPack(bytes.NewReader(b))
+		if nil != err {
+			return
+		}
+
+		// what was read writes and reads back the same
+		out, err := p.ToBuf()
+		if nil != err {
+			t.Fatal(err)
+		}
+		q, err := ReadPack(bytes.NewReader(out))
+		if nil != err {
+			t.Fatal(err)
+		}
+		if again, err := q.ToBuf(); nil != err {
+			t.Fatal(err)
+		} else if !bytes.Equal(out, again) {
+			t.Errorf("%x became %x", out, again)
+		}
+	})
+}
+
+func FuzzPackDecoder(f *testing.F) {
+	addPackSeeds(f)
+	f.Fuzz(func(t *testing.T, b []byte) {
+		const budget = 256
+		r := bytes.NewReader(b)
+		p, err := NewPackDecoder(r, PackDecoderOptions{MaxTotalBytes: budget, MaxElements: 8}).Decode()
+		if read := len(b) - r.Len(); read > budget {
+			t.Fatal("read", read)
+		}
+		if nil != err {
+			return
+		}
+		if len(p.Elements) > 8 {
+			t.Fatal("elements", len(p.Elements))
+		}
+
+		// the same pack as without limits
+		q, err := ReadPack(bytes.NewReader(b))
+		if nil != err {
+			t.Fatal(err)
+		}
+		x, _ := p.ToBuf()
+		y, _ := q.ToBuf()
+		if !bytes.Equal(x, y) {
+			t.Errorf("%x differs from %x", x, y)
+		}
+	})
+}
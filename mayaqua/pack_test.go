@@ -0,0 +1,416 @@
+package mayaqua
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"net"
+	"strconv"
+	"testing"
+)
+
+func testPackBuf(t *testing.T) []byte {
+	p := &Pack{}
+	p.AddStr("hello", "world")
+	p.AddInt("version", 443)
+	p.AddData("random", make([]byte, SHA1_SIZE))
+	p.AddIp32("ip", 0x0100007f)
+
+	b, err := p.ToBuf()
+	if nil != err {
+		t.Fatal(err)
+	}
+	return b
+}
+
+// element build a raw element, name | type | values
+func element(name string, t ValueType, num uint32, values ...[]byte) []byte {
+	b := &bytes.Buffer{}
+	WriteBufStr(b, name)
+	binary.Write(b, binary.BigEndian, t)
+	binary.Write(b, binary.BigEndian, num)
+	for _, v := range values {
+		b.Write(v)
+	}
+	return b.Bytes()
+}
+
+func pack(num uint32, elements ...[]byte) []byte {
+	b := &bytes.Buffer{}
+	binary.Write(b, binary.BigEndian, num)
+	for _, e := range elements {
+		b.Write(e)
+	}
+	return b.Bytes()
+}
+
+func u32(v uint32) []byte {
+	b := make([]byte, 4)
+	binary.BigEndian.PutUint32(b, v)
+	return b
+}
+
+func TestReadPackMalformed(t *testing.T) {
+	tests := []struct {
+		name string
+		buf  []byte
+		err  error
+	}{
+		{"too many elements", pack(MAX_ELEMENT_NUM + 1), NUMBER_EXCEEDS},
+		{"too many values", pack(1, element("a", VALUE_INT, MAX_VALUE_NUM+1)), NUMBER_EXCEEDS},
+		{"unknown type", pack(1, element("a", 42, 1, u32(0))), INVALID_TYPE},
+		{"huge unistr", pack(1, element("a", VALUE_UNISTR, 1, u32(MAX_VALUE_SIZE+1))), SIZE_OVER},
+		{"no values", pack(1, element("a", VALUE_INT, 0)), ZERO_NUM_VALUE},
+		{"same name", pack(2, element("a", VALUE_INT, 1, u32(0)), element("A", VALUE_INT, 1, u32(0))), SAME_NAME_EXISTS},
+		{"empty name", pack(1, u32(0)), INVALID_STRING},
+		{"huge name", pack(1, u32(0xffffffff)), SIZE_OVER},
+		{"long name", pack(1, element(string(make([]byte, MAX_ELEMENT_NAME_LEN+1)), VALUE_INT, 1, u32(0))), NAME_TOO_LONG},
+		{"huge data", pack(1, element("a", VALUE_DATA, 1, u32(MAX_VALUE_SIZE+1))), SIZE_OVER},
+		{"huge str", pack(1, element("a", VALUE_STR, 1, u32(MAX_VALUE_SIZE))), SIZE_OVER},
+	}
+
+	for _, tt := range tests {
+		if _, err := ReadPack(bytes.NewReader(tt.buf)); err != tt.err {
+			t.Errorf("%s: got %v", tt.name, err)
+		}
+	}
+}
+
+func TestReadPackTruncated(t *testing.T) {
+	b := testPackBuf(t)
+	if _, err := ReadPack(bytes.NewReader(b)); nil != err {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < len(b); i++ {
+		if _, err := ReadPack(bytes.NewReader(b[:i])); nil == err {
+			t.Error("truncated at", i, "accepted")
+		}
+	}
+}
+
+func TestReadPackCorrupted(t *testing.T) {
+	b := testPackBuf(t)
+
+	// every single byte set to every interesting value, nothing may panic
+	for i := range b {
+		for _, x := range []byte{0x00, 0x01, 0x7f, 0x80, 0xff} {
+			c := append([]byte(nil), b...)
+			c[i] = x
+			ReadPack(bytes.NewReader(c))
+		}
+	}
+}
+
+func TestValueWriteInvalid(t *testing.T) {
+	p := &Pack{}
+	p.AddElement(&Element{Name: "a", Type: 42, Values: []Value{{}}})
+	if _, err := p.ToBuf(); err != INVALID_TYPE {
+		t.Error(err)
+	}
+}
+
+// unistr packs as written by the server
+var uniStrFixtures = []struct {
+	name   string
+	hex    string
+	values []string
+}{
+	{"Msg", "00000001" + "000000044d7367" + "00000003" + "00000001" +
+		"0000000e48656c6c6f2c20e4b896e7958c00", []string{"Hello, \u4e16\u754c"}},
+	{"Names", "00000001" + "000000064e616d6573" + "00000003" + "00000003" +
+		"0000000100" + "00000003c3bc00" + "00000005f09f988000", []string{"", "\u00fc", "\U0001f600"}},
+}
+
+func TestUniStrFixtures(t *testing.T) {
+	for _, f := range uniStrFixtures {
+		b, _ := hex.DecodeString(f.hex)
+		p, err := ReadPack(bytes.NewReader(b))
+		if nil != err {
+			t.Fatal(f.name, err)
+		}
+		for i, v := range f.values {
+			if s := p.GetUniStrEx(f.name, uint32(i)); s != v {
+				t.Errorf("%s[%d]: got %q", f.name, i, s)
+			}
+		}
+		if e := p.GetElement(f.name, VALUE_UNISTR); nil == e || int(e.NumValue()) != len(f.values) {
+			t.Error(f.name, "unexpected element")
+		}
+
+		// and back to the same bytes
+		if out, err := p.ToBuf(); nil != err {
+			t.Fatal(err)
+		} else if !bytes.Equal(out, b) {
+			t.Errorf("%s: got %x", f.name, out)
+		}
+	}
+}
+
+func TestUniStrLenient(t *testing.T) {
+	tests := []struct {
+		name  string
+		value []byte
+		want  string
+	}{
+		{"no terminator", []byte("hi"), "hi"},
+		{"early terminator", []byte("hi\x00xx\x00"), "hi"},
+		{"empty", []byte{}, ""},
+	}
+
+	for _, tt := range tests {
+		b := pack(1, element("a", VALUE_UNISTR, 1, u32(uint32(len(tt.value))), tt.value))
+		if p, err := ReadPack(bytes.NewReader(b)); nil != err {
+			t.Error(tt.name, err)
+		} else if s := p.GetUniStr("a"); s != tt.want {
+			t.Errorf("%s: got %q", tt.name, s)
+		}
+	}
+}
+
+func TestUniStrRoundTrip(t *testing.T) {
+	p := &Pack{}
+	p.AddUniStr("msg", "\u3053\u3093\u306b\u3061\u306f")
+	p.AddStr("str", "ansi")
+
+	b, err := p.ToBuf()
+	if nil != err {
+		t.Fatal(err)
+	}
+	if q, err := ReadPack(bytes.NewReader(b)); nil != err {
+		t.Fatal(err)
+	} else if q.GetUniStr("MSG") != "\u3053\u3093\u306b\u3061\u306f" {
+		t.Error("unexpected", q.GetUniStr("msg"))
+	} else if "" != q.GetUniStr("str") || "" != q.GetStr("msg") {
+		t.Error("types mixed up")
+	} else if "" != q.GetUniStrEx("msg", 1) {
+		t.Error("index out of range")
+	}
+}
+
+func TestInt64(t *testing.T) {
+	p := &Pack{}
+	p.AddInt64("big", 0x0123456789abcdef)
+	p.AddInt("small", 1)
+
+	b, err := p.ToBuf()
+	if nil != err {
+		t.Fatal(err)
+	}
+	want := pack(2,
+		element("big", VALUE_INT64, 1, []byte{0x01, 0x23, 0x45, 0x67, 0x89, 0xab, 0xcd, 0xef}),
+		element("small", VALUE_INT, 1, u32(1)))
+	if !bytes.Equal(b, want) {
+		t.Errorf("got %x", b)
+	}
+
+	q, err := ReadPack(bytes.NewReader(b))
+	if nil != err {
+		t.Fatal(err)
+	}
+	if q.GetInt64("big") != 0x0123456789abcdef {
+		t.Error("unexpected", q.GetInt64("big"))
+	}
+	if 0 != q.GetInt64("small") || 0 != q.GetInt("big") || 0 != q.GetInt64Ex("big", 1) {
+		t.Error("types or index mixed up")
+	}
+}
+
+func TestAddEx(t *testing.T) {
+	p := &Pack{}
+	names := []string{"a", "b", "c"}
+	for i, n := range names {
+		p.AddStrEx("name", n, uint32(i), uint32(len(names)))
+		p.AddIntEx("id", uint32(i+1), uint32(i), uint32(len(names)))
+		p.AddInt64Ex("bytes", uint64(i)<<40, uint32(i), uint32(len(names)))
+		p.AddDataEx("key", []byte(n), uint32(i), uint32(len(names)))
+		p.AddUniStrEx("title", n+"é", uint32(i), uint32(len(names)))
+		p.AddBoolEx("on", i%2 == 1, uint32(i), uint32(len(names)))
+	}
+
+	b, err := p.ToBuf()
+	if nil != err {
+		t.Fatal(err)
+	}
+	q, err := ReadPack(bytes.NewReader(b))
+	if nil != err {
+		t.Fatal(err)
+	}
+	if len(q.Elements) != 6 {
+		t.Fatal("elements", len(q.Elements))
+	}
+	for i, n := range names {
+		index := uint32(i)
+		if q.GetStrEx("name", index) != n ||
+			q.GetIntEx("id", index) != uint32(i+1) ||
+			q.GetInt64Ex("bytes", index) != uint64(i)<<40 ||
+			string(q.GetDataEx("key", index)) != n ||
+			q.GetUniStrEx("title", index) != n+"é" ||
+			q.GetBoolEx("on", index) != (i%2 == 1) {
+			t.Error("unexpected value at", i)
+		}
+	}
+
+	for _, e := range p.Elements {
+		if !e.JsonHint_IsArray || int(e.NumValue()) != len(names) {
+			t.Error(e.Name, "is not an array of", len(names))
+		}
+	}
+	if !p.GetElement("on", VALUE_INT).JsonHint_IsBool {
+		t.Error("bool hint lost")
+	}
+}
+
+func TestAddExSparse(t *testing.T) {
+	p := &Pack{}
+	// values not set yet are zero
+	e := p.AddIntEx("a", 7, 2, 4)
+	if nil == e || e.NumValue() != 4 || p.GetIntEx("a", 2) != 7 || p.GetIntEx("a", 0) != 0 {
+		t.Fatal("unexpected element")
+	}
+	// overwrite
+	p.AddIntEx("a", 8, 2, 4)
+	if p.GetIntEx("a", 2) != 8 {
+		t.Error("not overwritten")
+	}
+
+	if nil != p.AddIntEx("b", 1, 0, 0) || nil != p.AddIntEx("b", 1, 4, 4) {
+		t.Error("index out of range accepted")
+	}
+	if nil != p.AddIntEx("a", 1, 5, 6) {
+		t.Error("array grown")
+	}
+	if nil != p.AddStrEx("a", "x", 0, 4) {
+		t.Error("type changed")
+	}
+	if nil == p.AddInt("single", 1) || p.GetElement("single", VALUE_INT).JsonHint_IsArray {
+		t.Error("single value marked as array")
+	}
+}
+
+func TestIp(t *testing.T) {
+	p := &Pack{}
+	p.AddIp("v4", net.IPv4(192, 168, 0, 1))
+	p.AddIp32("v4u", IPToUINT(net.IPv4(10, 0, 0, 1)))
+	p.AddIpAddr("v6", &net.IPAddr{IP: net.ParseIP("fe80::1"), Zone: "3"})
+	for i, ip := range []string{"127.0.0.1", "::1"} {
+		p.AddIpEx("list", net.ParseIP(ip), uint32(i), 2)
+	}
+
+	// the four elements of SoftEther's PackAddIp
+	b, err := p.ToBuf()
+	if nil != err {
+		t.Fatal(err)
+	}
+	r := bytes.NewReader(b)
+	if p, err = ReadPack(r); nil != err {
+		t.Fatal(err)
+	}
+	v4 := pack(4,
+		element("v4@ipv6_bool", VALUE_INT, 1, u32(0)),
+		element("v4@ipv6_array", VALUE_DATA, 1, u32(16), make([]byte, 16)),
+		element("v4@ipv6_scope_id", VALUE_INT, 1, u32(0)),
+		element("v4", VALUE_INT, 1, []byte{1, 0, 168, 192}))
+	if !bytes.Equal(b[4:len(v4)], v4[4:]) {
+		t.Errorf("got %x", b[:len(v4)])
+	}
+
+	if !p.GetIp("v4").Equal(net.IPv4(192, 168, 0, 1)) || p.GetIp32("v4u") != IPToUINT(net.IPv4(10, 0, 0, 1)) {
+		t.Error("unexpected IPv4 address")
+	}
+	if a := p.GetIpAddr("v6"); nil == a || a.String() != "fe80::1%3" {
+		t.Error("unexpected IPv6 address", a)
+	}
+	if !p.GetBool("v6@ipv6_bool") || p.GetInt("v6") != IPV6_UINT || p.GetIp32("v6") != 0 {
+		t.Error("unexpected IPv6 elements")
+	}
+	if !p.GetIpEx("list", 0).Equal(net.IPv4(127, 0, 0, 1)) || !p.GetIpEx("list", 1).Equal(net.IPv6loopback) {
+		t.Error("unexpected array")
+	}
+	if nil != p.GetIp("none") || nil != p.GetIpAddr("none") || nil != p.GetIpEx("list", 2) {
+		t.Error("missing address found")
+	}
+}
+
+func TestIPToUINT(t *testing.T) {
+	if IPToUINT(net.IPv4(127, 0, 0, 1)) != 0x0100007f || IPToUINT(net.ParseIP("::1")) != IPV6_UINT || IPToUINT(nil) != 0 {
+		t.Error("unexpected")
+	}
+	if !UINTToIP(0x0100007f).Equal(net.IPv4(127, 0, 0, 1)) || !UINTToIP(IPV6_UINT).Equal(net.IPv4(223, 255, 255, 254)) {
+		t.Error("unexpected reverse")
+	}
+	if ZoneToScopeId("") != 0 || ZoneToScopeId("12") != 12 || ZoneToScopeId("no-such-interface") != 0 || ScopeIdToZone(12) != "12" {
+		t.Error("unexpected zone")
+	}
+}
+
+func TestGetElementIndex(t *testing.T) {
+	p := &Pack{}
+	p.AddInt("Port", 443)
+	p.AddStr("HubName", "DEFAULT")
+	if nil == p.GetElement("PORT", VALUE_INT) || nil == p.GetElement("hubname", VALUE_STR) || nil != p.GetElement("port", VALUE_STR) {
+		t.Error("lookup failed")
+	}
+	if nil != p.AddInt("PORT", 1) || len(p.Elements) != 2 {
+		t.Error("same name added")
+	}
+
+	if !p.RemoveElement("PORT") || p.RemoveElement("port") || nil != p.GetElement("port", ValueType(INFINITE)) || len(p.Elements) != 1 {
+		t.Error("element not removed")
+	}
+	if nil == p.AddInt("Port", 80) || 80 != p.GetInt("port") {
+		t.Error("element not added again")
+	}
+
+	// Elements changed directly
+	p.Elements[1] = &Element{Name: "Extra", Type: VALUE_INT, Values: []Value{{IntValue: 1}}}
+	if 80 != p.GetInt("port") || 0 != p.GetInt("extra") {
+		t.Error("index changed before Reindex")
+	}
+	p.Reindex()
+	if nil != p.GetElement("port", ValueType(INFINITE)) || 1 != p.GetInt("extra") || "DEFAULT" != p.GetStr("HubName") {
+		t.Error("index not rebuilt")
+	}
+}
+
+// benchmarkPackBuf a pack of n elements as large RPC replies are
+func benchmarkPackBuf(b *testing.B, n int) []byte {
+	p := &Pack{}
+	p.Elements = make([]*Element, 0, n)
+	for i := 0; i < n; i++ {
+		p.AddInt("SessionKey"+strconv.Itoa(i), uint32(i))
+	}
+	buf, err := p.ToBuf()
+	if nil != err {
+		b.Fatal(err)
+	}
+	return buf
+}
+
+func BenchmarkReadPack(b *testing.B) {
+	for _, n := range []int{100, 10000, MAX_ELEMENT_NUM} {
+		b.Run(strconv.Itoa(n), func(b *testing.B) {
+			buf := benchmarkPackBuf(b, n)
+			b.SetBytes(int64(len(buf)))
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, err := ReadPack(bytes.NewReader(buf)); nil != err {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkGetElement(b *testing.B) {
+	p, err := ReadPack(bytes.NewReader(benchmarkPackBuf(b, 10000)))
+	if nil != err {
+		b.Fatal(err)
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if p.GetInt("sessionkey"+strconv.Itoa(i%10000)) != uint32(i%10000) {
+			b.Fatal("unexpected")
+		}
+	}
+}
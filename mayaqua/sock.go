@@ -2,8 +2,11 @@ package mayaqua
 
 import (
 	"bufio"
+	"context"
 	"crypto/tls"
+	"errors"
 	"net"
+	"time"
 )
 
 // Sock used by go-softether
@@ -31,6 +34,31 @@ func (s *Sock) Close() error {
 	return s.conn.Close()
 }
 
+// LocalAddr local address of the underlying tcp stream
+func (s *Sock) LocalAddr() net.Addr {
+	return s.raw.LocalAddr()
+}
+
+// RemoteAddr remote address of the underlying tcp stream
+func (s *Sock) RemoteAddr() net.Addr {
+	return s.raw.RemoteAddr()
+}
+
+// SetDeadline set read & write deadline
+func (s *Sock) SetDeadline(t time.Time) error {
+	return s.conn.SetDeadline(t)
+}
+
+// SetReadDeadline set read deadline
+func (s *Sock) SetReadDeadline(t time.Time) error {
+	return s.conn.SetReadDeadline(t)
+}
+
+// SetWriteDeadline set write deadline
+func (s *Sock) SetWriteDeadline(t time.Time) error {
+	return s.conn.SetWriteDeadline(t)
+}
+
 // NewSock new sock
 func NewSock(s *tls.Conn, r net.Conn) *Sock {
 	return &Sock{
@@ -40,3 +68,64 @@ func NewSock(s *tls.Conn, r net.Conn) *Sock {
 		RemoteIP: s.RemoteAddr().(*net.TCPAddr).IP.String(),
 	}
 }
+
+// deadliner a stream with deadlines
+type deadliner interface {
+	SetDeadline(t time.Time) error
+}
+
+// WatchContext bound the blocking calls on c by the deadline of ctx and abort
+// them as soon as ctx is done, until stop is called
+func WatchContext(ctx context.Context, c deadliner) (stop func()) {
+	deadline, ok := ctx.Deadline()
+	if !ok && nil == ctx.Done() {
+		// never done
+		return func() {}
+	}
+	if ok {
+		c.SetDeadline(deadline)
+	}
+
+	done, exited := make(chan struct{}), make(chan struct{})
+	go func() {
+		defer close(exited)
+		select {
+		case <-ctx.Done():
+			// wake up the blocked calls
+			c.SetDeadline(time.Unix(1, 0))
+		case <-done:
+		}
+	}()
+	return func() {
+		close(done)
+		<-exited
+		c.SetDeadline(time.Time{})
+	}
+}
+
+// ContextError the error of ctx if it is done, which is the reason of err,
+// a timeout at the deadline of ctx is one too even if ctx does not know yet
+func ContextError(ctx context.Context, err error) error {
+	if nil == err {
+		return nil
+	}
+	if nil != ctx.Err() {
+		return ctx.Err()
+	}
+	var ne net.Error
+	if errors.As(err, &ne) && ne.Timeout() {
+		if e := ContextDone(ctx); nil != e {
+			return e
+		}
+	}
+	return err
+}
+
+// ContextDone the error of ctx if it is done or its deadline has passed, the
+// socket timers may fire a little before the one of ctx
+func ContextDone(ctx context.Context) error {
+	if deadline, ok := ctx.Deadline(); ok && !time.Now().Before(deadline) {
+		<-ctx.Done()
+	}
+	return ctx.Err()
+}
@@ -0,0 +1,74 @@
+package mayaqua
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestWatchContext(t *testing.T) {
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+
+	// cancellation wakes up a blocked read
+	ctx, cancel := context.WithCancel(context.Background())
+	stop := WatchContext(ctx, a)
+	time.AfterFunc(50*time.Millisecond, cancel)
+	if _, err := a.Read(make([]byte, 1)); nil == err {
+		t.Fatal("read not aborted")
+	} else if err := ContextError(ctx, err); context.Canceled != err {
+		t.Error("unexpected error", err)
+	}
+	stop()
+
+	// reads block again once stopped
+	go b.Write([]byte{1})
+	if _, err := a.Read(make([]byte, 1)); nil != err {
+		t.Error(err)
+	}
+
+	// the deadline of ctx applies
+	ctx, cancel = context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	stop = WatchContext(ctx, a)
+	if _, err := a.Read(make([]byte, 1)); nil == err {
+		t.Fatal("read not aborted")
+	}
+	stop()
+
+	// a context never done leaves the stream alone
+	stop = WatchContext(context.Background(), a)
+	go b.Write([]byte{1})
+	if _, err := a.Read(make([]byte, 1)); nil != err {
+		t.Error(err)
+	}
+	stop()
+
+	if err := errors.New("other"); ContextError(context.Background(), err) != err {
+		t.Error("error replaced")
+	}
+
+	// the socket timer fired before the one of ctx
+	ctx, cancel = context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	late := lateContext{ctx}
+	a.SetDeadline(time.Now().Add(-time.Second))
+	if _, err := a.Read(make([]byte, 1)); nil == err {
+		t.Fatal("read not aborted")
+	} else if err := ContextError(late, err); context.DeadlineExceeded != err {
+		t.Error("unexpected error", err)
+	}
+	a.SetDeadline(time.Time{})
+}
+
+// lateContext a context whose deadline has passed before it is done
+type lateContext struct {
+	context.Context
+}
+
+func (c lateContext) Deadline() (time.Time, bool) {
+	return time.Now().Add(-time.Millisecond), true
+}